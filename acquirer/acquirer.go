@@ -2,12 +2,25 @@ package acquirer
 
 import (
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/google/uuid"
+	"mkuznets.com/go/upsp/money"
 )
 
 const (
 	expected3dsResponse = "123456"
+
+	// winningDisputeEvidence is the evidence that makes the issuer resolve a dispute in favour of the merchant.
+	winningDisputeEvidence = "winning_evidence"
+
+	// disputeDelay is the time after the confirmation when the test cards open a dispute.
+	disputeDelay = 30 * time.Second
+	// disputeEvidencePeriod is the time given to the merchant to submit the dispute evidence.
+	disputeEvidencePeriod = 10 * time.Minute
+	// disputeReviewDelay is the time the issuer takes to review the submitted evidence.
+	disputeReviewDelay = 30 * time.Second
 )
 
 type Acquirer interface {
@@ -18,21 +31,47 @@ type Acquirer interface {
 	Submit3dSecure(id PaymentId, version string, req *Submit3dSecureRequest) (*Submit3dSecureResponse, error)
 	ConfirmPayment(id PaymentId, version string) (*ConfirmPaymentResponse, error)
 	CancelPayment(id PaymentId, version string) (*CancelPaymentResponse, error)
+	GetDispute(DisputeId) (*DisputeResource, error)
+	ListDisputes() ([]*DisputeResource, error)
+	SubmitDisputeEvidence(id DisputeId, version string, req *SubmitDisputeEvidenceRequest) (*SubmitDisputeEvidenceResponse, error)
+	ListSettlementBatches() ([]*SettlementBatchResource, error)
+	GetSettlementReport(id SettlementBatchId, format SettlementReportFormat) ([]byte, error)
 }
 
 type acquirerImpl struct {
-	s Store
+	s                Store
+	settlementCutoff time.Duration
 }
 
-func New(s Store) Acquirer {
-	return &acquirerImpl{
+// Option configures the acquirer.
+type Option func(*acquirerImpl)
+
+// WithSettlementCutoff sets the daily time at which the settlement batches are closed, as an offset from midnight UTC.
+func WithSettlementCutoff(cutoff time.Duration) Option {
+	return func(a *acquirerImpl) {
+		a.settlementCutoff = cutoff % (24 * time.Hour)
+		if a.settlementCutoff < 0 {
+			a.settlementCutoff += 24 * time.Hour
+		}
+	}
+}
+
+func New(s Store, opts ...Option) Acquirer {
+	a := &acquirerImpl{
 		s: s,
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 func (a *acquirerImpl) Start() {
 	go a.asyncRefunder()
 	go a.asyncTimeouter()
+	go a.asyncDisputer()
+	go a.asyncDisputeResolver()
+	go a.asyncSettler()
 }
 
 // GetPayment returns a payment instance.
@@ -43,19 +82,21 @@ func (a *acquirerImpl) GetPayment(id PaymentId) (*PaymentResource, error) {
 	}
 
 	return &PaymentResource{
-		Id:      p.Id,
-		State:   p.State(),
-		Version: p.Version,
+		Id:           p.Id,
+		State:        p.State(),
+		Version:      p.Version,
+		RejectReason: p.RejectReason,
+		DisputeId:    p.DisputeId,
 	}, nil
 }
 
 // CreatePayment creates a new payment for the given amount and currency.
 func (a *acquirerImpl) CreatePayment(req *CreatePaymentRequest) (*CreatePaymentResponse, error) {
 	p := &Payment{
-		Id:       req.Id,
-		Version:  uuid.NewString(),
-		Amount:   req.Amount,
-		Currency: req.Currency,
+		Id:            req.Id,
+		Version:       uuid.NewString(),
+		Money:         money.New(req.Amount, req.Currency),
+		Force3dSecure: req.Force3dSecure,
 	}
 	_ = p.SetState(PaymentStateNew)
 
@@ -86,7 +127,7 @@ func (a *acquirerImpl) AuthorisePayment(id PaymentId, version string, req *Autho
 		m.CardHolder = req.CardHolder
 		m.Cvv = req.Cvv
 
-		if is3dSecureRequired(m.CardNumber) {
+		if m.Force3dSecure || is3dSecureRequired(m.CardNumber) {
 			if err := m.SetState(PaymentState3dSecureRequired); err != nil {
 				return err
 			}
@@ -108,9 +149,10 @@ func (a *acquirerImpl) AuthorisePayment(id PaymentId, version string, req *Autho
 
 	return &AuthorisePaymentResponse{
 		Payment: PaymentResource{
-			Id:      p.Id,
-			State:   p.State(),
-			Version: p.Version,
+			Id:           p.Id,
+			State:        p.State(),
+			Version:      p.Version,
+			RejectReason: p.RejectReason,
 		},
 		AuthUrl: authUrl,
 	}, nil
@@ -127,6 +169,7 @@ func (a *acquirerImpl) Submit3dSecure(id PaymentId, version string, req *Submit3
 			if err := m.SetState(PaymentStateRejected); err != nil {
 				return err
 			}
+			m.RejectReason = RejectReason3dsFailed
 		} else {
 			if err := m.SetState(PaymentStateAuthorising); err != nil {
 				return err
@@ -143,9 +186,10 @@ func (a *acquirerImpl) Submit3dSecure(id PaymentId, version string, req *Submit3
 
 	return &Submit3dSecureResponse{
 		Payment: PaymentResource{
-			Id:      p.Id,
-			State:   p.State(),
-			Version: p.Version,
+			Id:           p.Id,
+			State:        p.State(),
+			Version:      p.Version,
+			RejectReason: p.RejectReason,
 		},
 	}, nil
 }
@@ -158,12 +202,14 @@ func (a *acquirerImpl) ConfirmPayment(id PaymentId, version string) (*ConfirmPay
 	if err != nil {
 		return nil, err
 	}
+	a.addSettlementEntry(p, SettlementEntryPayment)
 
 	return &ConfirmPaymentResponse{
 		Payment: PaymentResource{
-			Id:      p.Id,
-			State:   p.State(),
-			Version: p.Version,
+			Id:           p.Id,
+			State:        p.State(),
+			Version:      p.Version,
+			RejectReason: p.RejectReason,
 		},
 	}, nil
 }
@@ -182,6 +228,7 @@ func (a *acquirerImpl) CancelPayment(id PaymentId, version string) (*CancelPayme
 			newState = PaymentStateRefunded
 		case PaymentState3dSecureRequired:
 			newState = PaymentStateRejected
+			m.RejectReason = RejectReason3dsTimeout
 		default:
 			return fmt.Errorf("cannot cancel payment in state %s", m.State())
 		}
@@ -195,20 +242,200 @@ func (a *acquirerImpl) CancelPayment(id PaymentId, version string) (*CancelPayme
 	if err != nil {
 		return nil, err
 	}
+	if p.State() == PaymentStateRefunded {
+		a.addSettlementEntry(p, SettlementEntryRefund)
+	}
 
 	return &CancelPaymentResponse{
 		Payment: PaymentResource{
-			Id:      p.Id,
-			State:   p.State(),
-			Version: p.Version,
+			Id:           p.Id,
+			State:        p.State(),
+			Version:      p.Version,
+			RejectReason: p.RejectReason,
 		},
 	}, nil
 }
 
+// GetDispute returns a dispute instance.
+func (a *acquirerImpl) GetDispute(id DisputeId) (*DisputeResource, error) {
+	d, err := a.s.GetDispute(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDisputeResource(d), nil
+}
+
+// ListDisputes returns all disputes raised against the acquirer payments.
+func (a *acquirerImpl) ListDisputes() ([]*DisputeResource, error) {
+	disputes, err := a.s.ListDisputes()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]*DisputeResource, 0, len(disputes))
+	for _, d := range disputes {
+		resources = append(resources, newDisputeResource(d))
+	}
+	return resources, nil
+}
+
+// SubmitDisputeEvidence submits the merchant evidence for an open dispute and sends it for review.
+func (a *acquirerImpl) SubmitDisputeEvidence(id DisputeId, version string, req *SubmitDisputeEvidenceRequest) (*SubmitDisputeEvidenceResponse, error) {
+	d, err := a.s.UpdateDispute(id, version, func(m *Dispute) error {
+		if m.State() != DisputeStateOpen {
+			return fmt.Errorf("dispute %s is not in open", m.Id)
+		}
+		if m.EvidenceDueBy.Before(time.Now()) {
+			return fmt.Errorf("dispute %s evidence is overdue", m.Id)
+		}
+
+		m.Evidence = req.Evidence
+		return m.SetState(DisputeStateUnderReview)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubmitDisputeEvidenceResponse{
+		Dispute: *newDisputeResource(d),
+	}, nil
+}
+
+// openDispute moves a confirmed payment to disputed and creates a dispute with the given reason.
+func (a *acquirerImpl) openDispute(payment *Payment, reason DisputeReason) (*Dispute, error) {
+	dId := DisputeId(uuid.NewString())
+
+	p, err := a.s.Update(payment.Id, payment.Version, func(m *Payment) error {
+		if m.DisputeId != "" {
+			return fmt.Errorf("payment %s has already been disputed", m.Id)
+		}
+		m.DisputeId = dId
+		return m.SetState(PaymentStateDisputed)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispute{
+		Id:            dId,
+		PaymentId:     p.Id,
+		Version:       uuid.NewString(),
+		Reason:        reason,
+		Amount:        p.Amount,
+		Currency:      p.Currency,
+		EvidenceDueBy: time.Now().Add(disputeEvidencePeriod),
+	}
+	_ = d.SetState(DisputeStateOpen)
+
+	return a.s.CreateDispute(d)
+}
+
+// resolveDispute finalises the dispute and moves the disputed payment either back to confirmed or to charged back.
+// The payment is moved first, so that a failure leaves the dispute unresolved and it is resolved again later.
+// If the payment has already been moved by a previous attempt, only the dispute is finalised.
+func (a *acquirerImpl) resolveDispute(dispute *Dispute, won bool) error {
+	newState, newPaymentState := DisputeStateLost, PaymentStateChargedBack
+	if won {
+		newState, newPaymentState = DisputeStateWon, PaymentStateConfirmed
+	}
+
+	p, err := a.s.Get(dispute.PaymentId)
+	if err != nil {
+		return err
+	}
+
+	if p.State() == PaymentStateDisputed {
+		p, err = a.s.Update(p.Id, p.Version, func(m *Payment) error {
+			if m.DisputeId != dispute.Id {
+				return fmt.Errorf("payment %s is disputed by %s", m.Id, m.DisputeId)
+			}
+			return m.SetState(newPaymentState)
+		})
+		if err != nil {
+			return err
+		}
+		if !won {
+			a.addSettlementEntry(p, SettlementEntryChargeback)
+		}
+	} else if p.State() != newPaymentState {
+		return fmt.Errorf("payment %s is in %s", p.Id, p.State())
+	}
+
+	_, err = a.s.UpdateDispute(dispute.Id, dispute.Version, func(m *Dispute) error {
+		return m.SetState(newState)
+	})
+	return err
+}
+
+// ListSettlementBatches returns all closed settlement batches ordered by the cut-off time.
+func (a *acquirerImpl) ListSettlementBatches() ([]*SettlementBatchResource, error) {
+	batches, err := a.s.ListSettlementBatches()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make([]*SettlementBatchResource, 0, len(batches))
+	for _, b := range batches {
+		resources = append(resources, &SettlementBatchResource{
+			Id:         b.Id,
+			Date:       b.Date,
+			Currency:   b.Currency,
+			CutoffAt:   b.CutoffAt,
+			Gross:      b.Gross,
+			Fees:       b.Fees,
+			Net:        b.Net,
+			EntryCount: len(b.Entries),
+		})
+	}
+	return resources, nil
+}
+
+// GetSettlementReport returns the settlement report file of the given batch in the requested format.
+func (a *acquirerImpl) GetSettlementReport(id SettlementBatchId, format SettlementReportFormat) ([]byte, error) {
+	b, err := a.s.GetSettlementBatch(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderSettlementReport(b, format)
+}
+
+// closeSettlementBatches settles all pending entries created before the most recent cut-off.
+func (a *acquirerImpl) closeSettlementBatches(now time.Time) ([]*SettlementBatch, error) {
+	return a.s.CloseSettlementBatches(lastCutoff(now, a.settlementCutoff), func(entries []*SettlementEntry) []*SettlementBatch {
+		batches := newSettlementBatches(entries, a.settlementCutoff)
+		for _, b := range batches {
+			b.Id = SettlementBatchId(uuid.NewString())
+		}
+		return batches
+	})
+}
+
+func (a *acquirerImpl) addSettlementEntry(p *Payment, entryType SettlementEntryType) {
+	if err := a.s.AddSettlementEntry(newSettlementEntry(p, entryType)); err != nil {
+		log.Printf("[ERR] failed to add %s settlement entry for payment %s: %s", entryType, p.Id, err)
+	}
+}
+
+func newDisputeResource(d *Dispute) *DisputeResource {
+	return &DisputeResource{
+		Id:            d.Id,
+		PaymentId:     d.PaymentId,
+		State:         d.State(),
+		Version:       d.Version,
+		Reason:        d.Reason,
+		Amount:        d.Amount,
+		Currency:      d.Currency,
+		EvidenceDueBy: d.EvidenceDueBy,
+	}
+}
+
 func authoriseOrReject(p *Payment) error {
 	if isSuccess(p.CardNumber) {
 		return p.SetState(PaymentStateAuthorised)
 	} else {
+		p.RejectReason = RejectReasonDeclined
 		return p.SetState(PaymentStateRejected)
 	}
 }
@@ -1,8 +1,10 @@
 package acquirer
 
 import (
+	"errors"
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -103,3 +105,169 @@ func TestAcquirer_AuthorisePayment(t *testing.T) {
 		assert.Equal(t, []PaymentState{"authorised", "3d_secure_required", "rejected", "rejected"}, states)
 	})
 }
+
+func TestAcquirer_Disputes(t *testing.T) {
+	confirmed := func(t *testing.T, acq *acquirerImpl, card string) *Payment {
+		py, err := acq.CreatePayment(&CreatePaymentRequest{
+			Id:       PaymentId(uuid.NewString()),
+			Amount:   100,
+			Currency: "GBP",
+		})
+		require.NoError(t, err)
+
+		rAuth, err := acq.AuthorisePayment(py.Id, py.Version, &AuthorisePaymentRequest{
+			CardNumber: card,
+			ExpiryDate: "1077",
+			CardHolder: "John Doe",
+			Cvv:        "123",
+		})
+		require.NoError(t, err)
+
+		rConfirm, err := acq.ConfirmPayment(rAuth.Payment.Id, rAuth.Payment.Version)
+		require.NoError(t, err)
+		require.Equal(t, PaymentStateConfirmed, rConfirm.Payment.State)
+
+		p, err := acq.s.Get(py.Id)
+		require.NoError(t, err)
+		return p
+	}
+
+	t.Run("open", func(t *testing.T) {
+		acq := New(NewStore()).(*acquirerImpl)
+		p := confirmed(t, acq, "4000000000000259")
+
+		d, err := acq.openDispute(p, DisputeReasonFraudulent)
+		require.NoError(t, err)
+
+		rGet, err := acq.GetPayment(p.Id)
+		require.NoError(t, err)
+		assert.Equal(t, PaymentStateDisputed, rGet.State)
+		assert.Equal(t, d.Id, rGet.DisputeId)
+
+		rDispute, err := acq.GetDispute(d.Id)
+		require.NoError(t, err)
+		assert.Equal(t, DisputeStateOpen, rDispute.State)
+		assert.Equal(t, DisputeReasonFraudulent, rDispute.Reason)
+		assert.Equal(t, int64(100), rDispute.Amount)
+		assert.True(t, rDispute.EvidenceDueBy.After(time.Now()))
+
+		disputes, err := acq.ListDisputes()
+		require.NoError(t, err)
+		assert.Len(t, disputes, 1)
+
+		// The payment cannot be disputed twice.
+		p, err = acq.s.Get(p.Id)
+		require.NoError(t, err)
+		_, err = acq.openDispute(p, DisputeReasonFraudulent)
+		assert.ErrorContains(t, err, "already been disputed")
+	})
+
+	t.Run("resolution", func(t *testing.T) {
+		for evidence, expected := range map[string]PaymentState{
+			winningDisputeEvidence: PaymentStateConfirmed,
+			"losing_evidence":      PaymentStateChargedBack,
+		} {
+			acq := New(NewStore()).(*acquirerImpl)
+			p := confirmed(t, acq, "4000000000002685")
+
+			d, err := acq.openDispute(p, DisputeReasonProductNotReceived)
+			require.NoError(t, err)
+
+			rEvidence, err := acq.SubmitDisputeEvidence(d.Id, d.Version, &SubmitDisputeEvidenceRequest{Evidence: evidence})
+			require.NoError(t, err)
+			assert.Equal(t, DisputeStateUnderReview, rEvidence.Dispute.State)
+
+			_, err = acq.SubmitDisputeEvidence(d.Id, rEvidence.Dispute.Version, &SubmitDisputeEvidenceRequest{Evidence: evidence})
+			assert.ErrorContains(t, err, "is not in open")
+
+			d, err = acq.s.GetDispute(d.Id)
+			require.NoError(t, err)
+			require.NoError(t, acq.resolveDispute(d, d.Evidence == winningDisputeEvidence))
+
+			rGet, err := acq.GetPayment(p.Id)
+			require.NoError(t, err)
+			assert.Equal(t, expected, rGet.State)
+		}
+	})
+
+	t.Run("resolution failure", func(t *testing.T) {
+		s := &failingStore{Store: NewStore()}
+		acq := New(s).(*acquirerImpl)
+		p := confirmed(t, acq, "4000000000002685")
+
+		d, err := acq.openDispute(p, DisputeReasonFraudulent)
+		require.NoError(t, err)
+
+		s.failUpdate = true
+		assert.ErrorIs(t, acq.resolveDispute(d, false), errStoreFailure)
+		d, err = acq.s.GetDispute(d.Id)
+		require.NoError(t, err)
+		assert.Equal(t, DisputeStateOpen, d.State(), "dispute must stay unresolved if the payment is not updated")
+
+		s.failUpdate, s.failUpdateDispute = false, true
+		assert.ErrorIs(t, acq.resolveDispute(d, false), errStoreFailure)
+		rGet, err := acq.GetPayment(p.Id)
+		require.NoError(t, err)
+		assert.Equal(t, PaymentStateChargedBack, rGet.State)
+
+		// The next attempt finalises the dispute without charging the payment back again.
+		s.failUpdateDispute = false
+		require.NoError(t, acq.resolveDispute(d, false))
+		d, err = acq.s.GetDispute(d.Id)
+		require.NoError(t, err)
+		assert.Equal(t, DisputeStateLost, d.State())
+
+		batches, err := acq.closeSettlementBatches(time.Now().Add(48 * time.Hour))
+		require.NoError(t, err)
+		chargebacks := 0
+		for _, b := range batches {
+			for _, e := range b.Entries {
+				if e.Type == SettlementEntryChargeback {
+					chargebacks++
+				}
+			}
+		}
+		assert.Equal(t, 1, chargebacks)
+	})
+
+	t.Run("overdue evidence", func(t *testing.T) {
+		acq := New(NewStore()).(*acquirerImpl)
+		p := confirmed(t, acq, "4000000000001976")
+
+		d, err := acq.openDispute(p, DisputeReasonDuplicate)
+		require.NoError(t, err)
+
+		d, err = acq.s.UpdateDispute(d.Id, d.Version, func(m *Dispute) error {
+			m.EvidenceDueBy = time.Now().Add(-time.Minute)
+			return nil
+		})
+		require.NoError(t, err)
+
+		_, err = acq.SubmitDisputeEvidence(d.Id, d.Version, &SubmitDisputeEvidenceRequest{Evidence: winningDisputeEvidence})
+		assert.ErrorContains(t, err, "overdue")
+	})
+}
+
+var errStoreFailure = errors.New("store failure")
+
+// failingStore fails the payment and dispute updates as configured and passes the rest to the wrapped store.
+type failingStore struct {
+	Store
+
+	failUpdate        bool
+	failUpdateDispute bool
+}
+
+func (s *failingStore) Update(id PaymentId, version string, fn func(*Payment) error) (*Payment, error) {
+	if s.failUpdate {
+		return nil, errStoreFailure
+	}
+	return s.Store.Update(id, version, fn)
+}
+
+func (s *failingStore) UpdateDispute(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error) {
+	if s.failUpdateDispute {
+		return nil, errStoreFailure
+	}
+	return s.Store.UpdateDispute(id, version, fn)
+}
@@ -14,14 +14,31 @@ var (
 	cardsNo3dsSuccess = []string{
 		"4242424242424242",
 		"5555555555554444",
+		"2223003122003222",    // Mastercard, 2-series BIN
+		"378282246310005",     // Amex, 15 digits
+		"6011111111111117",    // Discover
+		"36227206271667",      // Diners Club, 14 digits
+		"3566002020360505",    // JCB
+		"6200000000000005",    // UnionPay
+		"6205500000000000004", // UnionPay, 19 digits
+		"6759000000000000005", // Maestro, 19 digits
 		"4000000000007726",
 		"4000000000005126",
+		"4000000000000259",
+		"4000000000002685",
+		"4000000000001976",
 	}
 
 	cardsRefunded = []string{
 		"4000000000007726",
 		"4000000000005126",
 	}
+
+	cardsDisputed = map[string]DisputeReason{
+		"4000000000000259": DisputeReasonFraudulent,
+		"4000000000002685": DisputeReasonProductNotReceived,
+		"4000000000001976": DisputeReasonDuplicate,
+	}
 )
 
 func is3dSecureRequired(cardNumber string) bool {
@@ -60,3 +77,8 @@ func shouldRefund(cardNumber string) bool {
 	}
 	return false
 }
+
+func disputeReason(cardNumber string) (DisputeReason, bool) {
+	reason, ok := cardsDisputed[cardNumber]
+	return reason, ok
+}
@@ -0,0 +1,88 @@
+package acquirer
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	DisputeId     string
+	DisputeState  string
+	DisputeReason string
+)
+
+const (
+	emptyDisputeState DisputeState = ""
+
+	// DisputeStateOpen is the initial state of a dispute that is waiting for the merchant evidence.
+	DisputeStateOpen DisputeState = "open"
+
+	// DisputeStateUnderReview is the state of a dispute whose evidence is being reviewed by the issuer.
+	DisputeStateUnderReview DisputeState = "under_review"
+
+	// DisputeStateWon is the state of a dispute that has been resolved in favour of the merchant. Final state.
+	DisputeStateWon DisputeState = "won"
+
+	// DisputeStateLost is the state of a dispute that has been resolved in favour of the cardholder. Final state.
+	DisputeStateLost DisputeState = "lost"
+)
+
+const (
+	// DisputeReasonFraudulent is used when the cardholder claims they did not authorise the payment.
+	DisputeReasonFraudulent DisputeReason = "fraudulent"
+
+	// DisputeReasonProductNotReceived is used when the cardholder claims they did not receive the goods.
+	DisputeReasonProductNotReceived DisputeReason = "product_not_received"
+
+	// DisputeReasonDuplicate is used when the cardholder claims they were charged more than once.
+	DisputeReasonDuplicate DisputeReason = "duplicate"
+)
+
+var validDisputeTransitions = map[DisputeState][]DisputeState{
+	emptyDisputeState:       {DisputeStateOpen},
+	DisputeStateOpen:        {DisputeStateUnderReview, DisputeStateLost},
+	DisputeStateUnderReview: {DisputeStateWon, DisputeStateLost},
+	DisputeStateWon:         {},
+	DisputeStateLost:        {},
+}
+
+// Dispute is a record that represents a chargeback raised by the cardholder against a confirmed payment.
+type Dispute struct {
+	Id        DisputeId
+	PaymentId PaymentId
+	state     DisputeState
+	Version   string
+
+	Reason   DisputeReason
+	Amount   int64
+	Currency string
+
+	Evidence      string
+	EvidenceDueBy time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// State returns the state of the dispute.
+func (d *Dispute) State() DisputeState {
+	return d.state
+}
+
+// SetState sets the state of the dispute. Returns an error if the transition is invalid.
+func (d *Dispute) SetState(state DisputeState) error {
+	if !isValidDisputeTransition(d.state, state) {
+		return fmt.Errorf("invalid dispute transition: %s -> %s", d.state, state)
+	}
+	d.state = state
+	return nil
+}
+
+func isValidDisputeTransition(from, to DisputeState) bool {
+	for _, state := range validDisputeTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,14 @@ package acquirer
 
 import (
 	"fmt"
+	"mkuznets.com/go/upsp/money"
 	"time"
 )
 
 type (
 	PaymentId    string
 	PaymentState string
+	RejectReason string
 )
 
 const (
@@ -39,6 +41,23 @@ const (
 
 	// PaymentStateRejected is the state of a payment that failed the authorisation step. Final state.
 	PaymentStateRejected PaymentState = "rejected"
+
+	// PaymentStateDisputed is the state of a confirmed payment that has been disputed by the cardholder.
+	PaymentStateDisputed PaymentState = "disputed"
+
+	// PaymentStateChargedBack is the state of a disputed payment that has been charged back. Final state.
+	PaymentStateChargedBack PaymentState = "charged_back"
+)
+
+const (
+	// RejectReasonDeclined is used when the issuer declines the authorisation.
+	RejectReasonDeclined RejectReason = "declined"
+
+	// RejectReason3dsFailed is used when the customer fails the 3DS challenge.
+	RejectReason3dsFailed RejectReason = "3ds_failed"
+
+	// RejectReason3dsTimeout is used when the customer does not complete the 3DS challenge in time.
+	RejectReason3dsTimeout RejectReason = "3ds_timeout"
 )
 
 var validTransactions = map[PaymentState][]PaymentState{
@@ -47,7 +66,8 @@ var validTransactions = map[PaymentState][]PaymentState{
 	PaymentStateAuthorising:      {PaymentStateAuthorised, PaymentStateRejected},
 	PaymentState3dSecureRequired: {PaymentStateAuthorising, PaymentStateRejected},
 	PaymentStateAuthorised:       {PaymentStateConfirmed, PaymentStateReversed},
-	PaymentStateConfirmed:        {PaymentStateRefunded},
+	PaymentStateConfirmed:        {PaymentStateRefunded, PaymentStateDisputed},
+	PaymentStateDisputed:         {PaymentStateConfirmed, PaymentStateChargedBack},
 	PaymentStateRejected:         {},
 }
 
@@ -57,8 +77,7 @@ type Payment struct {
 	state   PaymentState
 	Version string
 
-	Amount   int64
-	Currency string
+	money.Money
 
 	CardNumber string
 	ExpiryDate string
@@ -67,7 +86,15 @@ type Payment struct {
 
 	UpdatedAt time.Time
 
+	// Force3dSecure is set if the payment requires 3DS authentication regardless of the card.
+	Force3dSecure       bool
 	Expected3dsResponse string
+
+	// RejectReason is the reason the payment has been rejected, if it has.
+	RejectReason RejectReason
+
+	// DisputeId is the ID of the dispute opened against the payment, if any.
+	DisputeId DisputeId
 }
 
 // State returns the state of the payment.
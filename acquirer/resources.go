@@ -1,15 +1,21 @@
 package acquirer
 
+import "time"
+
 type PaymentResource struct {
-	Id      PaymentId
-	State   PaymentState
-	Version string
+	Id           PaymentId
+	State        PaymentState
+	Version      string
+	RejectReason RejectReason
+	DisputeId    DisputeId
 }
 
 type CreatePaymentRequest struct {
 	Id       PaymentId
 	Amount   int64
 	Currency string
+	// Force3dSecure requires 3DS authentication of the cardholder, even if the issuer does not.
+	Force3dSecure bool
 }
 
 type CreatePaymentResponse struct {
@@ -43,3 +49,36 @@ type ConfirmPaymentResponse struct {
 type CancelPaymentResponse struct {
 	Payment PaymentResource
 }
+
+type DisputeResource struct {
+	Id        DisputeId
+	PaymentId PaymentId
+	State     DisputeState
+	Version   string
+
+	Reason   DisputeReason
+	Amount   int64
+	Currency string
+
+	EvidenceDueBy time.Time
+}
+
+type SubmitDisputeEvidenceRequest struct {
+	Evidence string
+}
+
+type SubmitDisputeEvidenceResponse struct {
+	Dispute DisputeResource
+}
+
+type SettlementBatchResource struct {
+	Id       SettlementBatchId
+	Date     string
+	Currency string
+	CutoffAt time.Time
+
+	Gross      int64
+	Fees       int64
+	Net        int64
+	EntryCount int
+}
@@ -0,0 +1,249 @@
+package acquirer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mkuznets.com/go/upsp/money"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type (
+	SettlementBatchId      string
+	SettlementEntryType    string
+	SettlementReportFormat string
+)
+
+const (
+	// SettlementEntryPayment is a confirmed payment credited to the merchant.
+	SettlementEntryPayment SettlementEntryType = "payment"
+
+	// SettlementEntryRefund is a refunded payment debited from the merchant.
+	SettlementEntryRefund SettlementEntryType = "refund"
+
+	// SettlementEntryChargeback is a lost dispute debited from the merchant.
+	SettlementEntryChargeback SettlementEntryType = "chargeback"
+)
+
+const (
+	SettlementReportCsv  SettlementReportFormat = "csv"
+	SettlementReportJson SettlementReportFormat = "json"
+)
+
+const (
+	// paymentFeeBasisPoints is the percentage fee charged for each confirmed payment (1.4%).
+	paymentFeeBasisPoints = 140
+	// paymentFeeFixed is the fixed fee in hundredths of the major unit charged for each confirmed payment.
+	paymentFeeFixed = 20
+	// chargebackFee is the fixed fee in hundredths of the major unit charged for each lost dispute.
+	chargebackFee = 1500
+	// feeDecimals is the number of decimals of the fixed fees, which are converted to the minor units of the currency.
+	feeDecimals = 2
+
+	// settlementDateLayout is the layout of the settlement batch date.
+	settlementDateLayout = "2006-01-02"
+)
+
+// SettlementEntry is a single money movement between the acquirer and the merchant.
+type SettlementEntry struct {
+	PaymentId PaymentId
+	Type      SettlementEntryType
+	// Amount is the gross amount in minor units: positive for payments, negative for refunds and chargebacks.
+	Amount   int64
+	Fee      int64
+	Currency string
+
+	CreatedAt time.Time
+}
+
+// Net returns the entry amount after fees.
+func (e *SettlementEntry) Net() int64 {
+	return e.Amount - e.Fee
+}
+
+// SettlementBatch is a set of entries of the same currency settled at the same cut-off.
+type SettlementBatch struct {
+	Id       SettlementBatchId
+	Date     string
+	Currency string
+	CutoffAt time.Time
+	Entries  []*SettlementEntry
+
+	Gross int64
+	Fees  int64
+	Net   int64
+
+	ClosedAt time.Time
+}
+
+func newSettlementEntry(p *Payment, entryType SettlementEntryType) *SettlementEntry {
+	e := &SettlementEntry{
+		PaymentId: p.Id,
+		Type:      entryType,
+		Currency:  p.Currency,
+	}
+
+	switch entryType {
+	case SettlementEntryPayment:
+		e.Amount = p.Amount
+		e.Fee = p.Amount*paymentFeeBasisPoints/10000 + money.Minor(paymentFeeFixed, feeDecimals, p.Currency)
+	case SettlementEntryRefund:
+		e.Amount = -p.Amount
+	case SettlementEntryChargeback:
+		e.Amount = -p.Amount
+		e.Fee = money.Minor(chargebackFee, feeDecimals, p.Currency)
+	}
+
+	return e
+}
+
+// nextCutoff returns the first cut-off strictly after t.
+// The cut-off is the given offset from the midnight UTC, within [0, 24h).
+func nextCutoff(t time.Time, cutoff time.Duration) time.Time {
+	t = t.UTC()
+	c := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Add(cutoff)
+	if !c.After(t) {
+		c = c.AddDate(0, 0, 1)
+	}
+	return c
+}
+
+// lastCutoff returns the most recent cut-off at or before t.
+func lastCutoff(t time.Time, cutoff time.Duration) time.Time {
+	return nextCutoff(t, cutoff).AddDate(0, 0, -1)
+}
+
+// newSettlementBatches groups the given entries into batches by currency and the cut-off that closes them.
+func newSettlementBatches(entries []*SettlementEntry, cutoff time.Duration) []*SettlementBatch {
+	type batchKey struct {
+		cutoffAt time.Time
+		currency string
+	}
+
+	batches := make(map[batchKey]*SettlementBatch)
+	var keys []batchKey
+
+	for _, e := range entries {
+		key := batchKey{cutoffAt: nextCutoff(e.CreatedAt, cutoff), currency: e.Currency}
+		b, ok := batches[key]
+		if !ok {
+			b = &SettlementBatch{
+				Date:     key.cutoffAt.Add(-time.Nanosecond).Format(settlementDateLayout),
+				Currency: key.currency,
+				CutoffAt: key.cutoffAt,
+			}
+			batches[key] = b
+			keys = append(keys, key)
+		}
+		b.Entries = append(b.Entries, e)
+		b.Gross += e.Amount
+		b.Fees += e.Fee
+		b.Net += e.Net()
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].cutoffAt.Equal(keys[j].cutoffAt) {
+			return keys[i].cutoffAt.Before(keys[j].cutoffAt)
+		}
+		return keys[i].currency < keys[j].currency
+	})
+
+	result := make([]*SettlementBatch, 0, len(keys))
+	for _, key := range keys {
+		b := batches[key]
+		sort.SliceStable(b.Entries, func(i, j int) bool {
+			return b.Entries[i].CreatedAt.Before(b.Entries[j].CreatedAt)
+		})
+		result = append(result, b)
+	}
+	return result
+}
+
+// settlementReportEntry is a line of the settlement report.
+type settlementReportEntry struct {
+	PaymentId PaymentId           `json:"payment_id"`
+	Type      SettlementEntryType `json:"type"`
+	Amount    int64               `json:"amount"`
+	Fee       int64               `json:"fee"`
+	Net       int64               `json:"net"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+// settlementReport is the JSON representation of the settlement report.
+type settlementReport struct {
+	BatchId  SettlementBatchId       `json:"batch_id"`
+	Date     string                  `json:"settlement_date"`
+	Currency string                  `json:"currency"`
+	CutoffAt time.Time               `json:"cutoff_at"`
+	Gross    int64                   `json:"gross"`
+	Fees     int64                   `json:"fees"`
+	Net      int64                   `json:"net"`
+	Entries  []settlementReportEntry `json:"entries"`
+}
+
+// settlementReportCsvHeader is the header of the CSV settlement report.
+var settlementReportCsvHeader = []string{
+	"batch_id", "settlement_date", "currency", "payment_id", "type", "amount", "fee", "net", "created_at",
+}
+
+// renderSettlementReport renders the settlement batch as a report file in the given format.
+func renderSettlementReport(b *SettlementBatch, format SettlementReportFormat) ([]byte, error) {
+	switch format {
+	case SettlementReportCsv:
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(settlementReportCsvHeader); err != nil {
+			return nil, err
+		}
+		for _, e := range b.Entries {
+			err := w.Write([]string{
+				string(b.Id),
+				b.Date,
+				b.Currency,
+				string(e.PaymentId),
+				string(e.Type),
+				strconv.FormatInt(e.Amount, 10),
+				strconv.FormatInt(e.Fee, 10),
+				strconv.FormatInt(e.Net(), 10),
+				e.CreatedAt.UTC().Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case SettlementReportJson:
+		report := settlementReport{
+			BatchId:  b.Id,
+			Date:     b.Date,
+			Currency: b.Currency,
+			CutoffAt: b.CutoffAt,
+			Gross:    b.Gross,
+			Fees:     b.Fees,
+			Net:      b.Net,
+			Entries:  make([]settlementReportEntry, 0, len(b.Entries)),
+		}
+		for _, e := range b.Entries {
+			report.Entries = append(report.Entries, settlementReportEntry{
+				PaymentId: e.PaymentId,
+				Type:      e.Type,
+				Amount:    e.Amount,
+				Fee:       e.Fee,
+				Net:       e.Net(),
+				CreatedAt: e.CreatedAt,
+			})
+		}
+		return json.Marshal(report)
+
+	default:
+		return nil, fmt.Errorf("unknown settlement report format: %s", format)
+	}
+}
@@ -0,0 +1,149 @@
+package acquirer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/money"
+)
+
+func Test_nextCutoff(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return v
+	}
+
+	assert.Equal(t, at("2022-12-03T00:00:00Z"), nextCutoff(at("2022-12-02T10:00:00Z"), 0))
+	assert.Equal(t, at("2022-12-02T22:00:00Z"), nextCutoff(at("2022-12-02T10:00:00Z"), 22*time.Hour))
+	assert.Equal(t, at("2022-12-03T22:00:00Z"), nextCutoff(at("2022-12-02T22:00:00Z"), 22*time.Hour))
+	assert.Equal(t, at("2022-12-01T22:00:00Z"), lastCutoff(at("2022-12-02T10:00:00Z"), 22*time.Hour))
+}
+
+func Test_newSettlementEntry(t *testing.T) {
+	tests := []struct {
+		money     money.Money
+		entryType SettlementEntryType
+		fee       int64
+	}{
+		{money.New(1000, "GBP"), SettlementEntryPayment, 34},
+		{money.New(1000, "JPY"), SettlementEntryPayment, 14},
+		{money.New(1000, "KWD"), SettlementEntryPayment, 214},
+		{money.New(1000, "GBP"), SettlementEntryChargeback, 1500},
+		{money.New(1000, "JPY"), SettlementEntryChargeback, 15},
+	}
+	for _, tt := range tests {
+		e := newSettlementEntry(&Payment{Id: "1", Money: tt.money}, tt.entryType)
+		assert.Equal(t, tt.fee, e.Fee, "%s %s", tt.entryType, tt.money.Display())
+	}
+}
+
+func Test_newSettlementBatches(t *testing.T) {
+	createdAt := time.Date(2022, 12, 2, 10, 0, 0, 0, time.UTC)
+
+	entries := []*SettlementEntry{
+		{PaymentId: "1", Type: SettlementEntryPayment, Amount: 1000, Fee: 34, Currency: "GBP", CreatedAt: createdAt},
+		{PaymentId: "2", Type: SettlementEntryPayment, Amount: 500, Fee: 27, Currency: "EUR", CreatedAt: createdAt},
+		{PaymentId: "1", Type: SettlementEntryRefund, Amount: -1000, Currency: "GBP", CreatedAt: createdAt.Add(time.Hour)},
+		{PaymentId: "3", Type: SettlementEntryPayment, Amount: 2000, Fee: 48, Currency: "GBP", CreatedAt: createdAt.Add(24 * time.Hour)},
+	}
+
+	batches := newSettlementBatches(entries, 0)
+	require.Len(t, batches, 3)
+
+	assert.Equal(t, "2022-12-02", batches[0].Date)
+	assert.Equal(t, "EUR", batches[0].Currency)
+	assert.Equal(t, int64(473), batches[0].Net)
+
+	assert.Equal(t, "2022-12-02", batches[1].Date)
+	assert.Equal(t, "GBP", batches[1].Currency)
+	assert.Len(t, batches[1].Entries, 2)
+	assert.Equal(t, int64(0), batches[1].Gross)
+	assert.Equal(t, int64(34), batches[1].Fees)
+	assert.Equal(t, int64(-34), batches[1].Net)
+
+	assert.Equal(t, "2022-12-03", batches[2].Date)
+	assert.Equal(t, int64(1952), batches[2].Net)
+}
+
+func TestAcquirer_Settlement(t *testing.T) {
+	acq := New(NewStore(), WithSettlementCutoff(22*time.Hour)).(*acquirerImpl)
+
+	for _, card := range []string{"4242424242424242", "4000000000005126"} {
+		py, err := acq.CreatePayment(&CreatePaymentRequest{
+			Id:       PaymentId(uuid.NewString()),
+			Amount:   1000,
+			Currency: "GBP",
+		})
+		require.NoError(t, err)
+
+		rAuth, err := acq.AuthorisePayment(py.Id, py.Version, &AuthorisePaymentRequest{
+			CardNumber: card,
+			ExpiryDate: "1077",
+			CardHolder: "John Doe",
+			Cvv:        "123",
+		})
+		require.NoError(t, err)
+
+		rConfirm, err := acq.ConfirmPayment(rAuth.Payment.Id, rAuth.Payment.Version)
+		require.NoError(t, err)
+
+		if shouldRefund(card) {
+			_, err = acq.CancelPayment(rConfirm.Payment.Id, rConfirm.Payment.Version)
+			require.NoError(t, err)
+		}
+	}
+
+	// Nothing is settled before the cut-off.
+	closed, err := acq.closeSettlementBatches(time.Now().Add(-48 * time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, closed)
+
+	closed, err = acq.closeSettlementBatches(time.Now().Add(48 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, closed, 1)
+
+	batches, err := acq.ListSettlementBatches()
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	assert.Equal(t, "GBP", batches[0].Currency)
+	assert.Equal(t, 3, batches[0].EntryCount)
+	assert.Equal(t, int64(1000), batches[0].Gross)
+	assert.Equal(t, int64(68), batches[0].Fees)
+	assert.Equal(t, int64(932), batches[0].Net)
+	assert.Equal(t, 22, batches[0].CutoffAt.Hour())
+
+	t.Run("csv", func(t *testing.T) {
+		report, err := acq.GetSettlementReport(batches[0].Id, SettlementReportCsv)
+		require.NoError(t, err)
+
+		records, err := csv.NewReader(strings.NewReader(string(report))).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 4)
+		assert.Equal(t, settlementReportCsvHeader, records[0])
+		assert.Equal(t, string(batches[0].Id), records[1][0])
+		assert.Equal(t, []string{"payment", "1000", "34", "966"}, records[1][4:8])
+	})
+
+	t.Run("json", func(t *testing.T) {
+		report, err := acq.GetSettlementReport(batches[0].Id, SettlementReportJson)
+		require.NoError(t, err)
+
+		var decoded settlementReport
+		require.NoError(t, json.Unmarshal(report, &decoded))
+		assert.Equal(t, batches[0].Id, decoded.BatchId)
+		assert.Equal(t, int64(932), decoded.Net)
+		assert.Len(t, decoded.Entries, 3)
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := acq.GetSettlementReport(batches[0].Id, "xml")
+		assert.ErrorContains(t, err, "unknown settlement report format")
+	})
+}
@@ -1,7 +1,9 @@
 package acquirer
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,6 +12,12 @@ import (
 
 //go:generate moq -out store_mock_test.go . Store
 
+// ErrPaymentNotFound is returned when the acquirer does not know the payment with the given ID.
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// ErrVersionMismatch is returned when an object is updated with a version other than its current one.
+var ErrVersionMismatch = errors.New("version mismatch")
+
 // Store is an interface to create, retrieve, and update payments.
 type Store interface {
 	// CreateOrGet creates a new payment or returns an existing one with the same ID.
@@ -20,18 +28,42 @@ type Store interface {
 	List(state PaymentState) ([]*Payment, error)
 	// Update updates a payment using the given lambda function.
 	Update(id PaymentId, version string, fn func(*Payment) error) (*Payment, error)
+
+	// CreateDispute creates a new dispute. Returns an error if a dispute with the same ID already exists.
+	CreateDispute(*Dispute) (*Dispute, error)
+	// GetDispute retrieves a dispute by ID.
+	GetDispute(id DisputeId) (*Dispute, error)
+	// ListDisputes retrieves all disputes.
+	ListDisputes() ([]*Dispute, error)
+	// UpdateDispute updates a dispute using the given lambda function.
+	UpdateDispute(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error)
+
+	// AddSettlementEntry records a money movement to be settled in one of the next batches.
+	AddSettlementEntry(*SettlementEntry) error
+	// CloseSettlementBatches groups the pending settlement entries created before the given time into batches
+	// with the given function, persists the batches and removes their entries from the pending ones.
+	// Either all batches are persisted, or none is and the entries stay pending.
+	CloseSettlementBatches(before time.Time, group func([]*SettlementEntry) []*SettlementBatch) ([]*SettlementBatch, error)
+	// GetSettlementBatch retrieves a settlement batch by ID.
+	GetSettlementBatch(id SettlementBatchId) (*SettlementBatch, error)
+	// ListSettlementBatches retrieves all settlement batches ordered by the cut-off time.
+	ListSettlementBatches() ([]*SettlementBatch, error)
 }
 
 // storeImpl implements an in-memory thread-safe payment store.
 type storeImpl struct {
-	db map[PaymentId]*Payment
-	l  *sync.Mutex
+	db       map[PaymentId]*Payment
+	disputes map[DisputeId]*Dispute
+	entries  []*SettlementEntry
+	batches  []*SettlementBatch
+	l        *sync.Mutex
 }
 
 func NewStore() Store {
 	return &storeImpl{
-		db: make(map[PaymentId]*Payment),
-		l:  &sync.Mutex{},
+		db:       make(map[PaymentId]*Payment),
+		disputes: make(map[DisputeId]*Dispute),
+		l:        &sync.Mutex{},
 	}
 }
 
@@ -41,6 +73,12 @@ func (s *storeImpl) lock(fn func(map[PaymentId]*Payment) error) error {
 	return fn(s.db)
 }
 
+func (s *storeImpl) lockDisputes(fn func(map[DisputeId]*Dispute) error) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return fn(s.disputes)
+}
+
 func (s *storeImpl) CreateOrGet(payment *Payment) (p *Payment, err error) {
 	err = s.lock(func(store map[PaymentId]*Payment) error {
 		if v, exists := store[payment.Id]; exists {
@@ -60,7 +98,7 @@ func (s *storeImpl) Get(id PaymentId) (*Payment, error) {
 	if payment, ok := s.db[id]; ok {
 		return payment, nil
 	}
-	return nil, fmt.Errorf("payment not found: %s", id)
+	return nil, fmt.Errorf("%w: %s", ErrPaymentNotFound, id)
 }
 
 func (s *storeImpl) List(state PaymentState) ([]*Payment, error) {
@@ -88,11 +126,11 @@ func (s *storeImpl) Update(id PaymentId, version string, fn func(*Payment) error
 		if v, ok := store[id]; ok {
 			*payment = *v
 		} else {
-			return fmt.Errorf("payment not found: %s", id)
+			return fmt.Errorf("%w: %s", ErrPaymentNotFound, id)
 		}
 
 		if payment.Version != version {
-			return fmt.Errorf("version mismatch: %s != %s", payment.Version, version)
+			return fmt.Errorf("%w: %s != %s", ErrVersionMismatch, payment.Version, version)
 		}
 
 		if err := fn(payment); err != nil {
@@ -110,3 +148,154 @@ func (s *storeImpl) Update(id PaymentId, version string, fn func(*Payment) error
 
 	return payment, nil
 }
+
+func (s *storeImpl) CreateDispute(dispute *Dispute) (*Dispute, error) {
+	d := new(Dispute)
+
+	err := s.lockDisputes(func(store map[DisputeId]*Dispute) error {
+		if _, exists := store[dispute.Id]; exists {
+			return fmt.Errorf("dispute already exists: %s", dispute.Id)
+		}
+		*d = *dispute
+		d.CreatedAt = time.Now()
+		d.UpdatedAt = d.CreatedAt
+		store[dispute.Id] = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (s *storeImpl) GetDispute(id DisputeId) (d *Dispute, err error) {
+	err = s.lockDisputes(func(store map[DisputeId]*Dispute) error {
+		if v, ok := store[id]; ok {
+			d = v
+			return nil
+		}
+		return fmt.Errorf("dispute not found: %s", id)
+	})
+	return
+}
+
+func (s *storeImpl) ListDisputes() ([]*Dispute, error) {
+	var disputes []*Dispute
+
+	err := s.lockDisputes(func(store map[DisputeId]*Dispute) error {
+		for _, dispute := range store {
+			disputes = append(disputes, dispute)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return disputes, nil
+}
+
+func (s *storeImpl) UpdateDispute(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error) {
+	dispute := new(Dispute)
+
+	err := s.lockDisputes(func(store map[DisputeId]*Dispute) error {
+		if v, ok := store[id]; ok {
+			*dispute = *v
+		} else {
+			return fmt.Errorf("dispute not found: %s", id)
+		}
+
+		if dispute.Version != version {
+			return fmt.Errorf("%w: %s != %s", ErrVersionMismatch, dispute.Version, version)
+		}
+
+		if err := fn(dispute); err != nil {
+			return err
+		}
+		dispute.Version = uuid.NewString()
+		dispute.UpdatedAt = time.Now()
+		store[id] = dispute
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dispute, nil
+}
+
+func (s *storeImpl) AddSettlementEntry(entry *SettlementEntry) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	entryCopy := *entry
+	entryCopy.CreatedAt = time.Now()
+	s.entries = append(s.entries, &entryCopy)
+	return nil
+}
+
+func (s *storeImpl) CloseSettlementBatches(before time.Time, group func([]*SettlementEntry) []*SettlementBatch) ([]*SettlementBatch, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	var taken, pending []*SettlementEntry
+	for _, entry := range s.entries {
+		if entry.CreatedAt.Before(before) {
+			taken = append(taken, entry)
+		} else {
+			pending = append(pending, entry)
+		}
+	}
+	if len(taken) == 0 {
+		return nil, nil
+	}
+
+	batches := group(taken)
+	ids := make(map[SettlementBatchId]bool, len(s.batches)+len(batches))
+	for _, b := range s.batches {
+		ids[b.Id] = true
+	}
+	closed := make([]*SettlementBatch, 0, len(batches))
+	now := time.Now()
+	for _, batch := range batches {
+		if ids[batch.Id] {
+			return nil, fmt.Errorf("settlement batch already exists: %s", batch.Id)
+		}
+		ids[batch.Id] = true
+
+		batchCopy := *batch
+		batchCopy.ClosedAt = now
+		closed = append(closed, &batchCopy)
+	}
+
+	s.entries = pending
+	s.batches = append(s.batches, closed...)
+	sort.SliceStable(s.batches, func(i, j int) bool {
+		return s.batches[i].CutoffAt.Before(s.batches[j].CutoffAt)
+	})
+
+	return closed, nil
+}
+
+func (s *storeImpl) GetSettlementBatch(id SettlementBatchId) (*SettlementBatch, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for _, b := range s.batches {
+		if b.Id == id {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("settlement batch not found: %s", id)
+}
+
+func (s *storeImpl) ListSettlementBatches() ([]*SettlementBatch, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	batches := make([]*SettlementBatch, len(s.batches))
+	copy(batches, s.batches)
+	return batches, nil
+}
@@ -5,6 +5,7 @@ package acquirer
 
 import (
 	"sync"
+	"time"
 )
 
 // Ensure, that StoreMock does implement Store.
@@ -17,18 +18,42 @@ var _ Store = &StoreMock{}
 //
 //		// make and configure a mocked Store
 //		mockedStore := &StoreMock{
+//			AddSettlementEntryFunc: func(settlementEntry *SettlementEntry) error {
+//				panic("mock out the AddSettlementEntry method")
+//			},
+//			CloseSettlementBatchesFunc: func(before time.Time, group func([]*SettlementEntry) []*SettlementBatch) ([]*SettlementBatch, error) {
+//				panic("mock out the CloseSettlementBatches method")
+//			},
+//			CreateDisputeFunc: func(dispute *Dispute) (*Dispute, error) {
+//				panic("mock out the CreateDispute method")
+//			},
 //			CreateOrGetFunc: func(payment *Payment) (*Payment, error) {
 //				panic("mock out the CreateOrGet method")
 //			},
 //			GetFunc: func(id PaymentId) (*Payment, error) {
 //				panic("mock out the Get method")
 //			},
+//			GetDisputeFunc: func(id DisputeId) (*Dispute, error) {
+//				panic("mock out the GetDispute method")
+//			},
+//			GetSettlementBatchFunc: func(id SettlementBatchId) (*SettlementBatch, error) {
+//				panic("mock out the GetSettlementBatch method")
+//			},
 //			ListFunc: func(state PaymentState) ([]*Payment, error) {
 //				panic("mock out the List method")
 //			},
+//			ListDisputesFunc: func() ([]*Dispute, error) {
+//				panic("mock out the ListDisputes method")
+//			},
+//			ListSettlementBatchesFunc: func() ([]*SettlementBatch, error) {
+//				panic("mock out the ListSettlementBatches method")
+//			},
 //			UpdateFunc: func(id PaymentId, version string, fn func(*Payment) error) (*Payment, error) {
 //				panic("mock out the Update method")
 //			},
+//			UpdateDisputeFunc: func(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error) {
+//				panic("mock out the UpdateDispute method")
+//			},
 //		}
 //
 //		// use mockedStore in code that requires Store
@@ -36,20 +61,61 @@ var _ Store = &StoreMock{}
 //
 //	}
 type StoreMock struct {
+	// AddSettlementEntryFunc mocks the AddSettlementEntry method.
+	AddSettlementEntryFunc func(settlementEntry *SettlementEntry) error
+
+	// CloseSettlementBatchesFunc mocks the CloseSettlementBatches method.
+	CloseSettlementBatchesFunc func(before time.Time, group func([]*SettlementEntry) []*SettlementBatch) ([]*SettlementBatch, error)
+
+	// CreateDisputeFunc mocks the CreateDispute method.
+	CreateDisputeFunc func(dispute *Dispute) (*Dispute, error)
+
 	// CreateOrGetFunc mocks the CreateOrGet method.
 	CreateOrGetFunc func(payment *Payment) (*Payment, error)
 
 	// GetFunc mocks the Get method.
 	GetFunc func(id PaymentId) (*Payment, error)
 
+	// GetDisputeFunc mocks the GetDispute method.
+	GetDisputeFunc func(id DisputeId) (*Dispute, error)
+
+	// GetSettlementBatchFunc mocks the GetSettlementBatch method.
+	GetSettlementBatchFunc func(id SettlementBatchId) (*SettlementBatch, error)
+
 	// ListFunc mocks the List method.
 	ListFunc func(state PaymentState) ([]*Payment, error)
 
+	// ListDisputesFunc mocks the ListDisputes method.
+	ListDisputesFunc func() ([]*Dispute, error)
+
+	// ListSettlementBatchesFunc mocks the ListSettlementBatches method.
+	ListSettlementBatchesFunc func() ([]*SettlementBatch, error)
+
 	// UpdateFunc mocks the Update method.
 	UpdateFunc func(id PaymentId, version string, fn func(*Payment) error) (*Payment, error)
 
+	// UpdateDisputeFunc mocks the UpdateDispute method.
+	UpdateDisputeFunc func(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error)
+
 	// calls tracks calls to the methods.
 	calls struct {
+		// AddSettlementEntry holds details about calls to the AddSettlementEntry method.
+		AddSettlementEntry []struct {
+			// SettlementEntry is the settlementEntry argument value.
+			SettlementEntry *SettlementEntry
+		}
+		// CloseSettlementBatches holds details about calls to the CloseSettlementBatches method.
+		CloseSettlementBatches []struct {
+			// Before is the before argument value.
+			Before time.Time
+			// Group is the group argument value.
+			Group func([]*SettlementEntry) []*SettlementBatch
+		}
+		// CreateDispute holds details about calls to the CreateDispute method.
+		CreateDispute []struct {
+			// Dispute is the dispute argument value.
+			Dispute *Dispute
+		}
 		// CreateOrGet holds details about calls to the CreateOrGet method.
 		CreateOrGet []struct {
 			// Payment is the payment argument value.
@@ -60,11 +126,27 @@ type StoreMock struct {
 			// ID is the id argument value.
 			ID PaymentId
 		}
+		// GetDispute holds details about calls to the GetDispute method.
+		GetDispute []struct {
+			// ID is the id argument value.
+			ID DisputeId
+		}
+		// GetSettlementBatch holds details about calls to the GetSettlementBatch method.
+		GetSettlementBatch []struct {
+			// ID is the id argument value.
+			ID SettlementBatchId
+		}
 		// List holds details about calls to the List method.
 		List []struct {
 			// State is the state argument value.
 			State PaymentState
 		}
+		// ListDisputes holds details about calls to the ListDisputes method.
+		ListDisputes []struct {
+		}
+		// ListSettlementBatches holds details about calls to the ListSettlementBatches method.
+		ListSettlementBatches []struct {
+		}
 		// Update holds details about calls to the Update method.
 		Update []struct {
 			// ID is the id argument value.
@@ -74,11 +156,128 @@ type StoreMock struct {
 			// Fn is the fn argument value.
 			Fn func(*Payment) error
 		}
+		// UpdateDispute holds details about calls to the UpdateDispute method.
+		UpdateDispute []struct {
+			// ID is the id argument value.
+			ID DisputeId
+			// Version is the version argument value.
+			Version string
+			// Fn is the fn argument value.
+			Fn func(*Dispute) error
+		}
 	}
-	lockCreateOrGet sync.RWMutex
-	lockGet         sync.RWMutex
-	lockList        sync.RWMutex
-	lockUpdate      sync.RWMutex
+	lockAddSettlementEntry     sync.RWMutex
+	lockCloseSettlementBatches sync.RWMutex
+	lockCreateDispute          sync.RWMutex
+	lockCreateOrGet            sync.RWMutex
+	lockGet                    sync.RWMutex
+	lockGetDispute             sync.RWMutex
+	lockGetSettlementBatch     sync.RWMutex
+	lockList                   sync.RWMutex
+	lockListDisputes           sync.RWMutex
+	lockListSettlementBatches  sync.RWMutex
+	lockUpdate                 sync.RWMutex
+	lockUpdateDispute          sync.RWMutex
+}
+
+// AddSettlementEntry calls AddSettlementEntryFunc.
+func (mock *StoreMock) AddSettlementEntry(settlementEntry *SettlementEntry) error {
+	if mock.AddSettlementEntryFunc == nil {
+		panic("StoreMock.AddSettlementEntryFunc: method is nil but Store.AddSettlementEntry was just called")
+	}
+	callInfo := struct {
+		SettlementEntry *SettlementEntry
+	}{
+		SettlementEntry: settlementEntry,
+	}
+	mock.lockAddSettlementEntry.Lock()
+	mock.calls.AddSettlementEntry = append(mock.calls.AddSettlementEntry, callInfo)
+	mock.lockAddSettlementEntry.Unlock()
+	return mock.AddSettlementEntryFunc(settlementEntry)
+}
+
+// AddSettlementEntryCalls gets all the calls that were made to AddSettlementEntry.
+// Check the length with:
+//
+//	len(mockedStore.AddSettlementEntryCalls())
+func (mock *StoreMock) AddSettlementEntryCalls() []struct {
+	SettlementEntry *SettlementEntry
+} {
+	var calls []struct {
+		SettlementEntry *SettlementEntry
+	}
+	mock.lockAddSettlementEntry.RLock()
+	calls = mock.calls.AddSettlementEntry
+	mock.lockAddSettlementEntry.RUnlock()
+	return calls
+}
+
+// CloseSettlementBatches calls CloseSettlementBatchesFunc.
+func (mock *StoreMock) CloseSettlementBatches(before time.Time, group func([]*SettlementEntry) []*SettlementBatch) ([]*SettlementBatch, error) {
+	if mock.CloseSettlementBatchesFunc == nil {
+		panic("StoreMock.CloseSettlementBatchesFunc: method is nil but Store.CloseSettlementBatches was just called")
+	}
+	callInfo := struct {
+		Before time.Time
+		Group  func([]*SettlementEntry) []*SettlementBatch
+	}{
+		Before: before,
+		Group:  group,
+	}
+	mock.lockCloseSettlementBatches.Lock()
+	mock.calls.CloseSettlementBatches = append(mock.calls.CloseSettlementBatches, callInfo)
+	mock.lockCloseSettlementBatches.Unlock()
+	return mock.CloseSettlementBatchesFunc(before, group)
+}
+
+// CloseSettlementBatchesCalls gets all the calls that were made to CloseSettlementBatches.
+// Check the length with:
+//
+//	len(mockedStore.CloseSettlementBatchesCalls())
+func (mock *StoreMock) CloseSettlementBatchesCalls() []struct {
+	Before time.Time
+	Group  func([]*SettlementEntry) []*SettlementBatch
+} {
+	var calls []struct {
+		Before time.Time
+		Group  func([]*SettlementEntry) []*SettlementBatch
+	}
+	mock.lockCloseSettlementBatches.RLock()
+	calls = mock.calls.CloseSettlementBatches
+	mock.lockCloseSettlementBatches.RUnlock()
+	return calls
+}
+
+// CreateDispute calls CreateDisputeFunc.
+func (mock *StoreMock) CreateDispute(dispute *Dispute) (*Dispute, error) {
+	if mock.CreateDisputeFunc == nil {
+		panic("StoreMock.CreateDisputeFunc: method is nil but Store.CreateDispute was just called")
+	}
+	callInfo := struct {
+		Dispute *Dispute
+	}{
+		Dispute: dispute,
+	}
+	mock.lockCreateDispute.Lock()
+	mock.calls.CreateDispute = append(mock.calls.CreateDispute, callInfo)
+	mock.lockCreateDispute.Unlock()
+	return mock.CreateDisputeFunc(dispute)
+}
+
+// CreateDisputeCalls gets all the calls that were made to CreateDispute.
+// Check the length with:
+//
+//	len(mockedStore.CreateDisputeCalls())
+func (mock *StoreMock) CreateDisputeCalls() []struct {
+	Dispute *Dispute
+} {
+	var calls []struct {
+		Dispute *Dispute
+	}
+	mock.lockCreateDispute.RLock()
+	calls = mock.calls.CreateDispute
+	mock.lockCreateDispute.RUnlock()
+	return calls
 }
 
 // CreateOrGet calls CreateOrGetFunc.
@@ -145,6 +344,70 @@ func (mock *StoreMock) GetCalls() []struct {
 	return calls
 }
 
+// GetDispute calls GetDisputeFunc.
+func (mock *StoreMock) GetDispute(id DisputeId) (*Dispute, error) {
+	if mock.GetDisputeFunc == nil {
+		panic("StoreMock.GetDisputeFunc: method is nil but Store.GetDispute was just called")
+	}
+	callInfo := struct {
+		ID DisputeId
+	}{
+		ID: id,
+	}
+	mock.lockGetDispute.Lock()
+	mock.calls.GetDispute = append(mock.calls.GetDispute, callInfo)
+	mock.lockGetDispute.Unlock()
+	return mock.GetDisputeFunc(id)
+}
+
+// GetDisputeCalls gets all the calls that were made to GetDispute.
+// Check the length with:
+//
+//	len(mockedStore.GetDisputeCalls())
+func (mock *StoreMock) GetDisputeCalls() []struct {
+	ID DisputeId
+} {
+	var calls []struct {
+		ID DisputeId
+	}
+	mock.lockGetDispute.RLock()
+	calls = mock.calls.GetDispute
+	mock.lockGetDispute.RUnlock()
+	return calls
+}
+
+// GetSettlementBatch calls GetSettlementBatchFunc.
+func (mock *StoreMock) GetSettlementBatch(id SettlementBatchId) (*SettlementBatch, error) {
+	if mock.GetSettlementBatchFunc == nil {
+		panic("StoreMock.GetSettlementBatchFunc: method is nil but Store.GetSettlementBatch was just called")
+	}
+	callInfo := struct {
+		ID SettlementBatchId
+	}{
+		ID: id,
+	}
+	mock.lockGetSettlementBatch.Lock()
+	mock.calls.GetSettlementBatch = append(mock.calls.GetSettlementBatch, callInfo)
+	mock.lockGetSettlementBatch.Unlock()
+	return mock.GetSettlementBatchFunc(id)
+}
+
+// GetSettlementBatchCalls gets all the calls that were made to GetSettlementBatch.
+// Check the length with:
+//
+//	len(mockedStore.GetSettlementBatchCalls())
+func (mock *StoreMock) GetSettlementBatchCalls() []struct {
+	ID SettlementBatchId
+} {
+	var calls []struct {
+		ID SettlementBatchId
+	}
+	mock.lockGetSettlementBatch.RLock()
+	calls = mock.calls.GetSettlementBatch
+	mock.lockGetSettlementBatch.RUnlock()
+	return calls
+}
+
 // List calls ListFunc.
 func (mock *StoreMock) List(state PaymentState) ([]*Payment, error) {
 	if mock.ListFunc == nil {
@@ -177,6 +440,60 @@ func (mock *StoreMock) ListCalls() []struct {
 	return calls
 }
 
+// ListDisputes calls ListDisputesFunc.
+func (mock *StoreMock) ListDisputes() ([]*Dispute, error) {
+	if mock.ListDisputesFunc == nil {
+		panic("StoreMock.ListDisputesFunc: method is nil but Store.ListDisputes was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockListDisputes.Lock()
+	mock.calls.ListDisputes = append(mock.calls.ListDisputes, callInfo)
+	mock.lockListDisputes.Unlock()
+	return mock.ListDisputesFunc()
+}
+
+// ListDisputesCalls gets all the calls that were made to ListDisputes.
+// Check the length with:
+//
+//	len(mockedStore.ListDisputesCalls())
+func (mock *StoreMock) ListDisputesCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockListDisputes.RLock()
+	calls = mock.calls.ListDisputes
+	mock.lockListDisputes.RUnlock()
+	return calls
+}
+
+// ListSettlementBatches calls ListSettlementBatchesFunc.
+func (mock *StoreMock) ListSettlementBatches() ([]*SettlementBatch, error) {
+	if mock.ListSettlementBatchesFunc == nil {
+		panic("StoreMock.ListSettlementBatchesFunc: method is nil but Store.ListSettlementBatches was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockListSettlementBatches.Lock()
+	mock.calls.ListSettlementBatches = append(mock.calls.ListSettlementBatches, callInfo)
+	mock.lockListSettlementBatches.Unlock()
+	return mock.ListSettlementBatchesFunc()
+}
+
+// ListSettlementBatchesCalls gets all the calls that were made to ListSettlementBatches.
+// Check the length with:
+//
+//	len(mockedStore.ListSettlementBatchesCalls())
+func (mock *StoreMock) ListSettlementBatchesCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockListSettlementBatches.RLock()
+	calls = mock.calls.ListSettlementBatches
+	mock.lockListSettlementBatches.RUnlock()
+	return calls
+}
+
 // Update calls UpdateFunc.
 func (mock *StoreMock) Update(id PaymentId, version string, fn func(*Payment) error) (*Payment, error) {
 	if mock.UpdateFunc == nil {
@@ -216,3 +533,43 @@ func (mock *StoreMock) UpdateCalls() []struct {
 	mock.lockUpdate.RUnlock()
 	return calls
 }
+
+// UpdateDispute calls UpdateDisputeFunc.
+func (mock *StoreMock) UpdateDispute(id DisputeId, version string, fn func(*Dispute) error) (*Dispute, error) {
+	if mock.UpdateDisputeFunc == nil {
+		panic("StoreMock.UpdateDisputeFunc: method is nil but Store.UpdateDispute was just called")
+	}
+	callInfo := struct {
+		ID      DisputeId
+		Version string
+		Fn      func(*Dispute) error
+	}{
+		ID:      id,
+		Version: version,
+		Fn:      fn,
+	}
+	mock.lockUpdateDispute.Lock()
+	mock.calls.UpdateDispute = append(mock.calls.UpdateDispute, callInfo)
+	mock.lockUpdateDispute.Unlock()
+	return mock.UpdateDisputeFunc(id, version, fn)
+}
+
+// UpdateDisputeCalls gets all the calls that were made to UpdateDispute.
+// Check the length with:
+//
+//	len(mockedStore.UpdateDisputeCalls())
+func (mock *StoreMock) UpdateDisputeCalls() []struct {
+	ID      DisputeId
+	Version string
+	Fn      func(*Dispute) error
+} {
+	var calls []struct {
+		ID      DisputeId
+		Version string
+		Fn      func(*Dispute) error
+	}
+	mock.lockUpdateDispute.RLock()
+	calls = mock.calls.UpdateDispute
+	mock.lockUpdateDispute.RUnlock()
+	return calls
+}
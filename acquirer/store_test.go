@@ -3,7 +3,10 @@ package acquirer
 import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/money"
 	"testing"
+	"time"
 )
 
 func Test_paymentStoreImpl_CreateOrGet(t *testing.T) {
@@ -14,8 +17,7 @@ func Test_paymentStoreImpl_CreateOrGet(t *testing.T) {
 			Id:                  "1234",
 			state:               PaymentStateNew,
 			Version:             "c415e106-4183-4c40-94cd-383eeb9a7704",
-			Amount:              1050,
-			Currency:            "GBP",
+			Money:               money.New(1050, "GBP"),
 			CardNumber:          "1234123412341234",
 			ExpiryDate:          "1220",
 			CardHolder:          "John Doe",
@@ -78,7 +80,7 @@ func Test_paymentStoreImpl_Get(t *testing.T) {
 			Id:      "1234",
 			state:   PaymentStateConfirmed,
 			Version: "c415e106-4183-4c40-94cd-383eeb9a7704",
-			Amount:  1050,
+			Money:   money.New(1050, "GBP"),
 		})
 		assert.NoError(t, err)
 
@@ -102,7 +104,7 @@ func Test_paymentStoreImpl_Update(t *testing.T) {
 			Id:      "1234",
 			state:   PaymentStateConfirmed,
 			Version: "c415e106-4183-4c40-94cd-383eeb9a7704",
-			Amount:  1050,
+			Money:   money.New(1050, "GBP"),
 		})
 		assert.NoError(t, err)
 
@@ -141,7 +143,7 @@ func Test_paymentStoreImpl_Update(t *testing.T) {
 			Id:      "1234",
 			state:   PaymentStateConfirmed,
 			Version: "c415e106-4183-4c40-94cd-383eeb9a7704",
-			Amount:  1050,
+			Money:   money.New(1050, "GBP"),
 		})
 		assert.NoError(t, err)
 
@@ -149,7 +151,7 @@ func Test_paymentStoreImpl_Update(t *testing.T) {
 			p.Amount = 999
 			return nil
 		})
-		assert.ErrorContains(t, err, "version mismatch")
+		assert.ErrorIs(t, err, ErrVersionMismatch)
 	})
 }
 
@@ -171,3 +173,96 @@ func Test_paymentStoreImpl_List(t *testing.T) {
 		assert.Equal(t, 2, len(ps))
 	})
 }
+
+func Test_paymentStoreImpl_Disputes(t *testing.T) {
+	t.Run("create and get", func(t *testing.T) {
+		s := NewStore()
+		d, err := s.CreateDispute(&Dispute{
+			Id:        "d-1234",
+			PaymentId: "1234",
+			state:     DisputeStateOpen,
+			Version:   "c415e106-4183-4c40-94cd-383eeb9a7704",
+			Reason:    DisputeReasonFraudulent,
+			Amount:    1050,
+			Currency:  "GBP",
+		})
+		assert.NoError(t, err)
+		assert.False(t, d.CreatedAt.IsZero())
+
+		d, err = s.GetDispute("d-1234")
+		assert.NoError(t, err)
+		assert.Equal(t, PaymentId("1234"), d.PaymentId)
+		assert.Equal(t, DisputeStateOpen, d.state)
+		assert.Equal(t, DisputeReasonFraudulent, d.Reason)
+
+		_, err = s.CreateDispute(&Dispute{Id: "d-1234"})
+		assert.ErrorContains(t, err, "already exists")
+
+		_, err = s.GetDispute("d-1111")
+		assert.ErrorContains(t, err, "not found")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		s := NewStore()
+		_, err := s.CreateDispute(&Dispute{
+			Id:      "d-1234",
+			state:   DisputeStateOpen,
+			Version: "c415e106-4183-4c40-94cd-383eeb9a7704",
+		})
+		assert.NoError(t, err)
+
+		_, err = s.UpdateDispute("d-1234", "2cea903d-b7f4-4f2c-a39e-0b4a71ff5b2a", func(d *Dispute) error {
+			return nil
+		})
+		assert.ErrorContains(t, err, "version mismatch")
+
+		d, err := s.UpdateDispute("d-1234", "c415e106-4183-4c40-94cd-383eeb9a7704", func(d *Dispute) error {
+			d.Evidence = "foo"
+			return d.SetState(DisputeStateUnderReview)
+		})
+		assert.NoError(t, err)
+		assert.NotEqual(t, "c415e106-4183-4c40-94cd-383eeb9a7704", d.Version)
+
+		ds, err := s.ListDisputes()
+		assert.NoError(t, err)
+		assert.Len(t, ds, 1)
+		assert.Equal(t, "foo", ds[0].Evidence)
+		assert.Equal(t, DisputeStateUnderReview, ds[0].State())
+	})
+}
+
+func Test_paymentStoreImpl_CloseSettlementBatches(t *testing.T) {
+	s := NewStore()
+	require.NoError(t, s.AddSettlementEntry(&SettlementEntry{PaymentId: "1234", Type: SettlementEntryPayment, Currency: "GBP", Amount: 100}))
+	before := time.Now().Add(time.Minute)
+
+	oneBatch := func(id SettlementBatchId) func([]*SettlementEntry) []*SettlementBatch {
+		return func(entries []*SettlementEntry) []*SettlementBatch {
+			return []*SettlementBatch{{Id: id, Currency: "GBP", Entries: entries}}
+		}
+	}
+
+	closed, err := s.CloseSettlementBatches(before, oneBatch("b-1"))
+	require.NoError(t, err)
+	require.Len(t, closed, 1)
+	assert.Len(t, closed[0].Entries, 1)
+	assert.False(t, closed[0].ClosedAt.IsZero())
+
+	closed, err = s.CloseSettlementBatches(before, oneBatch("b-2"))
+	require.NoError(t, err)
+	assert.Empty(t, closed, "settled entries must not be settled again")
+
+	// A failed batch leaves its entries pending.
+	require.NoError(t, s.AddSettlementEntry(&SettlementEntry{PaymentId: "5678", Type: SettlementEntryPayment, Currency: "GBP", Amount: 100}))
+	_, err = s.CloseSettlementBatches(before, oneBatch("b-1"))
+	assert.ErrorContains(t, err, "already exists")
+
+	closed, err = s.CloseSettlementBatches(before, oneBatch("b-3"))
+	require.NoError(t, err)
+	require.Len(t, closed, 1)
+	assert.Equal(t, PaymentId("5678"), closed[0].Entries[0].PaymentId)
+
+	batches, err := s.ListSettlementBatches()
+	require.NoError(t, err)
+	assert.Len(t, batches, 2)
+}
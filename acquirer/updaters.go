@@ -44,3 +44,67 @@ func (a *acquirerImpl) asyncTimeouter() {
 		time.Sleep(10 * time.Second)
 	}
 }
+
+func (a *acquirerImpl) asyncDisputer() {
+	for {
+		payments, err := a.s.List(PaymentStateConfirmed)
+		if err != nil {
+			log.Printf("[ERR] could not list payments: %v", err)
+		}
+
+		for _, payment := range payments {
+			reason, ok := disputeReason(payment.CardNumber)
+			if !ok || payment.DisputeId != "" {
+				continue
+			}
+			if payment.UpdatedAt.Add(disputeDelay).Before(time.Now()) {
+				_, err = a.openDispute(payment, reason)
+				if err != nil {
+					log.Printf("[ERR] failed to dispute payment %s: %s", payment.Id, err)
+				}
+			}
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (a *acquirerImpl) asyncDisputeResolver() {
+	for {
+		disputes, err := a.s.ListDisputes()
+		if err != nil {
+			log.Printf("[ERR] could not list disputes: %v", err)
+		}
+
+		for _, dispute := range disputes {
+			switch {
+			case dispute.State() == DisputeStateOpen && dispute.EvidenceDueBy.Before(time.Now()):
+				err = a.resolveDispute(dispute, false)
+			case dispute.State() == DisputeStateUnderReview && dispute.UpdatedAt.Add(disputeReviewDelay).Before(time.Now()):
+				err = a.resolveDispute(dispute, dispute.Evidence == winningDisputeEvidence)
+			default:
+				continue
+			}
+			if err != nil {
+				log.Printf("[ERR] failed to resolve dispute %s: %s", dispute.Id, err)
+			}
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (a *acquirerImpl) asyncSettler() {
+	for {
+		batches, err := a.closeSettlementBatches(time.Now())
+		if err != nil {
+			log.Printf("[ERR] could not close settlement batches: %v", err)
+		}
+
+		for _, batch := range batches {
+			log.Printf("[INFO] settlement batch %s closed: %s %s, net %d", batch.Id, batch.Date, batch.Currency, batch.Net)
+		}
+
+		time.Sleep(10 * time.Second)
+	}
+}
@@ -0,0 +1,24 @@
+// Package backoff computes the delays between retries of failed operations.
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Exponential returns the delay before the next retry after the given number of consecutive failures.
+// The delay starts at base and doubles with every failure, up to max. It is jittered between a half
+// and the full value, so that operations failed at the same time are not retried all at once.
+func Exponential(base, max time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
@@ -0,0 +1,19 @@
+package backoff
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestExponential(t *testing.T) {
+	base, max := 10*time.Millisecond, 50*time.Millisecond
+
+	for failures, want := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 3: 40 * time.Millisecond, 8: 50 * time.Millisecond} {
+		d := Exponential(base, max, failures)
+		assert.GreaterOrEqual(t, d, want/2)
+		assert.LessOrEqual(t, d, want)
+	}
+
+	assert.Equal(t, time.Duration(0), Exponential(0, 0, 3))
+}
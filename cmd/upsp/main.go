@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io"
+	"log"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway"
+	"mkuznets.com/go/upsp/gateway/acquiring/simulator"
+	"mkuznets.com/go/upsp/gateway/api"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/drift"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/risk"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/migrations"
+	"mkuznets.com/go/upsp/gateway/transitioner"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage:
+  upsp [serve] -p <postgres DSN> [flags]   Run the acquirer simulator and the gateway API
+  upsp [serve] -memory [flags]             Run them without Postgres, keeping the gateway data in memory
+  upsp migrate up|down|status -p <DSN>     Apply, revert or list the database schema migrations
+  upsp reconcile [flags]                   Reconcile gateway payments with the acquirer of a running gateway
+  upsp diagram                             Print the gateway payment state machine in the Graphviz DOT language
+
+Run 'upsp <command> -h' for the command flags.
+`
+
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"serve":     serve,
+	"migrate":   migrate,
+	"reconcile": reconcile,
+	"diagram":   diagram,
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	args := os.Args[1:]
+	cmd := serve
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		var ok bool
+		if cmd, ok = commands[args[0]]; !ok {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		args = args[1:]
+	}
+
+	if err := cmd(ctx, args); err != nil {
+		log.Fatalf("[ERR] %v", err)
+	}
+}
+
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dsn := fs.String("p", "", "Postgres connection string")
+	memory := fs.Bool("memory", false, "Keep the gateway data in memory instead of Postgres (the data is lost on exit)")
+	cutoff := fs.Duration("settlement-cutoff", 0, "Daily settlement cut-off time of the acquirer as an offset from midnight UTC")
+	driftRepair := fs.Bool("drift-repair", false, "Repair state discrepancies found by the background reconciliation")
+	concurrency := fs.Int("concurrency", 10, "Number of payments transitioned in parallel by the background worker")
+	acquirers := fs.String("acquirers", "simulator", "Comma-separated names of the simulated acquirers to register")
+	routingFile := fs.String("routing", "", "JSON file with the routing rules and the default route of the payments")
+	binTableFile := fs.String("bin-table", "", "JSON file mapping card number prefixes to ISO 3166 issuer countries (default: the simulator test cards)")
+	autoMigrate := fs.Bool("migrate", false, "Apply pending database schema migrations on startup")
+	fingerprintKey := fs.String("fingerprint-key", "", "Secret the card fingerprints are keyed with (default $UPSP_FINGERPRINT_KEY)")
+	trustedProxies := fs.String("trusted-proxies", "", "Comma-separated IPs or CIDR networks of the reverse proxies whose X-Forwarded-For is trusted")
+	_ = fs.Parse(args)
+
+	if *cutoff < 0 || *cutoff >= 24*time.Hour {
+		return fmt.Errorf("settlement cut-off must be an offset within a day, e.g. 22h or 17h30m")
+	}
+
+	key, err := fingerprintKeyOf(*fingerprintKey, *memory)
+	if err != nil {
+		return err
+	}
+	proxies, err := parseNetworks(*trustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	var s store.Store
+	switch {
+	case *memory:
+		log.Printf("[WARN] gateway data is kept in memory and will be lost on exit")
+		s = store.NewMemory()
+	case *dsn == "":
+		return fmt.Errorf("postgres connection string is required (-p), or -memory to run without postgres")
+	default:
+		pool, err := pgxpool.Connect(ctx, *dsn)
+		if err != nil {
+			return fmt.Errorf("could not connect to postgres: %w", err)
+		}
+		defer pool.Close()
+
+		m, err := migrations.New(pool)
+		if err != nil {
+			return err
+		}
+		if *autoMigrate {
+			applied, err := m.Up(ctx)
+			if err != nil {
+				return err
+			}
+			for _, migration := range applied {
+				log.Printf("[INFO] applied migration %d_%s", migration.Version, migration.Name)
+			}
+		}
+		if err := m.Check(ctx); err != nil {
+			return fmt.Errorf("%w (run 'upsp migrate up' or serve with -migrate)", err)
+		}
+
+		s = store.New(pool)
+	}
+
+	bins, err := binTable(*binTableFile)
+	if err != nil {
+		return err
+	}
+	routerOpts, err := routingOptions(*routingFile)
+	if err != nil {
+		return err
+	}
+	routerOpts = append(routerOpts, routing.WithBinTable(bins))
+	for _, name := range strings.Split(*acquirers, ",") {
+		acq := acquirer.New(acquirer.NewStore(), acquirer.WithSettlementCutoff(*cutoff))
+		acq.Start()
+		routerOpts = append(routerOpts, routing.WithAcquirer(strings.TrimSpace(name), simulator.New(acq)))
+	}
+	router, err := routing.New(routerOpts...)
+	if err != nil {
+		return fmt.Errorf("invalid routing: %w", err)
+	}
+	if err := checkAcquirers(ctx, s, router); err != nil {
+		return err
+	}
+
+	gw := gateway.New(s, router,
+		gateway.WithDriftOptions(drift.WithAutoRepair(*driftRepair)),
+		gateway.WithTransitionerOptions(transitioner.WithConcurrency(*concurrency),
+			transitioner.WithRiskOptions(risk.WithBinTable(bins))),
+		gateway.WithApiOptions(api.WithFingerprintKey(key), api.WithTrustedProxies(proxies...)),
+	)
+	gw.Start(ctx)
+	return nil
+}
+
+// fingerprintKeyOf returns the card fingerprint key given by the flag or the environment.
+// The key must persist with the gateway data, so a random one is only generated if the data is kept in memory.
+func fingerprintKeyOf(flagValue string, memory bool) ([]byte, error) {
+	if flagValue == "" {
+		flagValue = os.Getenv("UPSP_FINGERPRINT_KEY")
+	}
+	if flagValue != "" {
+		return []byte(flagValue), nil
+	}
+	if !memory {
+		return nil, fmt.Errorf("card fingerprint key is required (-fingerprint-key or UPSP_FINGERPRINT_KEY)")
+	}
+
+	log.Printf("[WARN] card fingerprint key is not set, using a random one")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// parseNetworks parses a comma-separated list of CIDR networks. A single IP address is a network of its own.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", item)
+			}
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// checkAcquirers returns an error if active payments are routed to acquirers that are not registered,
+// e.g. payments created before routing was introduced, which are routed to "simulator".
+func checkAcquirers(ctx context.Context, s store.Store, router routing.Router) error {
+	names, err := s.Payments().ListActiveAcquirers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := router.Acquirer(name); err != nil {
+			return fmt.Errorf("%w: active payments are routed to it, register it with -acquirers", err)
+		}
+	}
+	return nil
+}
+
+// routingConfig is the format of the routing file.
+type routingConfig struct {
+	Default []string       `json:"default"`
+	Rules   []routing.Rule `json:"rules"`
+}
+
+// routingOptions reads the routing rules and the default route from the given file, if any.
+func routingOptions(path string) ([]routing.Option, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config routingConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid routing file %s: %w", path, err)
+	}
+
+	return []routing.Option{
+		routing.WithRules(config.Rules...),
+		routing.WithDefaultRoute(config.Default...),
+	}, nil
+}
+
+// binTable reads the table of the card issuer countries from the given file, if any.
+// Otherwise, it is the table of the simulator test cards.
+func binTable(path string) (cards.BinTable, error) {
+	if path == "" {
+		return cards.TestBins, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bins cards.BinTable
+	if err := json.Unmarshal(data, &bins); err != nil {
+		return nil, fmt.Errorf("invalid BIN table file %s: %w", path, err)
+	}
+	return bins, nil
+}
+
+func migrate(ctx context.Context, args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dsn := fs.String("p", "", "Postgres connection string")
+	steps := fs.Int("steps", 1, "Number of the most recent migrations to revert (down only)")
+	_ = fs.Parse(args[1:])
+
+	if *dsn == "" {
+		return fmt.Errorf("postgres connection string is required (-p)")
+	}
+	pool, err := pgxpool.Connect(ctx, *dsn)
+	if err != nil {
+		return fmt.Errorf("could not connect to postgres: %w", err)
+	}
+	defer pool.Close()
+
+	m, err := migrations.New(pool)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, migration := range applied {
+			log.Printf("[INFO] applied migration %d_%s", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Printf("[INFO] database schema is up to date")
+		}
+		return err
+	case "down":
+		if *steps < 1 {
+			return fmt.Errorf("number of steps must be positive")
+		}
+		reverted, err := m.Down(ctx, *steps)
+		for _, migration := range reverted {
+			log.Printf("[INFO] reverted migration %d_%s", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, st := range statuses {
+			appliedAt := "pending"
+			if st.AppliedAt != nil {
+				appliedAt = st.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if st.Up == "" {
+				appliedAt += " (unknown)"
+			}
+			fmt.Fprintf(w, "%03d\t%s\t%s\n", st.Version, st.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", action)
+	}
+}
+
+func reconcile(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	addr := fs.String("addr", "http://127.0.0.1:8080", "Address of the running gateway API")
+	repair := fs.Bool("repair", false, "Repair discrepancies that can be resolved by applying the acquirer state")
+	_ = fs.Parse(args)
+
+	body, err := json.Marshal(map[string]bool{"repair": *repair})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *addr+"/admin/reconciliation", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("reconciliation failed: %s: %s", resp.Status, msg)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func diagram(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("diagram", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	_, err := fmt.Print(models.PaymentStateDiagram())
+	return err
+}
@@ -0,0 +1,55 @@
+package acquiring
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrPaymentNotFound is returned when the acquirer does not know the requested payment.
+	ErrPaymentNotFound = errors.New("acquirer payment not found")
+	// ErrVersionMismatch is returned when an acquirer object has changed since the version the request is based on.
+	ErrVersionMismatch = errors.New("acquirer version mismatch")
+)
+
+// Capabilities are the optional features of an acquirer.
+type Capabilities struct {
+	// ThreeDSecure is set if the acquirer authenticates the cardholder with 3DS when the issuer requires it.
+	ThreeDSecure bool `json:"three_d_secure"`
+	// PartialCapture is set if an authorised payment can be captured for less than the authorised amount.
+	PartialCapture bool `json:"partial_capture"`
+	// Refunds is set if the acquirer refunds captured payments.
+	Refunds bool `json:"refunds"`
+}
+
+// AcquirerAdapter is the interface of the gateway to an acquirer. An adapter translates the API of a particular
+// acquirer to the normalised payment and dispute states, decline codes and settlement entries of the gateway,
+// and its errors to the errors of this package.
+//
+// Objects changed by a request carry a version, which the next change must be based on:
+// a request with a stale version fails with ErrVersionMismatch.
+type AcquirerAdapter interface {
+	// Capabilities returns the optional features the acquirer supports.
+	Capabilities() Capabilities
+
+	// CreatePayment creates a payment with the ID chosen by the gateway. The acquirer deduplicates payments by ID:
+	// if the payment already exists, it is returned as is.
+	CreatePayment(ctx context.Context, req *CreatePaymentRequest) (*Payment, error)
+	// AuthorisePayment authorises a created payment with the given card. The payment is declined,
+	// authorised, or requires the cardholder action if the acquirer authenticates the cardholder.
+	AuthorisePayment(ctx context.Context, id, version string, card *Card) (*Payment, error)
+	// CapturePayment captures the full amount of an authorised payment.
+	CapturePayment(ctx context.Context, id, version string) (*Payment, error)
+	// GetPayment returns the current state of the payment.
+	GetPayment(ctx context.Context, id string) (*Payment, error)
+
+	// GetDispute returns the current state of the dispute.
+	GetDispute(ctx context.Context, id string) (*Dispute, error)
+	// SubmitDisputeEvidence submits the merchant evidence for an open dispute.
+	SubmitDisputeEvidence(ctx context.Context, id, version, evidence string) (*Dispute, error)
+
+	// ListSettlementBatches returns all settlement batches closed by the acquirer.
+	ListSettlementBatches(ctx context.Context) ([]*SettlementBatch, error)
+	// GetSettlementEntries returns the entries of the settlement batch.
+	GetSettlementEntries(ctx context.Context, batchId string) ([]*SettlementEntry, error)
+}
@@ -0,0 +1,128 @@
+package acquiring
+
+import "time"
+
+type (
+	PaymentState        string
+	DeclineCode         string
+	DisputeState        string
+	SettlementEntryType string
+)
+
+const (
+	// PaymentStateCreated is the state of a payment that has been created but not yet authorised.
+	PaymentStateCreated PaymentState = "created"
+	// PaymentStateAuthorising is the state of a payment whose authorisation is in progress.
+	PaymentStateAuthorising PaymentState = "authorising"
+	// PaymentStateActionRequired is the state of a payment that waits for the cardholder to authenticate (e.g. with 3DS).
+	PaymentStateActionRequired PaymentState = "action_required"
+	// PaymentStateAuthorised is the state of a payment that has been authorised but not yet captured.
+	PaymentStateAuthorised PaymentState = "authorised"
+	// PaymentStateCaptured is the state of a payment whose funds have been captured.
+	PaymentStateCaptured PaymentState = "captured"
+	// PaymentStateVoided is the state of a payment that has been cancelled before capture. Final state.
+	PaymentStateVoided PaymentState = "voided"
+	// PaymentStateDeclined is the state of a payment that failed the authorisation. Final state.
+	PaymentStateDeclined PaymentState = "declined"
+	// PaymentStateRefunded is the state of a captured payment that has been refunded. Final state.
+	PaymentStateRefunded PaymentState = "refunded"
+	// PaymentStateDisputed is the state of a captured payment that has been disputed by the cardholder.
+	PaymentStateDisputed PaymentState = "disputed"
+	// PaymentStateChargedBack is the state of a disputed payment that has been charged back. Final state.
+	PaymentStateChargedBack PaymentState = "charged_back"
+)
+
+const (
+	// DeclineDoNotHonour is used when the issuer declines the payment without a specific reason.
+	DeclineDoNotHonour DeclineCode = "do_not_honour"
+	// DeclineInsufficientFunds is used when the card does not have enough funds.
+	DeclineInsufficientFunds DeclineCode = "insufficient_funds"
+	// DeclineExpiredCard is used when the card has expired.
+	DeclineExpiredCard DeclineCode = "expired_card"
+	// DeclineAuthenticationFailed is used when the cardholder fails or abandons the authentication (e.g. 3DS).
+	DeclineAuthenticationFailed DeclineCode = "authentication_failed"
+	// DeclineUnknown is used when the acquirer reports a reason the adapter does not map.
+	DeclineUnknown DeclineCode = "unknown"
+)
+
+const (
+	// DisputeStateOpen is the state of a dispute that waits for the merchant evidence.
+	DisputeStateOpen DisputeState = "open"
+	// DisputeStateUnderReview is the state of a dispute whose evidence is being reviewed by the issuer.
+	DisputeStateUnderReview DisputeState = "under_review"
+	// DisputeStateWon is the state of a dispute resolved in favour of the merchant. Final state.
+	DisputeStateWon DisputeState = "won"
+	// DisputeStateLost is the state of a dispute resolved in favour of the cardholder. Final state.
+	DisputeStateLost DisputeState = "lost"
+)
+
+const (
+	SettlementEntryPayment    SettlementEntryType = "payment"
+	SettlementEntryRefund     SettlementEntryType = "refund"
+	SettlementEntryChargeback SettlementEntryType = "chargeback"
+)
+
+type CreatePaymentRequest struct {
+	Id       string
+	Amount   int64
+	Currency string
+	// ThreeDSecure requires the acquirer to authenticate the cardholder with 3DS, even if the issuer does not.
+	// It must only be set if the acquirer supports 3DS (see Capabilities).
+	ThreeDSecure bool
+}
+
+type Card struct {
+	Number     string
+	ExpiryDate string
+	Holder     string
+	Cvv        string
+}
+
+type Payment struct {
+	Id      string
+	State   PaymentState
+	Version string
+
+	// DeclineCode is the reason the payment has been declined, if it has.
+	DeclineCode DeclineCode
+	// ActionUrl is the URL the cardholder completes the required action at, if it is required.
+	ActionUrl string
+	// DisputeId is the ID of the dispute opened against the payment, if any.
+	DisputeId string
+}
+
+type Dispute struct {
+	Id        string
+	PaymentId string
+	State     DisputeState
+	Version   string
+
+	Reason   string
+	Amount   int64
+	Currency string
+
+	EvidenceDueBy time.Time
+}
+
+type SettlementBatch struct {
+	Id       string
+	Date     string
+	Currency string
+	CutoffAt time.Time
+
+	Gross      int64
+	Fees       int64
+	Net        int64
+	EntryCount int
+}
+
+type SettlementEntry struct {
+	BatchId   string
+	PaymentId string
+	Type      SettlementEntryType
+	Currency  string
+	Amount    int64
+	Fee       int64
+	Net       int64
+	CreatedAt time.Time
+}
@@ -0,0 +1,258 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"strconv"
+	"time"
+)
+
+// paymentStates maps the states of the simulator payments to the normalised ones.
+var paymentStates = map[acquirer.PaymentState]acquiring.PaymentState{
+	acquirer.PaymentStateNew:              acquiring.PaymentStateCreated,
+	acquirer.PaymentStateAuthorising:      acquiring.PaymentStateAuthorising,
+	acquirer.PaymentState3dSecureRequired: acquiring.PaymentStateActionRequired,
+	acquirer.PaymentStateAuthorised:       acquiring.PaymentStateAuthorised,
+	acquirer.PaymentStateConfirmed:        acquiring.PaymentStateCaptured,
+	acquirer.PaymentStateCancelled:        acquiring.PaymentStateVoided,
+	acquirer.PaymentStateReversed:         acquiring.PaymentStateVoided,
+	acquirer.PaymentStateRefunded:         acquiring.PaymentStateRefunded,
+	acquirer.PaymentStateRejected:         acquiring.PaymentStateDeclined,
+	acquirer.PaymentStateDisputed:         acquiring.PaymentStateDisputed,
+	acquirer.PaymentStateChargedBack:      acquiring.PaymentStateChargedBack,
+}
+
+// declineCodes maps the reject reasons of the simulator payments to the normalised decline codes.
+var declineCodes = map[acquirer.RejectReason]acquiring.DeclineCode{
+	acquirer.RejectReasonDeclined:   acquiring.DeclineDoNotHonour,
+	acquirer.RejectReason3dsFailed:  acquiring.DeclineAuthenticationFailed,
+	acquirer.RejectReason3dsTimeout: acquiring.DeclineAuthenticationFailed,
+}
+
+// disputeStates maps the states of the simulator disputes to the normalised ones.
+var disputeStates = map[acquirer.DisputeState]acquiring.DisputeState{
+	acquirer.DisputeStateOpen:        acquiring.DisputeStateOpen,
+	acquirer.DisputeStateUnderReview: acquiring.DisputeStateUnderReview,
+	acquirer.DisputeStateWon:         acquiring.DisputeStateWon,
+	acquirer.DisputeStateLost:        acquiring.DisputeStateLost,
+}
+
+type adapterImpl struct {
+	acq acquirer.Acquirer
+}
+
+// New creates a new AcquirerAdapter of the acquirer simulator.
+func New(acq acquirer.Acquirer) acquiring.AcquirerAdapter {
+	return &adapterImpl{acq: acq}
+}
+
+// Capabilities returns the optional features of the simulator: it authenticates the cardholders with 3DS
+// and refunds some of the test card payments, but captures the full amount only.
+func (a *adapterImpl) Capabilities() acquiring.Capabilities {
+	return acquiring.Capabilities{
+		ThreeDSecure:   true,
+		PartialCapture: false,
+		Refunds:        true,
+	}
+}
+
+// CreatePayment creates a payment with the ID chosen by the gateway, or returns the existing one.
+func (a *adapterImpl) CreatePayment(_ context.Context, req *acquiring.CreatePaymentRequest) (*acquiring.Payment, error) {
+	resp, err := a.acq.CreatePayment(&acquirer.CreatePaymentRequest{
+		Id:            acquirer.PaymentId(req.Id),
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		Force3dSecure: req.ThreeDSecure,
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return mapPayment(&resp.PaymentResource), nil
+}
+
+// AuthorisePayment authorises a created payment with the given card.
+func (a *adapterImpl) AuthorisePayment(_ context.Context, id, version string, card *acquiring.Card) (*acquiring.Payment, error) {
+	resp, err := a.acq.AuthorisePayment(acquirer.PaymentId(id), version, &acquirer.AuthorisePaymentRequest{
+		CardNumber: card.Number,
+		ExpiryDate: card.ExpiryDate,
+		CardHolder: card.Holder,
+		Cvv:        card.Cvv,
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	p := mapPayment(&resp.Payment)
+	p.ActionUrl = resp.AuthUrl
+	return p, nil
+}
+
+// CapturePayment confirms an authorised payment.
+func (a *adapterImpl) CapturePayment(_ context.Context, id, version string) (*acquiring.Payment, error) {
+	resp, err := a.acq.ConfirmPayment(acquirer.PaymentId(id), version)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return mapPayment(&resp.Payment), nil
+}
+
+// GetPayment returns the current state of the payment.
+func (a *adapterImpl) GetPayment(_ context.Context, id string) (*acquiring.Payment, error) {
+	resp, err := a.acq.GetPayment(acquirer.PaymentId(id))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return mapPayment(resp), nil
+}
+
+// GetDispute returns the current state of the dispute.
+func (a *adapterImpl) GetDispute(_ context.Context, id string) (*acquiring.Dispute, error) {
+	resp, err := a.acq.GetDispute(acquirer.DisputeId(id))
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return mapDispute(resp), nil
+}
+
+// SubmitDisputeEvidence submits the merchant evidence for an open dispute.
+func (a *adapterImpl) SubmitDisputeEvidence(_ context.Context, id, version, evidence string) (*acquiring.Dispute, error) {
+	resp, err := a.acq.SubmitDisputeEvidence(acquirer.DisputeId(id), version, &acquirer.SubmitDisputeEvidenceRequest{
+		Evidence: evidence,
+	})
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return mapDispute(&resp.Dispute), nil
+}
+
+// ListSettlementBatches returns all settlement batches closed by the simulator.
+func (a *adapterImpl) ListSettlementBatches(_ context.Context) ([]*acquiring.SettlementBatch, error) {
+	resp, err := a.acq.ListSettlementBatches()
+	if err != nil {
+		return nil, mapError(err)
+	}
+
+	batches := make([]*acquiring.SettlementBatch, 0, len(resp))
+	for _, b := range resp {
+		batches = append(batches, &acquiring.SettlementBatch{
+			Id:         string(b.Id),
+			Date:       b.Date,
+			Currency:   b.Currency,
+			CutoffAt:   b.CutoffAt,
+			Gross:      b.Gross,
+			Fees:       b.Fees,
+			Net:        b.Net,
+			EntryCount: b.EntryCount,
+		})
+	}
+	return batches, nil
+}
+
+// GetSettlementEntries downloads the CSV settlement report of the batch and parses its entries.
+func (a *adapterImpl) GetSettlementEntries(_ context.Context, batchId string) ([]*acquiring.SettlementEntry, error) {
+	report, err := a.acq.GetSettlementReport(acquirer.SettlementBatchId(batchId), acquirer.SettlementReportCsv)
+	if err != nil {
+		return nil, mapError(err)
+	}
+	return parseReport(report)
+}
+
+// mapPayment translates the simulator payment to the normalised one. A state the adapter does not map is passed
+// as is, so that the gateway reports it as an unmapped acquirer state.
+func mapPayment(r *acquirer.PaymentResource) *acquiring.Payment {
+	state, ok := paymentStates[r.State]
+	if !ok {
+		state = acquiring.PaymentState(r.State)
+	}
+
+	p := &acquiring.Payment{
+		Id:        string(r.Id),
+		State:     state,
+		Version:   r.Version,
+		DisputeId: string(r.DisputeId),
+	}
+	if state == acquiring.PaymentStateDeclined {
+		if p.DeclineCode, ok = declineCodes[r.RejectReason]; !ok {
+			p.DeclineCode = acquiring.DeclineUnknown
+		}
+	}
+	return p
+}
+
+// mapDispute translates the simulator dispute to the normalised one. A state the adapter does not map is passed as is.
+func mapDispute(r *acquirer.DisputeResource) *acquiring.Dispute {
+	state, ok := disputeStates[r.State]
+	if !ok {
+		state = acquiring.DisputeState(r.State)
+	}
+
+	return &acquiring.Dispute{
+		Id:            string(r.Id),
+		PaymentId:     string(r.PaymentId),
+		State:         state,
+		Version:       r.Version,
+		Reason:        string(r.Reason),
+		Amount:        r.Amount,
+		Currency:      r.Currency,
+		EvidenceDueBy: r.EvidenceDueBy,
+	}
+}
+
+// mapError wraps the errors of the simulator that the gateway handles into the errors of the acquiring package.
+func mapError(err error) error {
+	switch {
+	case errors.Is(err, acquirer.ErrPaymentNotFound):
+		return fmt.Errorf("%w: %v", acquiring.ErrPaymentNotFound, err)
+	case errors.Is(err, acquirer.ErrVersionMismatch):
+		return fmt.Errorf("%w: %v", acquiring.ErrVersionMismatch, err)
+	}
+	return err
+}
+
+// parseReport parses the CSV settlement report produced by the simulator.
+func parseReport(report []byte) ([]*acquiring.SettlementEntry, error) {
+	records, err := csv.NewReader(bytes.NewReader(report)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty settlement report")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"batch_id", "payment_id", "type", "currency", "amount", "fee", "net", "created_at"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("settlement report has no %s column", name)
+		}
+	}
+
+	entries := make([]*acquiring.SettlementEntry, 0, len(records)-1)
+	for i, record := range records[1:] {
+		entry := &acquiring.SettlementEntry{
+			BatchId:   record[columns["batch_id"]],
+			PaymentId: record[columns["payment_id"]],
+			Type:      acquiring.SettlementEntryType(record[columns["type"]]),
+			Currency:  record[columns["currency"]],
+		}
+
+		for name, v := range map[string]*int64{"amount": &entry.Amount, "fee": &entry.Fee, "net": &entry.Net} {
+			if *v, err = strconv.ParseInt(record[columns[name]], 10, 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s: %w", i+2, name, err)
+			}
+		}
+		if entry.CreatedAt, err = time.Parse(time.RFC3339Nano, record[columns["created_at"]]); err != nil {
+			return nil, fmt.Errorf("line %d: invalid created_at: %w", i+2, err)
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
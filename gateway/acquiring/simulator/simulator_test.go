@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"testing"
+	"time"
+)
+
+func createPayment(t *testing.T, a acquiring.AcquirerAdapter) *acquiring.Payment {
+	p, err := a.CreatePayment(context.Background(), &acquiring.CreatePaymentRequest{
+		Id:       uuid.NewString(),
+		Amount:   100,
+		Currency: "EUR",
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func testCard(number string) *acquiring.Card {
+	return &acquiring.Card{Number: number, ExpiryDate: "1077", Holder: "John Doe", Cvv: "123"}
+}
+
+func TestAdapter_Payment(t *testing.T) {
+	ctx := context.Background()
+	a := New(acquirer.New(acquirer.NewStore()))
+
+	p := createPayment(t, a)
+	assert.Equal(t, acquiring.PaymentStateCreated, p.State)
+
+	p, err := a.AuthorisePayment(ctx, p.Id, p.Version, testCard("4242424242424242"))
+	require.NoError(t, err)
+	assert.Equal(t, acquiring.PaymentStateAuthorised, p.State)
+
+	p, err = a.CapturePayment(ctx, p.Id, p.Version)
+	require.NoError(t, err)
+	assert.Equal(t, acquiring.PaymentStateCaptured, p.State)
+
+	rGet, err := a.GetPayment(ctx, p.Id)
+	require.NoError(t, err)
+	assert.Equal(t, p, rGet)
+}
+
+func TestAdapter_AuthorisePayment(t *testing.T) {
+	tests := []struct {
+		name        string
+		cardNumber  string
+		state       acquiring.PaymentState
+		declineCode acquiring.DeclineCode
+	}{
+		{"authorised", "4242424242424242", acquiring.PaymentStateAuthorised, ""},
+		{"3ds required", "4000000000003220", acquiring.PaymentStateActionRequired, ""},
+		{"declined", "4000000000000101", acquiring.PaymentStateDeclined, acquiring.DeclineDoNotHonour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(acquirer.New(acquirer.NewStore()))
+			p := createPayment(t, a)
+
+			p, err := a.AuthorisePayment(context.Background(), p.Id, p.Version, testCard(tt.cardNumber))
+			require.NoError(t, err)
+			assert.Equal(t, tt.state, p.State)
+			assert.Equal(t, tt.declineCode, p.DeclineCode)
+			assert.Equal(t, tt.state == acquiring.PaymentStateActionRequired, p.ActionUrl != "")
+		})
+	}
+}
+
+func TestAdapter_CreatePayment_threeDSecure(t *testing.T) {
+	ctx := context.Background()
+	a := New(acquirer.New(acquirer.NewStore()))
+
+	p, err := a.CreatePayment(ctx, &acquiring.CreatePaymentRequest{
+		Id:           uuid.NewString(),
+		Amount:       100,
+		Currency:     "EUR",
+		ThreeDSecure: true,
+	})
+	require.NoError(t, err)
+
+	p, err = a.AuthorisePayment(ctx, p.Id, p.Version, testCard("4242424242424242"))
+	require.NoError(t, err)
+	assert.Equal(t, acquiring.PaymentStateActionRequired, p.State, "3DS must be required regardless of the card")
+}
+
+func TestAdapter_errors(t *testing.T) {
+	ctx := context.Background()
+	a := New(acquirer.New(acquirer.NewStore()))
+
+	_, err := a.GetPayment(ctx, uuid.NewString())
+	assert.ErrorIs(t, err, acquiring.ErrPaymentNotFound)
+
+	p := createPayment(t, a)
+	_, err = a.AuthorisePayment(ctx, p.Id, uuid.NewString(), testCard("4242424242424242"))
+	assert.ErrorIs(t, err, acquiring.ErrVersionMismatch)
+}
+
+func Test_mapPayment_unmapped(t *testing.T) {
+	p := mapPayment(&acquirer.PaymentResource{Id: "1", State: "frozen", Version: "2"})
+	assert.Equal(t, acquiring.PaymentState("frozen"), p.State, "unmapped state must be passed as is")
+
+	p = mapPayment(&acquirer.PaymentResource{Id: "1", State: acquirer.PaymentStateRejected, Version: "2"})
+	assert.Equal(t, acquiring.DeclineUnknown, p.DeclineCode)
+}
+
+func Test_parseReport(t *testing.T) {
+	report := []byte("batch_id,payment_id,type,currency,amount,fee,net,created_at\n" +
+		"b1,p1,payment,EUR,100,-3,97,2022-10-01T12:00:00Z\n" +
+		"b1,p2,refund,EUR,-50,0,-50,2022-10-01T13:00:00Z\n")
+
+	entries, err := parseReport(report)
+	require.NoError(t, err)
+	assert.Equal(t, []*acquiring.SettlementEntry{
+		{BatchId: "b1", PaymentId: "p1", Type: acquiring.SettlementEntryPayment, Currency: "EUR", Amount: 100, Fee: -3, Net: 97,
+			CreatedAt: time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)},
+		{BatchId: "b1", PaymentId: "p2", Type: acquiring.SettlementEntryRefund, Currency: "EUR", Amount: -50, Fee: 0, Net: -50,
+			CreatedAt: time.Date(2022, 10, 1, 13, 0, 0, 0, time.UTC)},
+	}, entries)
+
+	_, err = parseReport([]byte("batch_id,payment_id\nb1,p1\n"))
+	assert.ErrorContains(t, err, "no type column")
+
+	_, err = parseReport([]byte("batch_id,payment_id,type,amount,fee,net,created_at\nb1,p1,payment,100,0,100,2022-10-01T12:00:00Z\n"))
+	assert.ErrorContains(t, err, "no currency column")
+
+	_, err = parseReport([]byte("batch_id,payment_id,type,currency,amount,fee,net,created_at\nb1,p1,payment,EUR,x,0,0,2022-10-01T12:00:00Z\n"))
+	assert.ErrorContains(t, err, "invalid amount")
+}
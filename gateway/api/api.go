@@ -2,50 +2,165 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v4"
 	"log"
-	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/drift"
 	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
 	"mkuznets.com/go/upsp/gateway/store"
 	"mkuznets.com/go/upsp/gateway/transitioner"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// merchantIdHeader is the request header that identifies the merchant.
+const merchantIdHeader = "X-Merchant-Id"
+
+const (
+	// requestTimeout is how long a request may take, unless it waits for changes.
+	requestTimeout = 30 * time.Second
+	// defaultWaitTimeout is how long a long-polling request waits for a change by default.
+	defaultWaitTimeout = 30 * time.Second
+	// maxWaitTimeout is the longest a long-polling request may wait for a change.
+	maxWaitTimeout = 60 * time.Second
+	// waitRecheckInterval is the interval between reads of a long-polled payment,
+	// which observe the changes made by other gateway instances.
+	waitRecheckInterval = 5 * time.Second
+)
+
+// syncTransitionLease is how long the background worker leaves a new payment to the synchronous transition of the API.
+const syncTransitionLease = 30 * time.Second
+
 type Api struct {
 	addr         string
 	store        store.Store
 	transitioner transitioner.Transitioner
+	drift        drift.Reconciler
+	events       *eventBroker
 	router       *chi.Mux
+
+	// fingerprintKey is the secret the card fingerprints are keyed with.
+	fingerprintKey []byte
+	// trustedProxies are the networks of the reverse proxies whose X-Forwarded-For headers are trusted.
+	trustedProxies []*net.IPNet
+
+	// shutdown is closed when the server starts shutting down, to end the long-lived requests.
+	shutdown chan struct{}
+}
+
+// Option configures the API.
+type Option func(*Api)
+
+// WithFingerprintKey sets the secret the card fingerprints are keyed with (see cards.Fingerprint).
+// Changing it makes the fingerprints of the existing payments and card blocklists unrecognisable.
+func WithFingerprintKey(key []byte) Option {
+	return func(a *Api) {
+		a.fingerprintKey = key
+	}
 }
 
-func New(store store.Store, acq acquirer.Acquirer) *Api {
+// WithTrustedProxies sets the networks of the reverse proxies in front of the API.
+// The client IP of a request that comes from them is taken from the X-Forwarded-For header.
+func WithTrustedProxies(nets ...*net.IPNet) Option {
+	return func(a *Api) {
+		a.trustedProxies = append(a.trustedProxies, nets...)
+	}
+}
+
+// WithReconciler sets the state reconciler run on demand by the API, so that it shares the configuration
+// of the background reconciliation. By default, a reconciler with the default options is used.
+func WithReconciler(r drift.Reconciler) Option {
+	return func(a *Api) {
+		a.drift = r
+	}
+}
+
+func New(store store.Store, router routing.Router, tr transitioner.Transitioner, opts ...Option) *Api {
 	a := &Api{
 		addr:         ":8080",
 		store:        store,
 		router:       chi.NewRouter(),
-		transitioner: transitioner.New(store, acq),
+		transitioner: tr,
+		drift:        drift.New(store, router),
+		events:       newEventBroker(store),
+		shutdown:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
 
-	a.router.Use(middleware.Timeout(30 * time.Second))
 	a.router.Use(middleware.Recoverer)
 	a.router.Use(middleware.Logger)
+	a.routes(a.router)
+
+	return a
+}
 
-	a.router.Route("/payments", func(r chi.Router) {
-		r.Post("/", a.CreatePayment)
-		r.Get("/{paymentId}", a.GetPayment)
+func (api *Api) routes(router chi.Router) {
+	timeout := middleware.Timeout(requestTimeout)
+
+	router.Route("/payments", func(r chi.Router) {
+		r.With(timeout).Post("/", api.CreatePayment)
+		// Long-polling requests wait for a change for up to maxWaitTimeout.
+		r.With(middleware.Timeout(maxWaitTimeout+requestTimeout)).Get("/{paymentId}", api.GetPayment)
+		// Event streams are long-lived and are not subject to the request timeout.
+		r.Get("/{paymentId}/stream", api.StreamPayment)
+		r.Get("/stream", api.StreamMerchantPayments)
 	})
 
-	return a
+	router.Route("/disputes", func(r chi.Router) {
+		r.Use(timeout)
+		r.Get("/", api.ListDisputes)
+		r.Get("/{disputeId}", api.GetDispute)
+		r.Post("/{disputeId}/evidence", api.SubmitDisputeEvidence)
+	})
+
+	router.With(timeout).Get("/settlements/reconciliation", api.GetSettlementReconciliation)
+
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(timeout)
+		r.Post("/reconciliation", api.ReconcileStates)
+		r.Get("/discrepancies", api.ListDiscrepancies)
+		r.Get("/payments/dead-letter", api.ListDeadLetterPayments)
+		r.Post("/payments/{paymentId}/retry", api.RetryPayment)
+		r.Get("/merchants/{merchantId}", api.GetMerchant)
+		r.Put("/merchants/{merchantId}", api.UpdateMerchant)
+		r.Get("/risk/rules", api.ListRiskRules)
+		r.Post("/risk/rules", api.CreateRiskRule)
+		r.Get("/risk/rules/{ruleId}", api.GetRiskRule)
+		r.Put("/risk/rules/{ruleId}", api.UpdateRiskRule)
+		r.Delete("/risk/rules/{ruleId}", api.DeleteRiskRule)
+	})
 }
 
+// Start serves the API until the context is cancelled, then waits for the requests in progress to finish.
 func (api *Api) Start(ctx context.Context) {
-	if err := http.ListenAndServe(api.addr, api.router); err != nil {
+	server := &http.Server{Addr: api.addr, Handler: api.router}
+	server.RegisterOnShutdown(func() {
+		close(api.shutdown)
+	})
+
+	go api.events.Start(ctx)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[WARN] could not shut down the server: %s", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Printf("[WARN] server has terminated: %s", err)
 	}
 }
@@ -62,59 +177,446 @@ func (api *Api) CreatePayment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx := r.Context()
+
+	merchantId := r.Header.Get(merchantIdHeader)
+	async, err := api.isAsync(ctx, merchantId, &request)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
 	paymentModel := &models.Payment{
 		Id:         uuid.NewString(),
-		Amount:     request.Amount,
-		Currency:   request.Currency,
+		MerchantId: merchantId,
+		Money:      request.Money,
 		State:      models.PaymentStateProcessing,
 		CardNumber: request.CardNumber,
 		CardHolder: request.CardHolder,
 		ExpiryDate: request.ExpiryDate,
 		Cvv:        request.Cvv,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+
+		CardFingerprint: cards.Fingerprint(api.fingerprintKey, request.CardNumber),
+		ClientIp:        api.clientIp(r),
+
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
+	if !async {
+		// The payment is transitioned synchronously below, the background worker only picks it up
+		// if the synchronous transition does not complete in time.
+		nextAttemptAt := time.Now().UTC().Add(syncTransitionLease)
+		paymentModel.NextAttemptAt = &nextAttemptAt
+	}
+
+	// The payment is committed before the transition, which must not run in a transaction (see Transitioner.Transition).
+	id, err := api.store.Payments().Create(ctx, paymentModel)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	// An asynchronous payment is due immediately, the background worker is notified and transitions it.
+	if !async {
+		if err := api.transitioner.Transition(ctx, id); err != nil {
+			log.Printf("[ERR] %v", err)
+		}
+	}
+
+	p, err := api.store.Payments().Get(ctx, id)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	resp := &CreatePaymentResponse{
+		PaymentResource: *PaymentModelToResource(p),
+	}
+
+	w.Header().Set("ETag", paymentETag(p))
+	if async {
+		w.Header().Set("Location", "/payments/"+id)
+		render.Status(r, http.StatusAccepted)
+	} else {
+		render.Status(r, http.StatusCreated)
+	}
+	render.JSON(w, r, resp)
+	return
+}
+
+// isAsync decides whether the payment is created asynchronously:
+// as requested, or according to the merchant settings by default.
+func (api *Api) isAsync(ctx context.Context, merchantId string, request *CreatePaymentRequest) (bool, error) {
+	if request.Async != nil {
+		return *request.Async, nil
+	}
+	if merchantId == "" {
+		return false, nil
+	}
+
+	m, err := api.store.Merchants().Get(ctx, merchantId)
+	switch {
+	case err == store.ErrNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return m.AsyncPayments, nil
+}
 
+// GetPayment returns the payment. With the wait_for_change parameter set to a payment version,
+// the request blocks until the payment version changes or the timeout (30s by default) expires,
+// and then returns the payment in its current state. If the payment matches the If-None-Match header,
+// 304 Not Modified is returned without the payment.
+func (api *Api) GetPayment(w http.ResponseWriter, r *http.Request) {
+	paymentId := chi.URLParam(r, "paymentId")
 	ctx := r.Context()
 
-	err := api.store.Tx(ctx, func(ctx context.Context) error {
-		id, err := api.store.Payments().Create(ctx, paymentModel)
-		if err != nil {
-			return err
+	getPayment := func() (*models.Payment, error) {
+		p, err := api.store.Payments().Get(ctx, paymentId)
+		if err == store.ErrNotFound {
+			e := fmt.Errorf("no payment found")
+			return nil, &Error{Err: e, Code: http.StatusNotFound, Msg: e.Error()}
 		}
+		return p, err
+	}
 
-		if err := api.transitioner.Transition(ctx, id); err != nil {
-			log.Printf("[ERR] %v", err)
+	version := r.URL.Query().Get("wait_for_change")
+	timeout := defaultWaitTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxWaitTimeout {
+			e := fmt.Errorf("timeout must be a duration up to %s", maxWaitTimeout)
+			renderApiError(w, r, e, http.StatusBadRequest, e.Error())
+			return
 		}
+		timeout = d
+	}
 
-		p, err := api.store.Payments().Get(ctx, id)
-		if err != nil {
-			return err
+	var (
+		p   *models.Payment
+		err error
+	)
+	if version == "" {
+		p, err = getPayment()
+	} else {
+		// Watch before reading the payment, so that a change committed in between is not missed.
+		changed, stop := api.store.Payments().Watch(paymentId)
+		defer stop()
+		p, err = api.waitForChange(ctx, version, timeout, changed, getPayment)
+	}
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	etag := paymentETag(p)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, PaymentModelToResource(p))
+	return
+}
+
+// paymentETag returns the entity tag of the payment, which changes with every update.
+func paymentETag(p *models.Payment) string {
+	return strconv.Quote(paymentVersion(p))
+}
+
+// ifMatch returns the payment version required by the If-Match header, if the request is conditional.
+func ifMatch(r *http.Request) (int64, bool, error) {
+	v := strings.TrimSpace(r.Header.Get("If-Match"))
+	if v == "" || v == "*" {
+		return 0, false, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+	if err != nil || !strings.HasPrefix(v, `"`) || !strings.HasSuffix(v, `"`) {
+		e := fmt.Errorf("invalid If-Match: %s", v)
+		return 0, false, &Error{Err: e, Code: http.StatusBadRequest, Msg: "If-Match must be a single payment ETag"}
+	}
+	return version, true, nil
+}
+
+// waitForChange reads the payment until its version differs from the given one or the timeout expires.
+// The payment is read again when it is changed by this instance, and regularly to observe changes
+// made by other gateway instances.
+func (api *Api) waitForChange(ctx context.Context, version string, timeout time.Duration, changed <-chan struct{}, getPayment func() (*models.Payment, error)) (*models.Payment, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		p, err := getPayment()
+		if err != nil || paymentVersion(p) != version {
+			return p, err
 		}
 
-		resp := &CreatePaymentResponse{
-			PaymentResource: *PaymentModelToResource(p),
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			return p, nil
+		case <-api.shutdown:
+			return p, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+	}
+}
 
-		render.Status(r, http.StatusCreated)
-		render.JSON(w, r, resp)
+func (api *Api) ListDisputes(w http.ResponseWriter, r *http.Request) {
+	ds, err := api.store.Disputes().List(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	resp := &ListDisputesResponse{Disputes: make([]*DisputeResource, 0, len(ds))}
+	for _, d := range ds {
+		resp.Disputes = append(resp.Disputes, DisputeModelToResource(d))
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, resp)
+	return
+}
+
+func (api *Api) GetDispute(w http.ResponseWriter, r *http.Request) {
+	disputeId := chi.URLParam(r, "disputeId")
+	d, err := api.store.Disputes().Get(r.Context(), disputeId)
+	switch {
+	case err == store.ErrNotFound:
+		e := fmt.Errorf("no dispute found")
+		renderApiError(w, r, e, http.StatusNotFound, e.Error())
+		return
+	case err != nil:
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, DisputeModelToResource(d))
+	return
+}
+
+func (api *Api) SubmitDisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	var request SubmitDisputeEvidenceRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		renderApiError(w, r, err, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if err := request.Validate(); err != nil {
+		renderApiError(w, r, err, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	disputeId := chi.URLParam(r, "disputeId")
+	ctx := r.Context()
+
+	err := api.store.Disputes().Update(ctx, disputeId, func(d *models.Dispute) error {
+		if d.State != models.DisputeStateNeedsResponse || d.Evidence != "" {
+			e := fmt.Errorf("dispute is in %s", d.State)
+			return &Error{Err: e, Code: http.StatusConflict, Msg: "dispute does not accept evidence"}
+		}
+		if d.EvidenceDueBy.Before(time.Now()) {
+			e := fmt.Errorf("evidence is overdue")
+			return &Error{Err: e, Code: http.StatusConflict, Msg: "evidence deadline has passed"}
+		}
+		d.Evidence = request.Evidence
 		return nil
 	})
+	switch {
+	case err == store.ErrNotFound:
+		e := fmt.Errorf("no dispute found")
+		renderError(w, r, &Error{Err: e, Code: http.StatusNotFound, Msg: e.Error()})
+		return
+	case err != nil:
+		renderError(w, r, err)
+		return
+	}
+
+	if err := api.transitioner.TransitionDispute(ctx, disputeId); err != nil {
+		// Withdraw the evidence the acquirer has not accepted, so that it can be submitted again.
+		errW := api.store.Disputes().Update(ctx, disputeId, func(d *models.Dispute) error {
+			if d.State == models.DisputeStateNeedsResponse && d.Evidence == request.Evidence {
+				d.Evidence = ""
+			}
+			return nil
+		})
+		if errW != nil {
+			log.Printf("[ERR] could not withdraw evidence of dispute %s: %v", disputeId, errW)
+		}
+		renderError(w, r, err)
+		return
+	}
+
+	d, err := api.store.Disputes().Get(ctx, disputeId)
 	if err != nil {
 		renderError(w, r, err)
 		return
 	}
 
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, DisputeModelToResource(d))
 	return
 }
 
-func (api *Api) GetPayment(w http.ResponseWriter, r *http.Request) {
+func (api *Api) GetSettlementReconciliation(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	batches, err := api.store.Settlements().ListBatches(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	lines, err := api.store.Settlements().ListUnmatchedLines(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	missing, err := api.store.Settlements().ListMissing(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, SettlementReconciliationToResource(batches, lines, missing))
+	return
+}
+
+func (api *Api) ReconcileStates(w http.ResponseWriter, r *http.Request) {
+	var request ReconcileStatesRequest
+	if r.ContentLength != 0 {
+		if err := render.DecodeJSON(r.Body, &request); err != nil {
+			renderApiError(w, r, err, http.StatusBadRequest, "invalid request")
+			return
+		}
+	}
+
+	report, err := api.drift.Reconcile(r.Context(), request.Repair)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, DriftReportToResource(report))
+	return
+}
+
+func (api *Api) ListDiscrepancies(w http.ResponseWriter, r *http.Request) {
+	status := models.DiscrepancyStatus(r.URL.Query().Get("status"))
+	if status == "" {
+		status = models.DiscrepancyStatusManualReview
+	}
+
+	ds, err := api.store.Discrepancies().List(r.Context(), status)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	resp := &ListDiscrepanciesResponse{Discrepancies: make([]*DiscrepancyResource, 0, len(ds))}
+	for _, d := range ds {
+		resp.Discrepancies = append(resp.Discrepancies, DiscrepancyModelToResource(d))
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, resp)
+	return
+}
+
+func (api *Api) ListDeadLetterPayments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	payments, err := api.store.Payments().ListDeadLetter(ctx)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	resp := &ListDeadLetterPaymentsResponse{Payments: make([]*DeadLetterPaymentResource, 0, len(payments))}
+	for _, p := range payments {
+		resp.Payments = append(resp.Payments, PaymentModelToDeadLetterResource(p))
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, resp)
+	return
+}
+
+func (api *Api) RetryPayment(w http.ResponseWriter, r *http.Request) {
 	paymentId := chi.URLParam(r, "paymentId")
-	p, err := api.store.Payments().Get(r.Context(), paymentId)
+	ctx := r.Context()
+
+	version, conditional, err := ifMatch(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	var opts []store.UpdateOption
+	if conditional {
+		opts = append(opts, store.IfVersion(version))
+	}
+
+	var p *models.Payment
+	err = api.store.Tx(ctx, func(ctx context.Context) error {
+		err := api.store.Payments().Update(ctx, paymentId, func(py *models.Payment) error {
+			if py.State != models.PaymentStateNeedsAttention {
+				e := fmt.Errorf("payment is in %s", py.State)
+				return &Error{Err: e, Code: http.StatusConflict, Msg: "payment does not need attention"}
+			}
+
+			// Restore the state implied by the acquirer and requeue the payment right away.
+			if err := py.SyncState(); err != nil {
+				return &Error{Err: err, Code: http.StatusConflict, Msg: err.Error()}
+			}
+			py.Attempts = 0
+			py.LastError = ""
+			now := time.Now().UTC()
+			py.NextAttemptAt = &now
+			return nil
+		}, opts...)
+		var conflict *store.ConflictError
+		switch {
+		case err == store.ErrNotFound:
+			e := fmt.Errorf("no payment found")
+			return &Error{Err: e, Code: http.StatusNotFound, Msg: e.Error()}
+		case errors.As(err, &conflict) && conditional:
+			return &Error{Err: err, Code: http.StatusPreconditionFailed, Msg: "payment has changed"}
+		case errors.As(err, &conflict):
+			return &Error{Err: err, Code: http.StatusConflict, Msg: "payment has changed concurrently, try again"}
+		case err != nil:
+			return err
+		}
+
+		p, err = api.store.Payments().Get(ctx, paymentId)
+		return err
+	})
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", paymentETag(p))
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, PaymentModelToDeadLetterResource(p))
+	return
+}
+
+func (api *Api) GetMerchant(w http.ResponseWriter, r *http.Request) {
+	merchantId := chi.URLParam(r, "merchantId")
+	m, err := api.store.Merchants().Get(r.Context(), merchantId)
 	switch {
-	case err == pgx.ErrNoRows:
-		e := fmt.Errorf("no payment found")
-		renderApiError(w, r, e, http.StatusNotFound, e.Error())
+	case err == store.ErrNotFound:
+		renderApiError(w, r, err, http.StatusNotFound, "no merchant found")
 		return
 	case err != nil:
 		renderError(w, r, err)
@@ -122,6 +624,154 @@ func (api *Api) GetPayment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	render.Status(r, http.StatusOK)
-	render.JSON(w, r, PaymentModelToResource(p))
+	render.JSON(w, r, MerchantModelToResource(m))
 	return
 }
+
+func (api *Api) UpdateMerchant(w http.ResponseWriter, r *http.Request) {
+	var request UpdateMerchantRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		renderApiError(w, r, err, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	m := &models.Merchant{
+		Id:            chi.URLParam(r, "merchantId"),
+		AsyncPayments: request.AsyncPayments,
+	}
+	if err := api.store.Merchants().Save(r.Context(), m); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, MerchantModelToResource(m))
+	return
+}
+
+func (api *Api) ListRiskRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := api.store.RiskRules().List(r.Context())
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	resp := &ListRiskRulesResponse{Rules: make([]*RiskRuleResource, 0, len(rules))}
+	for _, rule := range rules {
+		resp.Rules = append(resp.Rules, RiskRuleModelToResource(rule))
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, resp)
+	return
+}
+
+func (api *Api) CreateRiskRule(w http.ResponseWriter, r *http.Request) {
+	api.saveRiskRule(w, r, uuid.NewString(), nil, http.StatusCreated)
+}
+
+func (api *Api) UpdateRiskRule(w http.ResponseWriter, r *http.Request) {
+	ruleId := chi.URLParam(r, "ruleId")
+	existing, err := api.store.RiskRules().Get(r.Context(), ruleId)
+	if err != nil {
+		if err == store.ErrNotFound {
+			renderApiError(w, r, err, http.StatusNotFound, "no risk rule found")
+			return
+		}
+		renderError(w, r, err)
+		return
+	}
+	api.saveRiskRule(w, r, ruleId, existing, http.StatusOK)
+}
+
+// saveRiskRule creates or replaces the existing risk rule of the given ID with the one in the request.
+func (api *Api) saveRiskRule(w http.ResponseWriter, r *http.Request, id string, existing *models.RiskRule, status int) {
+	var request RiskRuleRequest
+	if err := render.DecodeJSON(r.Body, &request); err != nil {
+		renderApiError(w, r, err, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	if err := request.Validate(); err != nil {
+		renderApiError(w, r, err, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rule := RiskRuleRequestToModel(id, &request, existing, api.fingerprintKey)
+	if rule.Kind == models.RiskRuleCardBlocklist && len(rule.Params.Fingerprints) == 0 {
+		renderApiError(w, r, errors.New("empty blocklist"), http.StatusBadRequest, "card blocklist must block at least one card")
+		return
+	}
+	if err := api.store.RiskRules().Save(r.Context(), rule); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, status)
+	render.JSON(w, r, RiskRuleModelToResource(rule))
+	return
+}
+
+func (api *Api) GetRiskRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := api.store.RiskRules().Get(r.Context(), chi.URLParam(r, "ruleId"))
+	switch {
+	case err == store.ErrNotFound:
+		renderApiError(w, r, err, http.StatusNotFound, "no risk rule found")
+		return
+	case err != nil:
+		renderError(w, r, err)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, RiskRuleModelToResource(rule))
+	return
+}
+
+func (api *Api) DeleteRiskRule(w http.ResponseWriter, r *http.Request) {
+	err := api.store.RiskRules().Delete(r.Context(), chi.URLParam(r, "ruleId"))
+	switch {
+	case err == store.ErrNotFound:
+		renderApiError(w, r, err, http.StatusNotFound, "no risk rule found")
+		return
+	case err != nil:
+		renderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clientIp returns the IP address of the client that has sent the request.
+// If the request comes from a trusted proxy, it is the rightmost address of X-Forwarded-For that is not a trusted proxy,
+// since the addresses to the left of it may be forged by the client.
+func (api *Api) clientIp(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && api.isTrustedProxy(ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop.String()
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether the IP address belongs to a trusted proxy.
+func (api *Api) isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range api.trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,429 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/acquiring/simulator"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"mkuznets.com/go/upsp/gateway/transitioner"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testFingerprintKey is the key of the card fingerprints of the test API.
+var testFingerprintKey = []byte("secret")
+
+func newTestApi() (*Api, store.Store) {
+	s := store.NewMemory()
+	router, err := routing.New(routing.WithAcquirer("simulator", simulator.New(acquirer.New(acquirer.NewStore()))))
+	if err != nil {
+		panic(err)
+	}
+	return New(s, router, transitioner.New(s, router), WithFingerprintKey(testFingerprintKey)), s
+}
+
+func serve(api *Api, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, r)
+	return w
+}
+
+func paymentRequest(cardNumber string, extra string) string {
+	return `{"amount": 10, "currency": "EUR", "card_number": "` + cardNumber + `", "card_holder": "Jane Doe", "cvv": "123", "expiry_date": "0130"` + extra + `}`
+}
+
+func decodePayment(t *testing.T, w *httptest.ResponseRecorder) *PaymentResource {
+	var p PaymentResource
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&p))
+	return &p
+}
+
+func TestApi_CreatePayment(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		api, _ := newTestApi()
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.NotEmpty(t, w.Header().Get("ETag"))
+
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+		assert.Equal(t, "************4242", p.CardNumber)
+		assert.Equal(t, "***", p.Cvv)
+		assert.Equal(t, "0.10 EUR", p.DisplayAmount)
+	})
+
+	t.Run("async", func(t *testing.T) {
+		api, _ := newTestApi()
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", `, "async": true`), nil)
+		require.Equal(t, http.StatusAccepted, w.Code)
+
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateProcessing, p.State)
+		assert.Equal(t, "/payments/"+p.Id, w.Header().Get("Location"))
+	})
+
+	t.Run("merchant default", func(t *testing.T) {
+		api, s := newTestApi()
+		require.NoError(t, s.Merchants().Save(context.Background(), &models.Merchant{Id: "m1", AsyncPayments: true}))
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), map[string]string{merchantIdHeader: "m1"})
+		require.Equal(t, http.StatusAccepted, w.Code)
+		assert.Equal(t, "m1", decodePayment(t, w).MerchantId)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		api, _ := newTestApi()
+
+		w := serve(api, http.MethodPost, "/payments", `{"amount": -10, "currency": "EUR"}`, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("card brands", func(t *testing.T) {
+		api, _ := newTestApi()
+		request := func(cardNumber, cvv string) string {
+			return `{"amount": 10, "currency": "EUR", "card_number": "` + cardNumber + `", "card_holder": "Jane Doe", "cvv": "` + cvv + `", "expiry_date": "0130"}`
+		}
+
+		w := serve(api, http.MethodPost, "/payments", request("378282246310005", "1234"), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+		assert.Equal(t, "***********0005", p.CardNumber)
+		assert.Equal(t, cards.BrandAmex, p.Brand)
+		assert.Equal(t, "0005", p.Last4)
+		assert.Equal(t, "378282", p.Bin)
+
+		w = serve(api, http.MethodPost, "/payments", request("6205500000000000004", "123"), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, cards.BrandUnionPay, decodePayment(t, w).Brand)
+
+		w = serve(api, http.MethodPost, "/payments", request("378282246310005", "123"), nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "amex requires a 4-digit CVV")
+	})
+
+	t.Run("currency limits", func(t *testing.T) {
+		api, _ := newTestApi()
+		request := func(amount, currency string) string {
+			return `{"amount": ` + amount + `, "currency": "` + currency + `", "card_number": "4242424242424242", "card_holder": "Jane Doe", "cvv": "123", "expiry_date": "0130"}`
+		}
+
+		w := serve(api, http.MethodPost, "/payments", request("100000000", "EUR"), nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve(api, http.MethodPost, "/payments", request("100000000", "KWD"), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "100000.000 KWD", decodePayment(t, w).DisplayAmount)
+
+		w = serve(api, http.MethodPost, "/payments", request("1050", "JPY"), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "1050 JPY", decodePayment(t, w).DisplayAmount)
+	})
+}
+
+func TestApi_GetPayment(t *testing.T) {
+	api, _ := newTestApi()
+
+	w := serve(api, http.MethodPost, "/payments", paymentRequest("4000000000003220", ""), nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	created := decodePayment(t, w)
+	etag := w.Header().Get("ETag")
+
+	w = serve(api, http.MethodGet, "/payments/"+created.Id, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	p := decodePayment(t, w)
+	assert.Equal(t, models.PaymentStateActionRequired, p.State)
+	assert.Equal(t, created.Version, p.Version)
+
+	w = serve(api, http.MethodGet, "/payments/"+created.Id, "", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = serve(api, http.MethodGet, "/payments/"+created.Id+"?wait_for_change="+created.Version+"&timeout=10ms", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, created.Version, decodePayment(t, w).Version, "payment has not changed")
+
+	w = serve(api, http.MethodGet, "/payments/unknown", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serve(api, http.MethodGet, "/payments/stream", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the merchant stream is not a payment")
+}
+
+func TestApi_RetryPayment(t *testing.T) {
+	ctx := context.Background()
+	api, s := newTestApi()
+
+	w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", `, "async": true`), nil)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	id := decodePayment(t, w).Id
+
+	w = serve(api, http.MethodPost, "/admin/payments/"+id+"/retry", "", nil)
+	assert.Equal(t, http.StatusConflict, w.Code, "payment does not need attention")
+
+	require.NoError(t, s.Payments().Update(ctx, id, func(py *models.Payment) error {
+		py.Attempts = 12
+		return py.SetState(models.PaymentStateNeedsAttention)
+	}))
+	p, err := s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+
+	w = serve(api, http.MethodGet, "/admin/payments/dead-letter", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var deadLetter ListDeadLetterPaymentsResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&deadLetter))
+	require.Len(t, deadLetter.Payments, 1)
+	assert.Equal(t, id, deadLetter.Payments[0].Id)
+	assert.Equal(t, 12, deadLetter.Payments[0].Attempts)
+
+	w = serve(api, http.MethodPost, "/admin/payments/"+id+"/retry", "", map[string]string{"If-Match": `"1"`})
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	w = serve(api, http.MethodPost, "/admin/payments/"+id+"/retry", "", map[string]string{"If-Match": "1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(api, http.MethodPost, "/admin/payments/"+id+"/retry", "", map[string]string{"If-Match": paymentETag(p)})
+	require.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, models.PaymentStateProcessing, decodePayment(t, w).State)
+
+	w = serve(api, http.MethodPost, "/admin/payments/unknown/retry", "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestApi_RetryPayment_states(t *testing.T) {
+	tests := []struct {
+		name           string
+		state          models.PaymentState
+		acquiringState acquiring.PaymentState
+		want           models.PaymentState
+	}{
+		{"not created yet", models.PaymentStateProcessing, "", models.PaymentStateProcessing},
+		{"action required", models.PaymentStateActionRequired, acquiring.PaymentStateActionRequired, models.PaymentStateActionRequired},
+		{"paid", models.PaymentStateActionPaid, acquiring.PaymentStateCaptured, models.PaymentStateActionPaid},
+		{"disputed", models.PaymentStateDisputed, acquiring.PaymentStateDisputed, models.PaymentStateDisputed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			api, s := newTestApi()
+
+			id := storetest.CreatePayment(t, s.Payments(), storetest.WithState(tt.state), func(p *models.Payment) {
+				p.AcquiringState = string(tt.acquiringState)
+			}).Id
+			require.NoError(t, s.Payments().Update(ctx, id, func(py *models.Payment) error {
+				return py.SetState(models.PaymentStateNeedsAttention)
+			}))
+
+			w := serve(api, http.MethodPost, "/admin/payments/"+id+"/retry", "", nil)
+			require.Equal(t, http.StatusAccepted, w.Code)
+			assert.Equal(t, tt.want, decodePayment(t, w).State)
+
+			p, err := s.Payments().Get(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, p.State)
+			assert.Equal(t, 0, p.Attempts)
+		})
+	}
+}
+
+func decodeRiskRule(t *testing.T, w *httptest.ResponseRecorder) *RiskRuleResource {
+	var rule RiskRuleResource
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&rule))
+	return &rule
+}
+
+func TestApi_RiskRules(t *testing.T) {
+	api, s := newTestApi()
+
+	w := serve(api, http.MethodPost, "/admin/risk/rules",
+		`{"kind": "bin_country", "action": "block", "score": 80, "params": {"countries": ["FR"]}}`, nil)
+	require.Equal(t, http.StatusCreated, w.Code)
+	rule := decodeRiskRule(t, w)
+	assert.NotEmpty(t, rule.Id)
+	assert.True(t, rule.Enabled, "rules are enabled by default")
+	assert.Equal(t, []string{"FR"}, rule.Params.Countries)
+
+	w = serve(api, http.MethodPut, "/admin/risk/rules/"+rule.Id,
+		`{"kind": "card_blocklist", "action": "review", "enabled": false, "card_numbers": ["4242424242424242"]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	updated := decodeRiskRule(t, w)
+	assert.Equal(t, models.RiskDecisionReview, updated.Action)
+	assert.False(t, updated.Enabled)
+	assert.Empty(t, updated.Params.Fingerprints, "fingerprints must not be returned")
+	assert.Equal(t, 1, updated.FingerprintCount)
+	assert.Equal(t, rule.CreatedAt, updated.CreatedAt)
+
+	stored, err := s.RiskRules().Get(context.Background(), rule.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{cards.Fingerprint(testFingerprintKey, "4242424242424242")}, stored.Params.Fingerprints)
+
+	w = serve(api, http.MethodPut, "/admin/risk/rules/"+rule.Id,
+		`{"kind": "card_blocklist", "action": "block", "card_numbers": ["4000002500000003", "4242424242424242"]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, decodeRiskRule(t, w).FingerprintCount, "the blocklist must be kept and each card blocked once")
+
+	w = serve(api, http.MethodPut, "/admin/risk/rules/"+rule.Id,
+		`{"kind": "card_blocklist", "action": "block", "remove_card_numbers": ["4242424242424242"]}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, decodeRiskRule(t, w).FingerprintCount)
+
+	w = serve(api, http.MethodPut, "/admin/risk/rules/"+rule.Id,
+		`{"kind": "card_blocklist", "action": "block", "remove_card_numbers": ["4000002500000003"]}`, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the blocklist must not become empty")
+
+	w = serve(api, http.MethodGet, "/admin/risk/rules/"+rule.Id, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, models.RiskRuleCardBlocklist, decodeRiskRule(t, w).Kind)
+
+	w = serve(api, http.MethodGet, "/admin/risk/rules", "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list ListRiskRulesResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+	assert.Len(t, list.Rules, 1)
+
+	w = serve(api, http.MethodDelete, "/admin/risk/rules/"+rule.Id, "", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = serve(api, http.MethodGet, "/admin/risk/rules/"+rule.Id, "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serve(api, http.MethodPut, "/admin/risk/rules/"+rule.Id, `{"kind": "amount", "action": "block", "params": {"currency": "EUR"}}`, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	invalid := map[string]string{
+		"unknown kind":           `{"kind": "geo", "action": "block"}`,
+		"allow action":           `{"kind": "amount", "action": "allow", "params": {"currency": "EUR"}}`,
+		"score too high":         `{"kind": "amount", "action": "block", "score": 101, "params": {"currency": "EUR"}}`,
+		"no velocity key":        `{"kind": "velocity", "action": "block", "params": {"max_count": 3, "window_seconds": 60}}`,
+		"no amount currency":     `{"kind": "amount", "action": "block", "params": {"min_amount": 100}}`,
+		"invalid country":        `{"kind": "bin_country", "action": "block", "params": {"countries": ["France"]}}`,
+		"invalid fingerprint":    `{"kind": "card_blocklist", "action": "block", "params": {"fingerprints": ["abc"]}}`,
+		"card numbers of amount": `{"kind": "amount", "action": "block", "params": {"currency": "EUR"}, "card_numbers": ["4242424242424242"]}`,
+		"removed card of amount": `{"kind": "amount", "action": "block", "params": {"currency": "EUR"}, "remove_card_numbers": ["4242424242424242"]}`,
+		"empty blocklist":        `{"kind": "card_blocklist", "action": "block"}`,
+	}
+	for name, body := range invalid {
+		w = serve(api, http.MethodPost, "/admin/risk/rules", body, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+	}
+}
+
+func TestApi_CreatePayment_risk(t *testing.T) {
+	createRule := func(t *testing.T, api *Api, body string) {
+		w := serve(api, http.MethodPost, "/admin/risk/rules", body, nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	t.Run("block", func(t *testing.T) {
+		api, _ := newTestApi()
+		createRule(t, api, `{"kind": "card_blocklist", "action": "block", "score": 90, "card_numbers": ["4242424242424242"]}`)
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateRejected, p.State)
+		assert.Equal(t, models.RiskDecisionBlock, p.RiskDecision)
+		assert.Equal(t, 90, p.RiskScore)
+
+		w = serve(api, http.MethodPost, "/payments", paymentRequest("5555555555554444", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		p = decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+		assert.Equal(t, models.RiskDecisionAllow, p.RiskDecision)
+	})
+
+	t.Run("review", func(t *testing.T) {
+		ctx := context.Background()
+		api, _ := newTestApi()
+		createRule(t, api, `{"kind": "amount", "action": "review", "params": {"currency": "EUR", "min_amount": 10}}`)
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateNeedsAttention, p.State)
+
+		// Retrying the payment approves it.
+		w = serve(api, http.MethodPost, "/admin/payments/"+p.Id+"/retry", "", nil)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		require.NoError(t, api.transitioner.Transition(ctx, p.Id))
+
+		w = serve(api, http.MethodGet, "/payments/"+p.Id, "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, models.PaymentStateActionPaid, decodePayment(t, w).State)
+	})
+
+	t.Run("force 3ds", func(t *testing.T) {
+		api, _ := newTestApi()
+		createRule(t, api, `{"kind": "bin_country", "action": "force_3ds", "params": {"countries": ["US"]}}`)
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		p := decodePayment(t, w)
+		assert.Equal(t, models.PaymentStateActionRequired, p.State)
+		assert.Equal(t, models.RiskDecisionForce3ds, p.RiskDecision)
+	})
+
+	t.Run("velocity", func(t *testing.T) {
+		api, _ := newTestApi()
+		createRule(t, api, `{"kind": "velocity", "action": "block", "params": {"key": "ip", "max_count": 1, "window_seconds": 3600}}`)
+
+		w := serve(api, http.MethodPost, "/payments", paymentRequest("4242424242424242", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, models.PaymentStateActionPaid, decodePayment(t, w).State)
+
+		w = serve(api, http.MethodPost, "/payments", paymentRequest("5555555555554444", ""), nil)
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, models.PaymentStateRejected, decodePayment(t, w).State, "second payment from the same IP must be blocked")
+	})
+}
+
+func TestApi_clientIp(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	api := &Api{trustedProxies: []*net.IPNet{proxies}}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"proxy chain", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"forged by client", "10.0.0.1:1234", []string{"203.0.113.1, 198.51.100.1"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"203.0.113.1", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"invalid hop", "10.0.0.1:1234", []string{"198.51.100.1, unknown"}, "10.0.0.1"},
+		{"ipv6", "[2001:db8::1]:1234", nil, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/payments", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tt.want, api.clientIp(r))
+		})
+	}
+}
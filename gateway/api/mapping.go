@@ -1,24 +1,226 @@
 package api
 
 import (
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/drift"
 	"mkuznets.com/go/upsp/gateway/models"
+	"strconv"
 	"strings"
 )
 
+// paymentVersion returns the version of the payment, which changes with every update.
+func paymentVersion(p *models.Payment) string {
+	return strconv.FormatInt(p.Version, 10)
+}
+
 func PaymentModelToResource(p *models.Payment) *PaymentResource {
 	return &PaymentResource{
-		Id:    p.Id,
-		State: p.State,
+		Id:         p.Id,
+		MerchantId: p.MerchantId,
+		State:      p.State,
+		Version:    paymentVersion(p),
 
-		Amount:   p.Amount,
-		Currency: p.Currency,
+		DeclineCode:  p.DeclineCode,
+		RiskScore:    p.RiskScore,
+		RiskDecision: p.RiskDecision,
 
-		CardNumber: strings.Repeat("*", len(p.CardNumber)-4) + p.CardNumber[len(p.CardNumber)-4:],
+		Money:         p.Money,
+		DisplayAmount: p.Display(),
+
+		CardNumber: cards.Mask(p.CardNumber),
 		ExpiryDate: p.ExpiryDate,
 		CardHolder: p.CardHolder,
 		Cvv:        strings.Repeat("*", len(p.Cvv)),
+		Brand:      cards.BrandOf(p.CardNumber),
+		Last4:      cards.Last4(p.CardNumber),
+		Bin:        cards.Bin(p.CardNumber),
 
 		CreatedAt: p.CreatedAt,
 		UpdatedAt: p.UpdatedAt,
 	}
 }
+
+func PaymentModelToDeadLetterResource(p *models.Payment) *DeadLetterPaymentResource {
+	return &DeadLetterPaymentResource{
+		PaymentResource: *PaymentModelToResource(p),
+
+		Acquirer:       p.Acquirer,
+		AcquiringId:    p.AcquiringId,
+		AcquiringState: p.AcquiringState,
+
+		Attempts:      p.Attempts,
+		LastError:     p.LastError,
+		NextAttemptAt: p.NextAttemptAt,
+	}
+}
+
+func PaymentEventModelToResource(e *models.PaymentEvent) *PaymentEventResource {
+	return &PaymentEventResource{
+		PaymentId:  e.PaymentId,
+		MerchantId: e.MerchantId,
+		State:      e.State,
+		CreatedAt:  e.CreatedAt,
+	}
+}
+
+func MerchantModelToResource(m *models.Merchant) *MerchantResource {
+	return &MerchantResource{
+		Id:            m.Id,
+		AsyncPayments: m.AsyncPayments,
+
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+	}
+}
+
+// RiskRuleRequestToModel builds the risk rule of the given ID from the request.
+// The card numbers of the request are added to the blocklist as fingerprints keyed with the given key.
+// The blocklist of the existing rule, if any, is kept: the fingerprints are not returned by the API,
+// so the cards of a blocklist can only be added or removed.
+func RiskRuleRequestToModel(id string, r *RiskRuleRequest, existing *models.RiskRule, key []byte) *models.RiskRule {
+	rule := &models.RiskRule{
+		Id:      id,
+		Kind:    r.Kind,
+		Action:  r.Action,
+		Score:   r.Score,
+		Enabled: r.Enabled == nil || *r.Enabled,
+		Params:  r.Params,
+	}
+	if rule.Kind != models.RiskRuleCardBlocklist {
+		return rule
+	}
+
+	var fingerprints []string
+	if existing != nil && existing.Kind == models.RiskRuleCardBlocklist {
+		fingerprints = append(fingerprints, existing.Params.Fingerprints...)
+	}
+	fingerprints = append(fingerprints, r.Params.Fingerprints...)
+	for _, number := range r.CardNumbers {
+		fingerprints = append(fingerprints, cards.Fingerprint(key, number))
+	}
+
+	// skip holds the removed fingerprints and the ones already added, so that each card is blocked once.
+	skip := make(map[string]bool)
+	for _, number := range r.RemoveCardNumbers {
+		skip[cards.Fingerprint(key, number)] = true
+	}
+	rule.Params.Fingerprints = nil
+	for _, fingerprint := range fingerprints {
+		if !skip[fingerprint] {
+			skip[fingerprint] = true
+			rule.Params.Fingerprints = append(rule.Params.Fingerprints, fingerprint)
+		}
+	}
+	return rule
+}
+
+// RiskRuleModelToResource returns the risk rule with the number of blocked cards in place of their fingerprints.
+func RiskRuleModelToResource(rule *models.RiskRule) *RiskRuleResource {
+	resource := &RiskRuleResource{
+		Id:      rule.Id,
+		Kind:    rule.Kind,
+		Action:  rule.Action,
+		Score:   rule.Score,
+		Enabled: rule.Enabled,
+		Params:  rule.Params,
+
+		FingerprintCount: len(rule.Params.Fingerprints),
+
+		CreatedAt: rule.CreatedAt,
+		UpdatedAt: rule.UpdatedAt,
+	}
+	resource.Params.Fingerprints = nil
+	return resource
+}
+
+func DisputeModelToResource(d *models.Dispute) *DisputeResource {
+	return &DisputeResource{
+		Id:        d.Id,
+		PaymentId: d.PaymentId,
+		State:     d.State,
+		Reason:    d.Reason,
+
+		Amount:   d.Amount,
+		Currency: d.Currency,
+
+		Evidence:      d.Evidence,
+		EvidenceDueBy: d.EvidenceDueBy,
+
+		CreatedAt: d.CreatedAt,
+		UpdatedAt: d.UpdatedAt,
+	}
+}
+
+func SettlementReconciliationToResource(batches []*models.SettlementBatch, lines []*models.SettlementLine, missing []*models.MissingSettlement) *SettlementReconciliationResource {
+	res := &SettlementReconciliationResource{
+		Batches:    make([]*SettlementBatchResource, 0, len(batches)),
+		Exceptions: make([]*SettlementExceptionResource, 0, len(lines)),
+		Missing:    make([]*MissingSettlementResource, 0, len(missing)),
+	}
+
+	for _, b := range batches {
+		res.Batches = append(res.Batches, &SettlementBatchResource{
+			Id:         b.Id,
+			Date:       b.Date,
+			Currency:   b.Currency,
+			CutoffAt:   b.CutoffAt,
+			Gross:      b.Gross,
+			Fees:       b.Fees,
+			Net:        b.Net,
+			Lines:      b.LineCount,
+			Matched:    b.MatchedCount,
+			IngestedAt: b.IngestedAt,
+		})
+	}
+	for _, l := range lines {
+		res.Exceptions = append(res.Exceptions, &SettlementExceptionResource{
+			BatchId:     l.BatchId,
+			AcquiringId: l.AcquiringId,
+			PaymentId:   l.PaymentId,
+			Type:        l.Type,
+			Currency:    l.Currency,
+			Amount:      l.Amount,
+			Status:      l.Status,
+		})
+	}
+	for _, m := range missing {
+		res.Missing = append(res.Missing, &MissingSettlementResource{
+			PaymentId:  m.PaymentId,
+			Type:       m.Type,
+			Currency:   m.Currency,
+			Amount:     m.Amount,
+			DetectedAt: m.DetectedAt,
+		})
+	}
+
+	return res
+}
+
+func DiscrepancyModelToResource(d *models.Discrepancy) *DiscrepancyResource {
+	return &DiscrepancyResource{
+		PaymentId: d.PaymentId,
+		Kind:      d.Kind,
+		Status:    d.Status,
+		Details:   d.Details,
+
+		State:            d.State,
+		AcquiringId:      d.AcquiringId,
+		AcquiringState:   d.AcquiringState,
+		AcquiringVersion: d.AcquiringVersion,
+		AcquirerState:    d.AcquirerState,
+		AcquirerVersion:  d.AcquirerVersion,
+
+		DetectedAt: d.DetectedAt,
+	}
+}
+
+func DriftReportToResource(report *drift.Report) *ReconcileStatesResponse {
+	resp := &ReconcileStatesResponse{
+		Checked:       report.Checked,
+		Discrepancies: make([]*DiscrepancyResource, 0, len(report.Discrepancies)),
+	}
+	for _, d := range report.Discrepancies {
+		resp.Discrepancies = append(resp.Discrepancies, DiscrepancyModelToResource(d))
+	}
+	return resp
+}
@@ -1,21 +1,27 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	validation "github.com/go-ozzo/ozzo-validation"
 	"github.com/go-ozzo/ozzo-validation/is"
+	"mkuznets.com/go/upsp/gateway/cards"
 	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/risk"
+	"mkuznets.com/go/upsp/money"
 	"time"
 )
 
 type CreatePaymentRequest struct {
-	Amount   int64  `json:"amount"`
-	Currency string `json:"currency"`
+	money.Money
 
 	CardNumber string `json:"card_number"`
 	ExpiryDate string `json:"expiry_date"`
 	CardHolder string `json:"card_holder"`
 	Cvv        string `json:"cvv"`
+
+	// Async overrides the merchant default of whether the payment is created asynchronously.
+	Async *bool `json:"async"`
 }
 
 func isExpiryDate(value interface{}) error {
@@ -29,15 +35,26 @@ func isExpiryDate(value interface{}) error {
 	return nil
 }
 
+func isCardNumber(value interface{}) error {
+	return cards.ValidateNumber(value.(string))
+}
+
+// isCvvOf validates the CVV length required by the brand of the card.
+func isCvvOf(cardNumber string) validation.RuleFunc {
+	return func(value interface{}) error {
+		return cards.ValidateCvv(cardNumber, value.(string))
+	}
+}
+
 func (r *CreatePaymentRequest) Validate() error {
 	return validation.ValidateStruct(
 		r,
-		validation.Field(&r.Amount, validation.Required, validation.Min(1), validation.Max(99999999)),
+		validation.Field(&r.Amount, validation.Required, validation.Min(1), validation.Max(money.MaxAmount(r.Currency))),
 		validation.Field(&r.Currency, validation.Required, is.CurrencyCode),
-		validation.Field(&r.CardNumber, validation.Required, validation.Length(16, 16), is.CreditCard),
+		validation.Field(&r.CardNumber, validation.Required, validation.By(isCardNumber)),
 		validation.Field(&r.ExpiryDate, validation.Required, validation.Length(4, 4), validation.By(isExpiryDate)),
 		validation.Field(&r.CardHolder, validation.Required, validation.Length(1, 999)),
-		validation.Field(&r.Cvv, validation.Required, validation.Length(3, 4)),
+		validation.Field(&r.Cvv, validation.Required, validation.By(isCvvOf(r.CardNumber))),
 	)
 }
 
@@ -46,16 +63,275 @@ type CreatePaymentResponse struct {
 }
 
 type PaymentResource struct {
-	Id    string              `json:"id"`
-	State models.PaymentState `json:"state"`
+	Id         string              `json:"id"`
+	MerchantId string              `json:"merchant_id,omitempty"`
+	State      models.PaymentState `json:"state"`
+	// Version changes with every update of the payment.
+	Version string `json:"version"`
+	// DeclineCode is the reason the acquirer has declined the payment, if it has.
+	DeclineCode string `json:"decline_code,omitempty"`
+	// RiskScore and RiskDecision are the outcome of the risk rules, empty until the risk of the payment is assessed.
+	RiskScore    int                 `json:"risk_score,omitempty"`
+	RiskDecision models.RiskDecision `json:"risk_decision,omitempty"`
 
-	Amount   int64  `json:"amount"`
-	Currency string `json:"currency"`
+	money.Money
+	// DisplayAmount is the amount formatted with the decimals of the currency, e.g. "10.50 EUR".
+	DisplayAmount string `json:"display_amount"`
 
 	CardNumber string `json:"card_number"`
 	CardHolder string `json:"card_holder"`
 	ExpiryDate string `json:"expiry_date"`
 	Cvv        string `json:"cvv"`
+	// Brand is the card brand detected from the card number, empty if unknown.
+	Brand cards.Brand `json:"brand"`
+	Last4 string      `json:"last4"`
+	Bin   string      `json:"bin"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SubmitDisputeEvidenceRequest struct {
+	Evidence string `json:"evidence"`
+}
+
+func (r *SubmitDisputeEvidenceRequest) Validate() error {
+	return validation.ValidateStruct(
+		r,
+		validation.Field(&r.Evidence, validation.Required, validation.Length(1, 9999)),
+	)
+}
+
+type ListDisputesResponse struct {
+	Disputes []*DisputeResource `json:"disputes"`
+}
+
+type DisputeResource struct {
+	Id        string              `json:"id"`
+	PaymentId string              `json:"payment_id"`
+	State     models.DisputeState `json:"state"`
+	Reason    string              `json:"reason"`
+
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+
+	Evidence      string    `json:"evidence"`
+	EvidenceDueBy time.Time `json:"evidence_due_by"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SettlementReconciliationResource struct {
+	Batches    []*SettlementBatchResource     `json:"batches"`
+	Exceptions []*SettlementExceptionResource `json:"exceptions"`
+	Missing    []*MissingSettlementResource   `json:"missing"`
+}
+
+type SettlementBatchResource struct {
+	Id       string    `json:"id"`
+	Date     string    `json:"settlement_date"`
+	Currency string    `json:"currency"`
+	CutoffAt time.Time `json:"cutoff_at"`
+
+	Gross int64 `json:"gross"`
+	Fees  int64 `json:"fees"`
+	Net   int64 `json:"net"`
+
+	Lines   int `json:"lines"`
+	Matched int `json:"matched"`
+
+	IngestedAt time.Time `json:"ingested_at"`
+}
+
+type SettlementExceptionResource struct {
+	BatchId     string                     `json:"batch_id"`
+	AcquiringId string                     `json:"acquiring_id"`
+	PaymentId   string                     `json:"payment_id,omitempty"`
+	Type        models.SettlementEntryType `json:"type"`
+	Currency    string                     `json:"currency"`
+	Amount      int64                      `json:"amount"`
+	Status      models.SettlementStatus    `json:"status"`
+}
+
+type MissingSettlementResource struct {
+	PaymentId  string                     `json:"payment_id"`
+	Type       models.SettlementEntryType `json:"type"`
+	Currency   string                     `json:"currency"`
+	Amount     int64                      `json:"amount"`
+	DetectedAt time.Time                  `json:"detected_at"`
+}
+
+type ReconcileStatesRequest struct {
+	Repair bool `json:"repair"`
+}
+
+type ReconcileStatesResponse struct {
+	Checked       int                    `json:"checked"`
+	Discrepancies []*DiscrepancyResource `json:"discrepancies"`
+}
+
+type ListDiscrepanciesResponse struct {
+	Discrepancies []*DiscrepancyResource `json:"discrepancies"`
+}
+
+type DiscrepancyResource struct {
+	PaymentId string                   `json:"payment_id"`
+	Kind      models.DiscrepancyKind   `json:"kind"`
+	Status    models.DiscrepancyStatus `json:"status"`
+	Details   string                   `json:"details"`
+
+	State            models.PaymentState `json:"state"`
+	AcquiringId      string              `json:"acquiring_id"`
+	AcquiringState   string              `json:"acquiring_state"`
+	AcquiringVersion string              `json:"acquiring_version"`
+	AcquirerState    string              `json:"acquirer_state,omitempty"`
+	AcquirerVersion  string              `json:"acquirer_version,omitempty"`
+
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type ListDeadLetterPaymentsResponse struct {
+	Payments []*DeadLetterPaymentResource `json:"payments"`
+}
+
+type DeadLetterPaymentResource struct {
+	PaymentResource
+
+	Acquirer       string `json:"acquirer"`
+	AcquiringId    string `json:"acquiring_id"`
+	AcquiringState string `json:"acquiring_state"`
+
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+}
+
+type UpdateMerchantRequest struct {
+	AsyncPayments bool `json:"async_payments"`
+}
+
+type MerchantResource struct {
+	Id            string `json:"id"`
+	AsyncPayments bool   `json:"async_payments"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type PaymentEventResource struct {
+	PaymentId  string              `json:"payment_id"`
+	MerchantId string              `json:"merchant_id,omitempty"`
+	State      models.PaymentState `json:"state"`
+	CreatedAt  time.Time           `json:"created_at"`
+}
+
+type RiskRuleRequest struct {
+	Kind    models.RiskRuleKind   `json:"kind"`
+	Action  models.RiskDecision   `json:"action"`
+	Score   int                   `json:"score"`
+	Enabled *bool                 `json:"enabled"`
+	Params  models.RiskRuleParams `json:"params"`
+	// CardNumbers are added to the fingerprints of a card blocklist rule. Only the fingerprints are stored.
+	CardNumbers []string `json:"card_numbers"`
+	// RemoveCardNumbers are removed from the blocklist of the card blocklist rule being replaced.
+	RemoveCardNumbers []string `json:"remove_card_numbers"`
+}
+
+func isRiskRuleKind(value interface{}) error {
+	for _, kind := range models.RiskRuleKinds() {
+		if value.(models.RiskRuleKind) == kind {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %v", models.RiskRuleKinds())
+}
+
+func isRiskAction(value interface{}) error {
+	for _, action := range models.RiskActions() {
+		if value.(models.RiskDecision) == action {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %v", models.RiskActions())
+}
+
+// isEmptyList rejects a non-empty list with the given message.
+func isEmptyList(message string) validation.RuleFunc {
+	return func(value interface{}) error {
+		if len(value.([]string)) > 0 {
+			return errors.New(message)
+		}
+		return nil
+	}
+}
+
+// isRiskParamsOf validates the params required by the kind of the risk rule.
+func isRiskParamsOf(kind models.RiskRuleKind) validation.RuleFunc {
+	return func(value interface{}) error {
+		p := value.(models.RiskRuleParams)
+		switch kind {
+		case models.RiskRuleVelocity:
+			return validation.ValidateStruct(
+				&p,
+				validation.Field(&p.Key, validation.Required, validation.In(models.RiskVelocityCard, models.RiskVelocityClientIp)),
+				validation.Field(&p.MaxCount, validation.Required, validation.Min(1)),
+				validation.Field(&p.WindowSeconds, validation.Required, validation.Min(1)),
+			)
+		case models.RiskRuleAmount:
+			return validation.ValidateStruct(
+				&p,
+				validation.Field(&p.Currency, validation.Required, is.CurrencyCode),
+				validation.Field(&p.MinAmount, validation.Min(0)),
+			)
+		case models.RiskRuleBinCountry:
+			return validation.ValidateStruct(
+				&p,
+				validation.Field(&p.Countries, validation.Required, validation.Each(is.CountryCode2)),
+			)
+		case models.RiskRuleCardBlocklist:
+			// The blocklist must not be empty, which is checked once it is merged with the one of the replaced rule.
+			return validation.ValidateStruct(
+				&p,
+				validation.Field(&p.Fingerprints, validation.Each(validation.Length(64, 64), is.Hexadecimal)),
+			)
+		}
+		return nil
+	}
+}
+
+func (r *RiskRuleRequest) Validate() error {
+	cardNumberRules := []validation.Rule{validation.Each(validation.By(isCardNumber))}
+	if r.Kind != models.RiskRuleCardBlocklist {
+		cardNumberRules = []validation.Rule{validation.By(isEmptyList("only apply to card blocklist rules"))}
+	}
+
+	return validation.ValidateStruct(
+		r,
+		validation.Field(&r.Kind, validation.Required, validation.By(isRiskRuleKind)),
+		validation.Field(&r.Action, validation.Required, validation.By(isRiskAction)),
+		validation.Field(&r.Score, validation.Min(0), validation.Max(risk.MaxScore)),
+		validation.Field(&r.Params, validation.By(isRiskParamsOf(r.Kind))),
+		validation.Field(&r.CardNumbers, cardNumberRules...),
+		validation.Field(&r.RemoveCardNumbers, cardNumberRules...),
+	)
+}
+
+type ListRiskRulesResponse struct {
+	Rules []*RiskRuleResource `json:"rules"`
+}
+
+type RiskRuleResource struct {
+	Id      string                `json:"id"`
+	Kind    models.RiskRuleKind   `json:"kind"`
+	Action  models.RiskDecision   `json:"action"`
+	Score   int                   `json:"score"`
+	Enabled bool                  `json:"enabled"`
+	Params  models.RiskRuleParams `json:"params"`
+
+	// FingerprintCount is the number of cards blocked by a card blocklist rule.
+	// The fingerprints themselves are not returned, as they identify the card numbers.
+	FingerprintCount int `json:"fingerprint_count,omitempty"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -0,0 +1,229 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"log"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/store"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// streamKeepAlive is the interval between keep-alive comments sent to idle event streams.
+	// Streams also check for missed events at this interval.
+	streamKeepAlive = 15 * time.Second
+	// streamBatchSize is the maximum number of events a merchant stream reads at once.
+	streamBatchSize = 100
+)
+
+// eventBroker wakes up event streams when events of their payments are committed.
+// A single subscription to the store notifications is shared by all streams of the instance.
+type eventBroker struct {
+	s store.Store
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber is an event stream of a payment or, if the payment ID is empty, of all payments of a merchant.
+type subscriber struct {
+	paymentId  string
+	merchantId string
+	wake       chan struct{}
+}
+
+func newEventBroker(s store.Store) *eventBroker {
+	return &eventBroker{
+		s:           s,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Start listens to the committed payment events until the context is cancelled.
+// The subscription is re-established if it fails; the streams catch up on missed events on their own.
+func (b *eventBroker) Start(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := b.s.PaymentEvents().Listen(ctx, b.notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] payment event notifications are interrupted: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (b *eventBroker) notify(paymentId, merchantId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if sub.paymentId == paymentId || (sub.paymentId == "" && sub.merchantId == merchantId) {
+			select {
+			case sub.wake <- struct{}{}:
+			default:
+				// The stream has a pending wake-up already.
+			}
+		}
+	}
+}
+
+// subscribe registers a new stream and returns it with the function that unregisters it.
+func (b *eventBroker) subscribe(paymentId, merchantId string) (*subscriber, func()) {
+	sub := &subscriber{
+		paymentId:  paymentId,
+		merchantId: merchantId,
+		wake:       make(chan struct{}, 1),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+
+	return sub, func() {
+		b.mu.Lock()
+		delete(b.subscribers, sub)
+		b.mu.Unlock()
+	}
+}
+
+// lastEventId returns the ID of the last event received by the client, if it resumes the stream.
+func lastEventId(r *http.Request) (int64, bool, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		e := fmt.Errorf("invalid Last-Event-ID: %s", v)
+		return 0, false, &Error{Err: e, Code: http.StatusBadRequest, Msg: e.Error()}
+	}
+	return id, true, nil
+}
+
+// serveEvents streams the events returned by fetch as server-sent events until the client disconnects
+// or the server shuts down. fetch returns the events after the given event ID, and the stream calls it
+// whenever it is woken up by the broker and at the keep-alive interval.
+func (api *Api) serveEvents(w http.ResponseWriter, r *http.Request, sub *subscriber, after int64, fetch func(ctx context.Context, after int64) ([]*models.PaymentEvent, error)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		renderError(w, r, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	for {
+		events, err := fetch(ctx, after)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[ERR] could not read payment events: %v", err)
+			}
+			return
+		}
+
+		for _, e := range events {
+			data, err := json.Marshal(PaymentEventModelToResource(e))
+			if err != nil {
+				log.Printf("[ERR] could not encode payment event %d: %v", e.Id, err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: payment\ndata: %s\n\n", e.Id, data); err != nil {
+				return
+			}
+			after = e.Id
+		}
+		flusher.Flush()
+
+		if len(events) == streamBatchSize {
+			// There may be more events to catch up on.
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-api.shutdown:
+			return
+		case <-sub.wake:
+		case <-time.After(streamKeepAlive):
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// StreamPayment streams the state changes of the payment, starting from the payment creation
+// or after the Last-Event-ID if the client resumes the stream.
+func (api *Api) StreamPayment(w http.ResponseWriter, r *http.Request) {
+	paymentId := chi.URLParam(r, "paymentId")
+
+	after, _, err := lastEventId(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	_, err = api.store.Payments().Get(r.Context(), paymentId)
+	switch {
+	case err == store.ErrNotFound:
+		renderApiError(w, r, err, http.StatusNotFound, "no payment found")
+		return
+	case err != nil:
+		renderError(w, r, err)
+		return
+	}
+
+	sub, unsubscribe := api.events.subscribe(paymentId, "")
+	defer unsubscribe()
+
+	api.serveEvents(w, r, sub, after, func(ctx context.Context, after int64) ([]*models.PaymentEvent, error) {
+		return api.store.PaymentEvents().ListByPayment(ctx, paymentId, after)
+	})
+}
+
+// StreamMerchantPayments streams the state changes of all payments of the merchant, starting from now
+// or after the Last-Event-ID if the client resumes the stream.
+func (api *Api) StreamMerchantPayments(w http.ResponseWriter, r *http.Request) {
+	merchantId := r.Header.Get(merchantIdHeader)
+	if merchantId == "" {
+		e := fmt.Errorf("%s header is required", merchantIdHeader)
+		renderApiError(w, r, e, http.StatusBadRequest, e.Error())
+		return
+	}
+
+	after, resumed, err := lastEventId(r)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+	if !resumed {
+		if after, err = api.store.PaymentEvents().LastId(r.Context()); err != nil {
+			renderError(w, r, err)
+			return
+		}
+	}
+
+	sub, unsubscribe := api.events.subscribe("", merchantId)
+	defer unsubscribe()
+
+	api.serveEvents(w, r, sub, after, func(ctx context.Context, after int64) ([]*models.PaymentEvent, error) {
+		return api.store.PaymentEvents().ListByMerchant(ctx, merchantId, after, streamBatchSize)
+	})
+}
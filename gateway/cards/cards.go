@@ -0,0 +1,225 @@
+package cards
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+type Brand string
+
+const (
+	BrandVisa       Brand = "visa"
+	BrandMastercard Brand = "mastercard"
+	BrandAmex       Brand = "amex"
+	BrandDiscover   Brand = "discover"
+	BrandDiners     Brand = "diners"
+	BrandJcb        Brand = "jcb"
+	BrandUnionPay   Brand = "unionpay"
+	BrandMaestro    Brand = "maestro"
+)
+
+// minLength and maxLength bound the PAN length of the cards of an unknown brand, as defined by ISO/IEC 7812.
+const (
+	minLength = 12
+	maxLength = 19
+)
+
+// binLength is the number of leading PAN digits that identify the issuer.
+const binLength = 6
+
+// iinRange is an inclusive range of card number prefixes of the same length.
+type iinRange struct {
+	from, to string
+	brand    Brand
+}
+
+// iinRanges are the issuer identification number ranges of the card brands. If the ranges overlap,
+// the one with the longer prefix takes precedence.
+var iinRanges = []iinRange{
+	{"4", "4", BrandVisa},
+	{"51", "55", BrandMastercard},
+	{"2221", "2720", BrandMastercard},
+	{"34", "34", BrandAmex},
+	{"37", "37", BrandAmex},
+	{"6011", "6011", BrandDiscover},
+	{"644", "649", BrandDiscover},
+	{"65", "65", BrandDiscover},
+	{"300", "305", BrandDiners},
+	{"36", "36", BrandDiners},
+	{"38", "39", BrandDiners},
+	{"3528", "3589", BrandJcb},
+	{"62", "62", BrandUnionPay},
+	{"50", "50", BrandMaestro},
+	{"56", "58", BrandMaestro},
+	{"6304", "6304", BrandMaestro},
+	{"6759", "6759", BrandMaestro},
+	{"676770", "676770", BrandMaestro},
+	{"676774", "676774", BrandMaestro},
+}
+
+// brandRules are the valid PAN lengths and the CVV length of the cards of each brand.
+var brandRules = map[Brand]struct {
+	lengths   []int
+	cvvLength int
+}{
+	BrandVisa:       {[]int{13, 16, 19}, 3},
+	BrandMastercard: {[]int{16}, 3},
+	BrandAmex:       {[]int{15}, 4},
+	BrandDiscover:   {[]int{16, 17, 18, 19}, 3},
+	BrandDiners:     {[]int{14, 15, 16, 17, 18, 19}, 3},
+	BrandJcb:        {[]int{16, 17, 18, 19}, 3},
+	BrandUnionPay:   {[]int{16, 17, 18, 19}, 3},
+	BrandMaestro:    {[]int{12, 13, 14, 15, 16, 17, 18, 19}, 3},
+}
+
+// BinTable maps card number prefixes to the ISO 3166 codes of their issuer countries.
+// Longer prefixes take precedence.
+type BinTable map[string]string
+
+// TestBins are the issuer countries of the acquirer simulator test cards, which are the default BinTable.
+// Country-specific test cards embed the ISO 3166 numeric code after the 400000 prefix.
+// It does not cover real cards: use a BIN table of a BIN data provider to match them.
+var TestBins = BinTable{
+	"4242":      "US",
+	"5555":      "US",
+	"400000036": "AU",
+	"400000076": "BR",
+	"400000124": "CA",
+	"400000250": "FR",
+	"400000276": "DE",
+	"400000392": "JP",
+	"400000528": "NL",
+	"400000826": "GB",
+	"400000840": "US",
+}
+
+// BrandOf returns the brand of the card, or an empty string if it is unknown.
+func BrandOf(number string) Brand {
+	var match iinRange
+	for _, r := range iinRanges {
+		if len(number) < len(r.from) || len(r.from) <= len(match.from) {
+			continue
+		}
+		if prefix := number[:len(r.from)]; prefix >= r.from && prefix <= r.to {
+			match = r
+		}
+	}
+	return match.brand
+}
+
+// Country returns the issuer country of the card, or an empty string if it is not in the table.
+func (t BinTable) Country(number string) string {
+	var match, country string
+	for prefix, c := range t {
+		if strings.HasPrefix(number, prefix) && len(prefix) > len(match) {
+			match, country = prefix, c
+		}
+	}
+	return country
+}
+
+// Bin returns the leading digits of the card number that identify the issuer.
+func Bin(number string) string {
+	if len(number) < binLength {
+		return number
+	}
+	return number[:binLength]
+}
+
+// Last4 returns the last four digits of the card number.
+func Last4(number string) string {
+	if len(number) < 4 {
+		return number
+	}
+	return number[len(number)-4:]
+}
+
+// Fingerprint returns a stable identifier of the card number, which is used in place of the number
+// to recognise the same card across payments, e.g. in velocity limits and blocklists.
+// It is keyed with a server-side secret: the few digits left unknown by the BIN and the last four digits
+// would otherwise let anyone holding a fingerprint recover the card number by brute force.
+func Fingerprint(key []byte, number string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Mask replaces all but the last four digits of the card number with asterisks.
+func Mask(number string) string {
+	last4 := Last4(number)
+	return strings.Repeat("*", len(number)-len(last4)) + last4
+}
+
+// ValidateNumber checks that the card number consists of digits, has a valid length for its brand,
+// and passes the Luhn check. The numbers of an unknown brand may have any length allowed by ISO/IEC 7812.
+func ValidateNumber(number string) error {
+	if !isDigits(number) {
+		return fmt.Errorf("must contain digits only")
+	}
+
+	brand := BrandOf(number)
+	if rules, ok := brandRules[brand]; ok {
+		if !containsInt(rules.lengths, len(number)) {
+			return fmt.Errorf("must be a valid %s card number length", brand)
+		}
+	} else if len(number) < minLength || len(number) > maxLength {
+		return fmt.Errorf("must be between %d and %d digits long", minLength, maxLength)
+	}
+
+	if !luhn(number) {
+		return fmt.Errorf("must be a valid credit card number")
+	}
+	return nil
+}
+
+// ValidateCvv checks that the CVV consists of digits and has the length required by the brand of the card:
+// 4 digits for Amex, and 3 digits for the other brands.
+func ValidateCvv(number, cvv string) error {
+	length := 3
+	if rules, ok := brandRules[BrandOf(number)]; ok {
+		length = rules.cvvLength
+	}
+	if !isDigits(cvv) || len(cvv) != length {
+		return fmt.Errorf("must be %d digits long", length)
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// luhn returns true if the number passes the Luhn checksum.
+func luhn(number string) bool {
+	sum := 0
+	for i := 0; i < len(number); i++ {
+		d := int(number[len(number)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
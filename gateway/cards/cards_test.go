@@ -0,0 +1,76 @@
+package cards
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBrandOf(t *testing.T) {
+	tests := map[string]Brand{
+		"4242424242424242":    BrandVisa,
+		"5555555555554444":    BrandMastercard,
+		"2223003122003222":    BrandMastercard,
+		"378282246310005":     BrandAmex,
+		"6011111111111117":    BrandDiscover,
+		"36227206271667":      BrandDiners,
+		"3566002020360505":    BrandJcb,
+		"6205500000000000004": BrandUnionPay,
+		"6759000000000000005": BrandMaestro,
+		"9999999999999995":    "",
+		"2":                   "",
+	}
+	for number, brand := range tests {
+		assert.Equal(t, brand, BrandOf(number), number)
+	}
+}
+
+func TestBinTable_Country(t *testing.T) {
+	assert.Equal(t, "GB", TestBins.Country("4000008260000000"))
+	assert.Equal(t, "US", TestBins.Country("4242424242424242"))
+	assert.Equal(t, "", TestBins.Country("378282246310005"))
+
+	bins := BinTable{"4": "US", "4571": "DK"}
+	assert.Equal(t, "DK", bins.Country("4571000000000001"))
+	assert.Equal(t, "US", bins.Country("4242424242424242"))
+	assert.Equal(t, "", BinTable(nil).Country("4242424242424242"))
+}
+
+func TestValidateNumber(t *testing.T) {
+	for _, number := range []string{"4242424242424242", "378282246310005", "36227206271667", "6205500000000000004", "9999999999999995"} {
+		assert.NoError(t, ValidateNumber(number), number)
+	}
+
+	invalid := map[string]string{
+		"4242424242424241":    "must be a valid credit card number",
+		"424242424242424":     "must be a valid visa card number length",
+		"3782822463100050":    "must be a valid amex card number length",
+		"4242-4242-4242-4242": "must contain digits only",
+		"99999999995":         "must be between 12 and 19 digits long",
+	}
+	for number, msg := range invalid {
+		assert.EqualError(t, ValidateNumber(number), msg, number)
+	}
+}
+
+func TestValidateCvv(t *testing.T) {
+	assert.NoError(t, ValidateCvv("4242424242424242", "123"))
+	assert.NoError(t, ValidateCvv("378282246310005", "1234"))
+	assert.EqualError(t, ValidateCvv("378282246310005", "123"), "must be 4 digits long")
+	assert.EqualError(t, ValidateCvv("4242424242424242", "1234"), "must be 3 digits long")
+	assert.EqualError(t, ValidateCvv("4242424242424242", "12a"), "must be 3 digits long")
+}
+
+func TestMask(t *testing.T) {
+	assert.Equal(t, "***********0005", Mask("378282246310005"))
+	assert.Equal(t, "123", Mask("123"))
+	assert.Equal(t, "0005", Last4("378282246310005"))
+	assert.Equal(t, "378282", Bin("378282246310005"))
+}
+
+func TestFingerprint(t *testing.T) {
+	key := []byte("secret")
+	assert.Equal(t, Fingerprint(key, "4242424242424242"), Fingerprint(key, "4242424242424242"))
+	assert.NotEqual(t, Fingerprint(key, "4242424242424242"), Fingerprint(key, "5555555555554444"))
+	assert.NotEqual(t, Fingerprint(key, "4242424242424242"), Fingerprint([]byte("other"), "4242424242424242"))
+	assert.Len(t, Fingerprint(key, "4242424242424242"), 64)
+}
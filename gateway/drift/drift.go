@@ -0,0 +1,240 @@
+package drift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"time"
+)
+
+var (
+	// errPaymentChanged aborts recording a discrepancy if the payment has changed since it was compared with the acquirer.
+	errPaymentChanged = errors.New("payment has changed concurrently")
+
+	// errNoChanges aborts a payment update that has nothing to change.
+	errNoChanges = errors.New("no changes")
+)
+
+// Report is the result of a single reconciliation run.
+type Report struct {
+	Checked       int
+	Discrepancies []*models.Discrepancy
+}
+
+// Reconciler is a service that compares active gateway payments with their acquirer counterparts
+// and records (and optionally repairs) the discrepancies.
+// It works both as a synchronous reconciler and as a background worker.
+type Reconciler interface {
+	Start(ctx context.Context)
+	Reconcile(ctx context.Context, repair bool) (*Report, error)
+}
+
+type reconcilerImpl struct {
+	s      store.Store
+	router routing.Router
+
+	interval   time.Duration
+	staleGrace time.Duration
+	autoRepair bool
+}
+
+// Option configures the Reconciler.
+type Option func(*reconcilerImpl)
+
+// WithInterval sets the interval between background reconciliation runs.
+func WithInterval(interval time.Duration) Option {
+	return func(r *reconcilerImpl) {
+		r.interval = interval
+	}
+}
+
+// WithStaleGrace sets how long the transition attempt of a payment that lags behind the acquirer version
+// may be overdue before the payment is reported as stale.
+func WithStaleGrace(grace time.Duration) Option {
+	return func(r *reconcilerImpl) {
+		r.staleGrace = grace
+	}
+}
+
+// WithAutoRepair makes background reconciliation runs repair the discrepancies they can.
+func WithAutoRepair(autoRepair bool) Option {
+	return func(r *reconcilerImpl) {
+		r.autoRepair = autoRepair
+	}
+}
+
+// New creates a new Reconciler that compares payments with the acquirers they are routed to.
+func New(s store.Store, router routing.Router, opts ...Option) Reconciler {
+	r := &reconcilerImpl{
+		s:          s,
+		router:     router,
+		interval:   5 * time.Minute,
+		staleGrace: 10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Start initiates a background worker that regularly reconciles all active payments.
+func (r *reconcilerImpl) Start(ctx context.Context) {
+	for {
+		report, err := r.Reconcile(ctx, r.autoRepair)
+		if err != nil {
+			log.Printf("[ERR] state reconciliation failed: %v", err)
+		} else if len(report.Discrepancies) > 0 {
+			log.Printf("[WARN] state reconciliation: %d discrepancies in %d payments", len(report.Discrepancies), report.Checked)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// Reconcile compares every active gateway payment with the acquirer one and records all detected discrepancies.
+// If repair is set, discrepancies that can be resolved by applying the acquirer state are repaired;
+// the others are marked for manual review.
+func (r *reconcilerImpl) Reconcile(ctx context.Context, repair bool) (*Report, error) {
+	ids, err := r.s.Payments().ListByStates(ctx, models.ActiveStates())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Discrepancies: make([]*models.Discrepancy, 0)}
+	for _, id := range ids {
+		d, err := r.check(ctx, id, repair)
+		if err != nil {
+			log.Printf("[WARN] could not reconcile payment %s: %v", id, err)
+			continue
+		}
+		report.Checked++
+		if d != nil {
+			report.Discrepancies = append(report.Discrepancies, d)
+		}
+	}
+
+	return report, nil
+}
+
+// check compares a single payment with the one of its acquirer and returns the discrepancy, if any.
+// The acquirer is queried outside of a transaction; the discrepancy is recorded only if the gateway payment
+// has not changed meanwhile, otherwise the payment is left to the next run.
+func (r *reconcilerImpl) check(ctx context.Context, id string, repair bool) (*models.Discrepancy, error) {
+	p, err := r.s.Payments().Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if p.AcquiringState == "" {
+		// The payment has not reached the acquirer yet, the transitioner will initialise it.
+		return nil, nil
+	}
+
+	d := &models.Discrepancy{
+		PaymentId:        p.Id,
+		State:            p.State,
+		AcquiringId:      p.AcquiringId,
+		AcquiringState:   p.AcquiringState,
+		AcquiringVersion: p.AcquiringVersion,
+	}
+
+	acq, err := r.router.Acquirer(p.Acquirer)
+	if err != nil {
+		return nil, err
+	}
+
+	rGet, err := acq.GetPayment(ctx, p.AcquiringId)
+	switch {
+	case errors.Is(err, acquiring.ErrPaymentNotFound):
+		d.Kind = models.DiscrepancyOrphaned
+		d.Details = "acquirer does not know the payment"
+	case err != nil:
+		return nil, err
+	default:
+		d.AcquirerState = string(rGet.State)
+		d.AcquirerVersion = rGet.Version
+		classify(p, rGet, d)
+	}
+
+	if d.Kind == "" || d.Kind == models.DiscrepancyStaleVersion && r.catchingUp(p) {
+		return nil, nil
+	}
+
+	// The payment is locked as in a transition, so that the transitioner does not sync it while it is repaired.
+	err = r.s.WithLock(ctx, "payment:"+id, func(ctx context.Context) error {
+		return r.s.Tx(ctx, func(ctx context.Context) error {
+			d.Status = models.DiscrepancyStatusDetected
+			if repair && d.Kind != models.DiscrepancyStaleVersion {
+				d.Status = models.DiscrepancyStatusManualReview
+			}
+
+			err := r.s.Payments().Update(ctx, id, func(py *models.Payment) error {
+				if py.AcquiringVersion != p.AcquiringVersion || py.State != p.State {
+					return errPaymentChanged
+				}
+				if !repair || d.Kind != models.DiscrepancyStaleVersion {
+					return errNoChanges
+				}
+				// A stale payment is repaired by the transitioner, which syncs the payment together with its dispute,
+				// if any, on the next attempt. Clearing the attempt time makes it due right away.
+				py.NextAttemptAt = nil
+				d.Status = models.DiscrepancyStatusRepaired
+				return nil
+			}, store.ForUpdate())
+			if err != nil && err != errNoChanges {
+				return err
+			}
+
+			return r.s.Discrepancies().Create(ctx, d)
+		})
+	})
+	switch {
+	case err == errPaymentChanged || err == store.ErrLocked:
+		// The payment has been transitioned since it was read, or is being transitioned right now,
+		// the next run will check it again.
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// catchingUp reports whether the payment lags behind the acquirer only because the transitioner has not synced it yet:
+// the payment is scheduled for a transition attempt that is not overdue by more than the grace period.
+func (r *reconcilerImpl) catchingUp(p *models.Payment) bool {
+	return p.NextAttemptAt != nil && time.Since(*p.NextAttemptAt) < r.staleGrace
+}
+
+// classify sets the kind and the details of the discrepancy between the gateway and the acquirer payment, if any.
+// The acquirer state is impossible if the gateway state machine does not lead from the gateway state
+// to the state implied by the acquirer.
+func classify(p *models.Payment, rGet *acquiring.Payment, d *models.Discrepancy) {
+	implied, err := models.AcquirerPaymentState(rGet.State)
+	if err != nil {
+		d.Kind = models.DiscrepancyImpossibleState
+		d.Details = err.Error()
+		return
+	}
+
+	switch {
+	case !models.CanTransition(p.State, implied):
+		d.Kind = models.DiscrepancyImpossibleState
+		d.Details = fmt.Sprintf("gateway payment is %s while acquirer payment is %s", p.State, rGet.State)
+	case p.AcquiringVersion != rGet.Version:
+		d.Kind = models.DiscrepancyStaleVersion
+		d.Details = fmt.Sprintf("acquiring version %s is behind %s", p.AcquiringVersion, rGet.Version)
+	case implied != p.State:
+		// Same version, yet the gateway state has diverged from the one derived from the acquirer.
+		d.Kind = models.DiscrepancyImpossibleState
+		d.Details = fmt.Sprintf("gateway payment is %s while acquirer state %s implies %s", p.State, rGet.State, implied)
+	}
+}
@@ -0,0 +1,203 @@
+package drift
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/acquiring/simulator"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"testing"
+	"time"
+)
+
+func Test_classify(t *testing.T) {
+	tests := []struct {
+		name            string
+		state           models.PaymentState
+		version         string
+		acquirerState   acquiring.PaymentState
+		acquirerVersion string
+		kind            models.DiscrepancyKind
+	}{
+		{"in sync", models.PaymentStateProcessing, "1", acquiring.PaymentStateAuthorised, "1", ""},
+		{"stale version", models.PaymentStateProcessing, "1", acquiring.PaymentStateCaptured, "2", models.DiscrepancyStaleVersion},
+		{"regression", models.PaymentStateActionPaid, "1", acquiring.PaymentStateCreated, "2", models.DiscrepancyImpossibleState},
+		{"unmapped state", models.PaymentStateProcessing, "1", "mystery", "2", models.DiscrepancyImpossibleState},
+		{"diverged state", models.PaymentStateProcessing, "1", acquiring.PaymentStateCaptured, "1", models.DiscrepancyImpossibleState},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &models.Payment{State: tt.state, AcquiringVersion: tt.version}
+			d := &models.Discrepancy{}
+			classify(p, &acquiring.Payment{State: tt.acquirerState, Version: tt.acquirerVersion}, d)
+			assert.Equal(t, tt.kind, d.Kind)
+			if tt.kind != "" {
+				assert.NotEmpty(t, d.Details)
+			}
+		})
+	}
+}
+
+// fixture is a set of gateway payments in various states of drift from the simulator payments.
+type fixture struct {
+	s   store.Store
+	acq acquiring.AcquirerAdapter
+
+	inSync, catchingUp, stale, orphaned, regressed *models.Payment
+}
+
+func newFixture(t *testing.T) *fixture {
+	f := &fixture{
+		s:   store.NewMemory(),
+		acq: simulator.New(acquirer.New(acquirer.NewStore())),
+	}
+
+	f.inSync = f.createPayment(t, models.PaymentStateProcessing, f.createAcquirerPayment(t, false), nil)
+
+	now := time.Now().UTC()
+	f.catchingUp = f.createPayment(t, models.PaymentStateProcessing, f.createAcquirerPayment(t, true), &now)
+
+	overdue := now.Add(-time.Hour)
+	f.stale = f.createPayment(t, models.PaymentStateProcessing, f.createAcquirerPayment(t, true), &overdue)
+
+	f.orphaned = f.createPayment(t, models.PaymentStateProcessing, &acquiring.Payment{
+		Id:      uuid.NewString(),
+		State:   acquiring.PaymentStateCreated,
+		Version: "1",
+	}, nil)
+
+	regressed := f.createAcquirerPayment(t, false)
+	f.regressed = f.createPayment(t, models.PaymentStateActionPaid, &acquiring.Payment{
+		Id:      regressed.Id,
+		State:   acquiring.PaymentStateCaptured,
+		Version: regressed.Version,
+	}, nil)
+
+	return f
+}
+
+// createAcquirerPayment creates a simulator payment and returns it as it was created.
+// If authorise is set, the payment is authorised afterwards, so that the returned version is stale.
+func (f *fixture) createAcquirerPayment(t *testing.T, authorise bool) *acquiring.Payment {
+	ctx := context.Background()
+	p, err := f.acq.CreatePayment(ctx, &acquiring.CreatePaymentRequest{
+		Id:       uuid.NewString(),
+		Amount:   100,
+		Currency: "EUR",
+	})
+	require.NoError(t, err)
+
+	if authorise {
+		card := &acquiring.Card{Number: "4242424242424242", ExpiryDate: "1077", Holder: "Jane Doe", Cvv: "123"}
+		_, err := f.acq.AuthorisePayment(ctx, p.Id, p.Version, card)
+		require.NoError(t, err)
+	}
+	return p
+}
+
+// createPayment creates a gateway payment synced with the given acquirer payment.
+func (f *fixture) createPayment(t *testing.T, state models.PaymentState, ap *acquiring.Payment, next *time.Time) *models.Payment {
+	return storetest.CreatePayment(t, f.s.Payments(), storetest.WithState(state), func(p *models.Payment) {
+		p.Acquirer = "simulator"
+		p.AcquiringId = ap.Id
+		p.AcquiringState = string(ap.State)
+		p.AcquiringVersion = ap.Version
+		p.NextAttemptAt = next
+	})
+}
+
+func (f *fixture) reconciler(t *testing.T, opts ...Option) Reconciler {
+	router, err := routing.New(routing.WithAcquirer("simulator", f.acq))
+	require.NoError(t, err)
+	return New(f.s, router, opts...)
+}
+
+func TestReconciler_Reconcile(t *testing.T) {
+	tests := []struct {
+		name           string
+		repair         bool
+		staleStatus    models.DiscrepancyStatus
+		reviewedStatus models.DiscrepancyStatus
+	}{
+		{"detect", false, models.DiscrepancyStatusDetected, models.DiscrepancyStatusDetected},
+		{"repair", true, models.DiscrepancyStatusRepaired, models.DiscrepancyStatusManualReview},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newFixture(t)
+
+			report, err := f.reconciler(t).Reconcile(ctx, tt.repair)
+			require.NoError(t, err)
+			assert.Equal(t, 5, report.Checked)
+
+			found := make(map[string]*models.Discrepancy)
+			for _, d := range report.Discrepancies {
+				found[d.PaymentId] = d
+			}
+			require.Len(t, found, 3)
+
+			assert.Equal(t, models.DiscrepancyStaleVersion, found[f.stale.Id].Kind)
+			assert.Equal(t, tt.staleStatus, found[f.stale.Id].Status)
+			assert.Equal(t, models.DiscrepancyOrphaned, found[f.orphaned.Id].Kind)
+			assert.Equal(t, tt.reviewedStatus, found[f.orphaned.Id].Status)
+			assert.Equal(t, models.DiscrepancyImpossibleState, found[f.regressed.Id].Kind)
+			assert.Equal(t, tt.reviewedStatus, found[f.regressed.Id].Status)
+
+			recorded, err := f.s.Discrepancies().List(ctx, tt.staleStatus)
+			require.NoError(t, err)
+			assert.NotEmpty(t, recorded)
+
+			stale, err := f.s.Payments().Get(ctx, f.stale.Id)
+			require.NoError(t, err)
+			assert.Equal(t, f.stale.AcquiringVersion, stale.AcquiringVersion, "the transitioner syncs the payment")
+			require.NotNil(t, stale.NextAttemptAt)
+			if tt.repair {
+				assert.False(t, stale.NextAttemptAt.After(time.Now()), "a repaired payment must be due")
+			} else {
+				assert.Equal(t, f.stale.NextAttemptAt.Unix(), stale.NextAttemptAt.Unix())
+			}
+		})
+	}
+
+	t.Run("locked", func(t *testing.T) {
+		ctx := context.Background()
+		f := newFixture(t)
+
+		var report *Report
+		err := f.s.WithLock(ctx, "payment:"+f.stale.Id, func(ctx context.Context) error {
+			var err error
+			report, err = f.reconciler(t).Reconcile(ctx, true)
+			return err
+		})
+		require.NoError(t, err)
+
+		for _, d := range report.Discrepancies {
+			assert.NotEqual(t, f.stale.Id, d.PaymentId, "payments being transitioned must be left to the next run")
+		}
+	})
+
+	t.Run("no grace", func(t *testing.T) {
+		ctx := context.Background()
+		f := newFixture(t)
+
+		report, err := f.reconciler(t, WithStaleGrace(0)).Reconcile(ctx, false)
+		require.NoError(t, err)
+
+		var stale []string
+		for _, d := range report.Discrepancies {
+			if d.Kind == models.DiscrepancyStaleVersion {
+				stale = append(stale, d.PaymentId)
+			}
+		}
+		assert.ElementsMatch(t, []string{f.catchingUp.Id, f.stale.Id}, stale)
+	})
+}
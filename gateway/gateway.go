@@ -2,10 +2,13 @@ package gateway
 
 import (
 	"context"
-	"mkuznets.com/go/upsp/acquirer"
 	"mkuznets.com/go/upsp/gateway/api"
+	"mkuznets.com/go/upsp/gateway/drift"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/settlement"
 	"mkuznets.com/go/upsp/gateway/store"
 	"mkuznets.com/go/upsp/gateway/transitioner"
+	"sync"
 )
 
 type Gateway interface {
@@ -17,17 +20,67 @@ type gatewayImpl struct {
 	api          *api.Api
 	store        store.Store
 	transitioner transitioner.Transitioner
+	settlement   settlement.Reconciler
+	drift        drift.Reconciler
+
+	apiOpts          []api.Option
+	driftOpts        []drift.Option
+	transitionerOpts []transitioner.Option
+}
+
+// Option configures the gateway.
+type Option func(*gatewayImpl)
+
+// WithApiOptions configures the HTTP API of the gateway.
+func WithApiOptions(opts ...api.Option) Option {
+	return func(g *gatewayImpl) {
+		g.apiOpts = append(g.apiOpts, opts...)
+	}
+}
+
+// WithDriftOptions configures the background state reconciliation between the gateway and the acquirer.
+func WithDriftOptions(opts ...drift.Option) Option {
+	return func(g *gatewayImpl) {
+		g.driftOpts = append(g.driftOpts, opts...)
+	}
 }
 
-func New(store store.Store, acq acquirer.Acquirer) Gateway {
-	return &gatewayImpl{
-		store:        store,
-		api:          api.New(store, acq),
-		transitioner: transitioner.New(store, acq),
+// WithTransitionerOptions configures the transitioner of the gateway payments.
+func WithTransitionerOptions(opts ...transitioner.Option) Option {
+	return func(g *gatewayImpl) {
+		g.transitionerOpts = append(g.transitionerOpts, opts...)
 	}
 }
 
+// New creates a new Gateway that processes payments with the acquirers registered in the router.
+func New(store store.Store, router routing.Router, opts ...Option) Gateway {
+	g := &gatewayImpl{
+		store:      store,
+		settlement: settlement.New(store, router),
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	g.transitioner = transitioner.New(store, router, g.transitionerOpts...)
+	g.drift = drift.New(store, router, g.driftOpts...)
+	// The API runs the same reconciler on demand as the background job.
+	apiOpts := append([]api.Option{api.WithReconciler(g.drift)}, g.apiOpts...)
+	g.api = api.New(store, router, g.transitioner, apiOpts...)
+	return g
+}
+
+// Start runs the API and the background workers until the context is cancelled,
+// then waits for all of them to stop.
 func (g *gatewayImpl) Start(ctx context.Context) {
-	go g.transitioner.Start(ctx)
+	var wg sync.WaitGroup
+	for _, start := range []func(context.Context){g.transitioner.Start, g.settlement.Start, g.drift.Start} {
+		wg.Add(1)
+		go func(start func(context.Context)) {
+			defer wg.Done()
+			start(ctx)
+		}(start)
+	}
+
 	g.api.Start(ctx)
+	wg.Wait()
 }
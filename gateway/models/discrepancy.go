@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+type (
+	DiscrepancyKind   string
+	DiscrepancyStatus string
+)
+
+const (
+	// DiscrepancyOrphaned is a payment whose acquiring ID is not known to the acquirer.
+	DiscrepancyOrphaned DiscrepancyKind = "orphaned"
+	// DiscrepancyStaleVersion is a payment whose acquiring version is behind the acquirer one.
+	DiscrepancyStaleVersion DiscrepancyKind = "stale_version"
+	// DiscrepancyImpossibleState is a payment whose state cannot be reconciled with the acquirer state.
+	DiscrepancyImpossibleState DiscrepancyKind = "impossible_state"
+)
+
+const (
+	// DiscrepancyStatusDetected is a discrepancy that has been detected but not repaired.
+	DiscrepancyStatusDetected DiscrepancyStatus = "detected"
+	// DiscrepancyStatusRepaired is a discrepancy that has been repaired automatically.
+	DiscrepancyStatusRepaired DiscrepancyStatus = "repaired"
+	// DiscrepancyStatusManualReview is a discrepancy that cannot be repaired automatically.
+	DiscrepancyStatusManualReview DiscrepancyStatus = "manual_review"
+)
+
+// Discrepancy is a difference between a gateway payment and its acquirer counterpart.
+type Discrepancy struct {
+	Id        int64
+	PaymentId string
+	Kind      DiscrepancyKind
+	Status    DiscrepancyStatus
+	Details   string
+
+	State            PaymentState
+	AcquiringId      string
+	AcquiringState   string
+	AcquiringVersion string
+	AcquirerState    string
+	AcquirerVersion  string
+
+	DetectedAt time.Time
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"time"
+)
+
+type DisputeState string
+
+const (
+	DisputeStateNeedsResponse DisputeState = "needs_response"
+	DisputeStateUnderReview   DisputeState = "under_review"
+
+	DisputeStateWon  DisputeState = "won"
+	DisputeStateLost DisputeState = "lost"
+)
+
+type Dispute struct {
+	Id        string
+	PaymentId string
+	State     DisputeState
+	Reason    string
+	Amount    int64
+	Currency  string
+
+	Evidence      string
+	EvidenceDueBy time.Time
+
+	AcquiringId      string
+	AcquiringState   string
+	AcquiringVersion string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SyncState syncs dispute state with the normalised acquiring state (see acquiring.DisputeState).
+func (d *Dispute) SyncState() {
+	switch acquiring.DisputeState(d.AcquiringState) {
+	case acquiring.DisputeStateOpen:
+		d.State = DisputeStateNeedsResponse
+	case acquiring.DisputeStateUnderReview:
+		d.State = DisputeStateUnderReview
+	case acquiring.DisputeStateWon:
+		d.State = DisputeStateWon
+	case acquiring.DisputeStateLost:
+		d.State = DisputeStateLost
+	}
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// Merchant holds the gateway settings of a merchant.
+type Merchant struct {
+	Id string
+	// AsyncPayments makes payment creation asynchronous unless a request asks otherwise.
+	AsyncPayments bool
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -1,7 +1,9 @@
 package models
 
 import (
-	acq "mkuznets.com/go/upsp/acquirer"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/money"
 	"time"
 )
 
@@ -15,44 +17,128 @@ const (
 	PaymentStateCancelled PaymentState = "cancelled"
 	PaymentStateRefunded  PaymentState = "refunded"
 	PaymentStateRejected  PaymentState = "rejected"
+
+	PaymentStateDisputed    PaymentState = "disputed"
+	PaymentStateChargedBack PaymentState = "charged_back"
+
+	// PaymentStateNeedsAttention is the state of a payment whose transition has failed too many times,
+	// or that the risk rules have held for review.
+	// The payment is not picked up by the background transitioner until it is retried manually.
+	PaymentStateNeedsAttention PaymentState = "needs_attention"
 )
 
+// finalStates are the payment states that cannot change anymore.
+var finalStates = []PaymentState{
+	PaymentStateCancelled,
+	PaymentStateRefunded,
+	PaymentStateRejected,
+	PaymentStateChargedBack,
+}
+
+// ActiveStates returns the payment states that can still change.
+func ActiveStates() []PaymentState {
+	return []PaymentState{
+		PaymentStateProcessing,
+		PaymentStateActionRequired,
+		PaymentStateActionPaid,
+		PaymentStateDisputed,
+	}
+}
+
+// IsActive returns true if the payment in this state is regularly transitioned in the background.
+func (s PaymentState) IsActive() bool {
+	for _, state := range ActiveStates() {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSettled returns true if the payment in this state has been paid. Such a payment is still active,
+// but it only changes if the cardholder disputes it, so it is synced with the acquirer far less often.
+func (s PaymentState) IsSettled() bool {
+	return s == PaymentStateActionPaid || s == PaymentStateDisputed
+}
+
+// IsFinal returns true if the payment in this state cannot change anymore.
+func (s PaymentState) IsFinal() bool {
+	for _, state := range finalStates {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
+
 type Payment struct {
-	Id       string
-	Amount   int64
-	Currency string
-	State    PaymentState
+	Id         string
+	MerchantId string
+	money.Money
+	State PaymentState
 
 	CardNumber string
 	CardHolder string
 	ExpiryDate string
 	Cvv        string
+	// CardFingerprint identifies the card without revealing its number (see cards.Fingerprint).
+	CardFingerprint string
+	// ClientIp is the IP address the payment has been requested from.
+	ClientIp string
 
-	AcquiringId      string
+	// RiskScore is the sum of the scores of the risk rules the payment has matched, capped at 100.
+	RiskScore int
+	// RiskDecision is the decision of the risk rules, empty until the risk of the payment is assessed.
+	RiskDecision RiskDecision
+
+	// Acquirer is the name of the acquirer the payment is routed to, empty until the payment is routed.
+	Acquirer    string
+	AcquiringId string
+	// AcquiringState is the normalised state of the acquirer payment (see acquiring.PaymentState).
 	AcquiringState   string
 	AcquiringVersion string
+	// DeclineCode is the normalised reason the acquirer has declined the payment, if it has.
+	DeclineCode string
+
+	// NextAttemptAt is the time when the background transitioner should pick up the payment.
+	// Nil for payments that are not active.
+	NextAttemptAt *time.Time
+	// Attempts is the number of consecutive failed transition attempts.
+	Attempts int
+	// LastError is the error of the last failed transition attempt.
+	LastError string
+
+	// Version is incremented with every update of the payment.
+	Version int64
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
-// SyncState syncs payment state with acquiring state
-func (p *Payment) SyncState() {
-	switch p.AcquiringState {
-	case string(acq.PaymentStateNew), string(acq.PaymentStateAuthorising):
-		p.State = PaymentStateProcessing
-
-	case string(acq.PaymentState3dSecureRequired):
-		p.State = PaymentStateActionRequired
+// acquiringPaymentState returns the payment state implied by the acquiring state.
+// The payment is processing until it has been created in the acquirer.
+func (p *Payment) acquiringPaymentState() (PaymentState, error) {
+	if p.AcquiringState == "" {
+		return PaymentStateProcessing, nil
+	}
+	return AcquirerPaymentState(acquiring.PaymentState(p.AcquiringState))
+}
 
-	case string(acq.PaymentStateConfirmed):
-		p.State = PaymentStateActionPaid
+// SetState sets the state of the payment. Returns an error if the transition is invalid.
+func (p *Payment) SetState(state PaymentState) error {
+	if !CanTransition(p.State, state) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, p.State, state)
+	}
+	p.State = state
+	return nil
+}
 
-	case string(acq.PaymentStateReversed), string(acq.PaymentStateCancelled):
-		p.State = PaymentStateCancelled
-	case string(acq.PaymentStateRefunded):
-		p.State = PaymentStateRefunded
-	case string(acq.PaymentStateRejected):
-		p.State = PaymentStateRejected
+// SyncState syncs payment state with acquiring state.
+// Returns an error if the acquiring state is unknown or implies an invalid transition.
+func (p *Payment) SyncState() error {
+	state, err := p.acquiringPaymentState()
+	if err != nil {
+		return err
 	}
+	return p.SetState(state)
 }
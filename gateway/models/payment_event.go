@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// PaymentEvent is a state change of a payment. Event IDs are unique, but events are listed in the order
+// of the transactions that recorded them, which may differ from the order of IDs (see store.PaymentEvents).
+type PaymentEvent struct {
+	Id         int64
+	PaymentId  string
+	MerchantId string
+	State      PaymentState
+	CreatedAt  time.Time
+}
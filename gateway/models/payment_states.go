@@ -0,0 +1,158 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrInvalidTransition is returned when a payment state change is not allowed by the state machine.
+	ErrInvalidTransition = errors.New("invalid payment transition")
+
+	// ErrUnmappedAcquirerState is returned when the acquirer payment is in a state the gateway does not know.
+	ErrUnmappedAcquirerState = errors.New("unmapped acquirer payment state")
+)
+
+// validTransitions is the state machine of gateway payments: the states each state can change to directly.
+var validTransitions = map[PaymentState][]PaymentState{
+	PaymentStateProcessing: {
+		PaymentStateActionRequired,
+		PaymentStateActionPaid,
+		PaymentStateCancelled,
+		PaymentStateRejected,
+		PaymentStateNeedsAttention,
+	},
+	PaymentStateActionRequired: {
+		PaymentStateProcessing,
+		PaymentStateRejected,
+		PaymentStateNeedsAttention,
+	},
+	PaymentStateActionPaid: {
+		PaymentStateRefunded,
+		PaymentStateDisputed,
+		PaymentStateNeedsAttention,
+	},
+	PaymentStateDisputed: {
+		PaymentStateActionPaid,
+		PaymentStateChargedBack,
+		PaymentStateNeedsAttention,
+	},
+	// A payment leaves this state only when it is retried manually,
+	// for the active state implied by the acquirer, so that it does not regress.
+	PaymentStateNeedsAttention: {
+		PaymentStateProcessing,
+		PaymentStateActionRequired,
+		PaymentStateActionPaid,
+		PaymentStateDisputed,
+	},
+	PaymentStateCancelled:   {},
+	PaymentStateRefunded:    {},
+	PaymentStateRejected:    {},
+	PaymentStateChargedBack: {},
+}
+
+// acquirerStates maps the normalised states of acquirer payments to the states of gateway payments.
+var acquirerStates = map[acquiring.PaymentState]PaymentState{
+	acquiring.PaymentStateCreated:        PaymentStateProcessing,
+	acquiring.PaymentStateAuthorising:    PaymentStateProcessing,
+	acquiring.PaymentStateAuthorised:     PaymentStateProcessing,
+	acquiring.PaymentStateActionRequired: PaymentStateActionRequired,
+	acquiring.PaymentStateCaptured:       PaymentStateActionPaid,
+	acquiring.PaymentStateVoided:         PaymentStateCancelled,
+	acquiring.PaymentStateRefunded:       PaymentStateRefunded,
+	acquiring.PaymentStateDeclined:       PaymentStateRejected,
+	acquiring.PaymentStateDisputed:       PaymentStateDisputed,
+	acquiring.PaymentStateChargedBack:    PaymentStateChargedBack,
+}
+
+// CanTransition returns true if a payment can change from one state to another.
+//
+// Besides the direct transitions, a payment may skip intermediate states, because the gateway only observes
+// the acquirer payment from time to time. Skipping through PaymentStateNeedsAttention is not allowed though,
+// as this would let a payment regress, e.g. from paid back to processing.
+func CanTransition(from, to PaymentState) bool {
+	if from == to {
+		return true
+	}
+
+	visited := map[PaymentState]bool{from: true}
+	queue := []PaymentState{from}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for _, next := range validTransitions[state] {
+			if next == to {
+				return true
+			}
+			if visited[next] || next == PaymentStateNeedsAttention {
+				continue
+			}
+			visited[next] = true
+			queue = append(queue, next)
+		}
+	}
+	return false
+}
+
+// AcquirerPaymentState returns the gateway payment state implied by the normalised acquirer payment state.
+func AcquirerPaymentState(state acquiring.PaymentState) (PaymentState, error) {
+	s, ok := acquirerStates[state]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnmappedAcquirerState, state)
+	}
+	return s, nil
+}
+
+// PaymentStateDiagram renders the state machine of gateway payments in the Graphviz DOT language.
+// Each transition is labelled with the acquirer states that lead to it.
+func PaymentStateDiagram() string {
+	causes := make(map[PaymentState][]string)
+	for aState, state := range acquirerStates {
+		causes[state] = append(causes[state], string(aState))
+	}
+
+	states := make([]string, 0, len(validTransitions))
+	for state := range validTransitions {
+		states = append(states, string(state))
+	}
+	sort.Strings(states)
+
+	var b strings.Builder
+	b.WriteString("digraph payment {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, style=rounded];\n")
+	fmt.Fprintf(&b, "  start [shape=point];\n")
+	fmt.Fprintf(&b, "  start -> %q;\n", PaymentStateProcessing)
+
+	for _, name := range states {
+		state := PaymentState(name)
+		if state.IsFinal() {
+			fmt.Fprintf(&b, "  %q [peripheries=2];\n", state)
+		}
+	}
+
+	for _, name := range states {
+		from := PaymentState(name)
+		for _, to := range validTransitions[from] {
+			var label string
+			switch {
+			case to == PaymentStateNeedsAttention:
+				label = "retries exhausted"
+			case from == PaymentStateNeedsAttention:
+				label = "manual retry"
+			default:
+				labels := causes[to]
+				sort.Strings(labels)
+				label = strings.Join(labels, `\n`)
+			}
+			fmt.Fprintf(&b, "  %q -> %q [label=\"%s\"];\n", from, to, label)
+		}
+	}
+
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to PaymentState
+		allowed  bool
+	}{
+		{"same state", PaymentStateActionPaid, PaymentStateActionPaid, true},
+		{"direct", PaymentStateProcessing, PaymentStateActionRequired, true},
+		{"skipping states", PaymentStateProcessing, PaymentStateActionPaid, true},
+		{"skipping several states", PaymentStateActionRequired, PaymentStateChargedBack, true},
+		{"back from dispute", PaymentStateDisputed, PaymentStateActionPaid, true},
+		{"regression", PaymentStateActionPaid, PaymentStateProcessing, false},
+		{"from final state", PaymentStateRejected, PaymentStateProcessing, false},
+		{"into needs attention", PaymentStateDisputed, PaymentStateNeedsAttention, true},
+		{"manual retry", PaymentStateNeedsAttention, PaymentStateProcessing, true},
+		{"through needs attention", PaymentStateActionPaid, PaymentStateActionRequired, false},
+		{"manual retry of a paid payment", PaymentStateNeedsAttention, PaymentStateActionPaid, true},
+		{"manual retry of a disputed payment", PaymentStateNeedsAttention, PaymentStateDisputed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, CanTransition(tt.from, tt.to))
+		})
+	}
+}
+
+func TestPayment_SetState(t *testing.T) {
+	p := &Payment{State: PaymentStateActionPaid}
+
+	err := p.SetState(PaymentStateProcessing)
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+	assert.Equal(t, PaymentStateActionPaid, p.State, "the state must not change")
+
+	require.NoError(t, p.SetState(PaymentStateRefunded))
+	assert.Equal(t, PaymentStateRefunded, p.State)
+}
+
+func TestPayment_SyncState(t *testing.T) {
+	tests := []struct {
+		name           string
+		state          PaymentState
+		acquiringState acquiring.PaymentState
+		want           PaymentState
+		err            error
+	}{
+		{"not created yet", PaymentStateProcessing, "", PaymentStateProcessing, nil},
+		{"authorised", PaymentStateProcessing, acquiring.PaymentStateAuthorised, PaymentStateProcessing, nil},
+		{"captured", PaymentStateProcessing, acquiring.PaymentStateCaptured, PaymentStateActionPaid, nil},
+		{"declined", PaymentStateActionRequired, acquiring.PaymentStateDeclined, PaymentStateRejected, nil},
+		{"regression", PaymentStateActionPaid, acquiring.PaymentStateCreated, PaymentStateActionPaid, ErrInvalidTransition},
+		{"unmapped", PaymentStateProcessing, "mystery", PaymentStateProcessing, ErrUnmappedAcquirerState},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Payment{State: tt.state, AcquiringState: string(tt.acquiringState)}
+			err := p.SyncState()
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.want, p.State)
+		})
+	}
+}
+
+func TestAcquirerPaymentState(t *testing.T) {
+	state, err := AcquirerPaymentState(acquiring.PaymentStateChargedBack)
+	require.NoError(t, err)
+	assert.Equal(t, PaymentStateChargedBack, state)
+
+	_, err = AcquirerPaymentState("mystery")
+	assert.ErrorIs(t, err, ErrUnmappedAcquirerState)
+}
+
+func TestPaymentStateDiagram(t *testing.T) {
+	golden := filepath.Join("testdata", "payment_states.dot")
+	diagram := PaymentStateDiagram()
+
+	if *update {
+		require.NoError(t, os.WriteFile(golden, []byte(diagram), 0644))
+	}
+
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), diagram, "run go test ./gateway/models -update to update the golden file")
+}
@@ -0,0 +1,97 @@
+package models
+
+import "time"
+
+type (
+	RiskDecision    string
+	RiskRuleKind    string
+	RiskVelocityKey string
+)
+
+const (
+	// RiskDecisionAllow lets the payment through to the acquirer as is.
+	RiskDecisionAllow RiskDecision = "allow"
+	// RiskDecisionForce3ds requires the acquirer to authenticate the cardholder with 3DS.
+	RiskDecisionForce3ds RiskDecision = "force_3ds"
+	// RiskDecisionReview holds the payment in needs_attention until it is retried manually.
+	RiskDecisionReview RiskDecision = "review"
+	// RiskDecisionBlock rejects the payment before it reaches the acquirer.
+	RiskDecisionBlock RiskDecision = "block"
+)
+
+// riskSeverity orders the risk decisions: the most severe decision of the matching rules applies.
+var riskSeverity = map[RiskDecision]int{
+	RiskDecisionAllow:    0,
+	RiskDecisionForce3ds: 1,
+	RiskDecisionReview:   2,
+	RiskDecisionBlock:    3,
+}
+
+// Severer returns true if the decision is more severe than the other one.
+func (d RiskDecision) Severer(other RiskDecision) bool {
+	return riskSeverity[d] > riskSeverity[other]
+}
+
+// RiskActions returns the decisions a risk rule may take.
+func RiskActions() []RiskDecision {
+	return []RiskDecision{RiskDecisionForce3ds, RiskDecisionReview, RiskDecisionBlock}
+}
+
+const (
+	// RiskRuleVelocity matches more than MaxCount payments of the same card or client IP within the window.
+	RiskRuleVelocity RiskRuleKind = "velocity"
+	// RiskRuleAmount matches payments in the currency of at least MinAmount.
+	RiskRuleAmount RiskRuleKind = "amount"
+	// RiskRuleBinCountry matches cards issued in one of the countries, as implied by the card BIN.
+	// The countries are looked up in the configured BIN table, which by default only covers the simulator test cards.
+	RiskRuleBinCountry RiskRuleKind = "bin_country"
+	// RiskRuleCardBlocklist matches cards with one of the fingerprints.
+	RiskRuleCardBlocklist RiskRuleKind = "card_blocklist"
+)
+
+// RiskRuleKinds returns all kinds of risk rules.
+func RiskRuleKinds() []RiskRuleKind {
+	return []RiskRuleKind{RiskRuleVelocity, RiskRuleAmount, RiskRuleBinCountry, RiskRuleCardBlocklist}
+}
+
+const (
+	RiskVelocityCard     RiskVelocityKey = "card"
+	RiskVelocityClientIp RiskVelocityKey = "ip"
+)
+
+// RiskRule is a condition that, if the payment matches it, adds its score to the risk score of the payment
+// and takes its action.
+type RiskRule struct {
+	Id      string
+	Kind    RiskRuleKind
+	Action  RiskDecision
+	Score   int
+	Enabled bool
+	Params  RiskRuleParams
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RiskRuleParams are the conditions of a risk rule. Only the ones of the rule kind apply.
+type RiskRuleParams struct {
+	// Key, MaxCount and WindowSeconds are the conditions of velocity rules.
+	Key           RiskVelocityKey `json:"key,omitempty"`
+	MaxCount      int             `json:"max_count,omitempty"`
+	WindowSeconds int64           `json:"window_seconds,omitempty"`
+
+	// Currency and MinAmount are the conditions of amount rules, MinAmount is in minor units of the currency.
+	Currency  string `json:"currency,omitempty"`
+	MinAmount int64  `json:"min_amount,omitempty"`
+
+	// Countries are the ISO 3166 codes of the card issuer countries of BIN country rules.
+	Countries []string `json:"countries,omitempty"`
+
+	// Fingerprints are the card fingerprints of card blocklist rules (see cards.Fingerprint).
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// Window returns the time window of a velocity rule.
+func (p *RiskRuleParams) Window() time.Duration {
+	return time.Duration(p.WindowSeconds) * time.Second
+}
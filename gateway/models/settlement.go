@@ -0,0 +1,74 @@
+package models
+
+import "time"
+
+type (
+	SettlementEntryType string
+	SettlementStatus    string
+)
+
+const (
+	SettlementEntryPayment    SettlementEntryType = "payment"
+	SettlementEntryRefund     SettlementEntryType = "refund"
+	SettlementEntryChargeback SettlementEntryType = "chargeback"
+)
+
+const (
+	// SettlementStatusMatched is a settlement line that matches exactly one gateway payment.
+	SettlementStatusMatched SettlementStatus = "matched"
+	// SettlementStatusDuplicate is a settlement line that has already been settled before.
+	SettlementStatusDuplicate SettlementStatus = "duplicate"
+	// SettlementStatusAmountMismatch is a settlement line whose amount differs from the gateway payment.
+	SettlementStatusAmountMismatch SettlementStatus = "amount_mismatch"
+	// SettlementStatusCurrencyMismatch is a settlement line whose currency differs from the gateway payment.
+	SettlementStatusCurrencyMismatch SettlementStatus = "currency_mismatch"
+	// SettlementStatusUnknownPayment is a settlement line that does not match any gateway payment.
+	SettlementStatusUnknownPayment SettlementStatus = "unknown_payment"
+)
+
+// SettlementBatch is a settlement report file ingested from the acquirer.
+type SettlementBatch struct {
+	Id       string
+	Date     string
+	Currency string
+	CutoffAt time.Time
+
+	Gross int64
+	Fees  int64
+	Net   int64
+
+	Lines []*SettlementLine
+
+	// LineCount and MatchedCount are populated when batches are listed without lines.
+	LineCount    int
+	MatchedCount int
+
+	IngestedAt time.Time
+}
+
+// SettlementLine is a single entry of a settlement report file along with its reconciliation result.
+type SettlementLine struct {
+	Id          int64
+	BatchId     string
+	AcquiringId string
+	PaymentId   string
+	Type        SettlementEntryType
+
+	Currency string
+	Amount   int64
+	Fee      int64
+	Net      int64
+
+	Status    SettlementStatus
+	CreatedAt time.Time
+}
+
+// MissingSettlement is a settlement entry expected for a gateway payment that the acquirer has not settled.
+type MissingSettlement struct {
+	PaymentId string
+	Type      SettlementEntryType
+	Currency  string
+	Amount    int64
+
+	DetectedAt time.Time
+}
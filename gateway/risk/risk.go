@@ -0,0 +1,146 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/store"
+	"strings"
+	"time"
+)
+
+// MaxScore is the upper bound of the risk score of a payment.
+const MaxScore = 100
+
+// Assessment is the outcome of the risk rules evaluated against a payment.
+type Assessment struct {
+	// Decision is the most severe action of the matched rules, or allow if none matched.
+	Decision models.RiskDecision
+	// Score is the sum of the scores of the matched rules, capped at MaxScore.
+	Score int
+	// Rules are the IDs of the matched rules.
+	Rules []string
+}
+
+// Engine evaluates the fraud and risk rules against new payments before they reach the acquirer.
+type Engine interface {
+	// Assess evaluates the enabled rules against the payment. The payment must be persisted already,
+	// so that it is counted by the velocity rules.
+	Assess(ctx context.Context, p *models.Payment) (*Assessment, error)
+}
+
+type engineImpl struct {
+	store store.Store
+	bins  cards.BinTable
+	now   func() time.Time
+}
+
+// Option configures the Engine.
+type Option func(*engineImpl)
+
+// WithBinTable sets the table the issuer countries of the cards are looked up in by the bin_country rules.
+// By default, it is cards.TestBins, which only covers the acquirer simulator test cards.
+func WithBinTable(t cards.BinTable) Option {
+	return func(e *engineImpl) {
+		e.bins = t
+	}
+}
+
+// New creates a new Engine that evaluates the rules kept in the store.
+func New(s store.Store, opts ...Option) Engine {
+	e := &engineImpl{store: s, bins: cards.TestBins, now: time.Now}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Assess evaluates the enabled rules against the payment.
+func (e *engineImpl) Assess(ctx context.Context, p *models.Payment) (*Assessment, error) {
+	rules, err := e.store.RiskRules().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list risk rules: %w", err)
+	}
+
+	a := &Assessment{Decision: models.RiskDecisionAllow}
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		matched, err := e.match(ctx, rule, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate risk rule %s: %w", rule.Id, err)
+		}
+		if !matched {
+			continue
+		}
+
+		a.Rules = append(a.Rules, rule.Id)
+		a.Score += rule.Score
+		if rule.Action.Severer(a.Decision) {
+			a.Decision = rule.Action
+		}
+	}
+	if a.Score > MaxScore {
+		a.Score = MaxScore
+	}
+	return a, nil
+}
+
+func (e *engineImpl) match(ctx context.Context, rule *models.RiskRule, p *models.Payment) (bool, error) {
+	params := &rule.Params
+	switch rule.Kind {
+	case models.RiskRuleVelocity:
+		return e.matchVelocity(ctx, params, p)
+	case models.RiskRuleAmount:
+		return strings.EqualFold(params.Currency, p.Currency) && p.Amount >= params.MinAmount, nil
+	case models.RiskRuleBinCountry:
+		return contains(params.Countries, e.bins.Country(p.CardNumber)), nil
+	case models.RiskRuleCardBlocklist:
+		return contains(params.Fingerprints, p.CardFingerprint), nil
+	default:
+		return false, fmt.Errorf("unknown kind %q", rule.Kind)
+	}
+}
+
+// matchVelocity returns true if more than MaxCount payments with the same card or client IP as the payment,
+// including the payment itself, were created within the window.
+func (e *engineImpl) matchVelocity(ctx context.Context, params *models.RiskRuleParams, p *models.Payment) (bool, error) {
+	since := e.now().Add(-params.Window())
+
+	var (
+		n   int
+		err error
+	)
+	switch params.Key {
+	case models.RiskVelocityCard:
+		if p.CardFingerprint == "" {
+			return false, nil
+		}
+		n, err = e.store.Payments().CountByCardFingerprint(ctx, p.CardFingerprint, since)
+	case models.RiskVelocityClientIp:
+		if p.ClientIp == "" {
+			return false, nil
+		}
+		n, err = e.store.Payments().CountByClientIp(ctx, p.ClientIp, since)
+	default:
+		return false, fmt.Errorf("unknown velocity key %q", params.Key)
+	}
+	if err != nil {
+		return false, err
+	}
+	return n > params.MaxCount, nil
+}
+
+func contains(values []string, v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
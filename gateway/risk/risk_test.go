@@ -0,0 +1,123 @@
+package risk
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"testing"
+	"time"
+)
+
+// fingerprintKey is the key of the card fingerprints of the test payments and rules.
+var fingerprintKey = []byte("secret")
+
+// createPayment creates a payment with the fingerprint and the client IP the rules are evaluated against.
+func createPayment(t *testing.T, s store.Store, cardNumber string, amount int64) *models.Payment {
+	return storetest.CreatePayment(t, s.Payments(), storetest.WithCardNumber(cardNumber), storetest.WithAmount(amount),
+		func(p *models.Payment) {
+			p.CardFingerprint = cards.Fingerprint(fingerprintKey, cardNumber)
+			p.ClientIp = "192.0.2.1"
+		})
+}
+
+func saveRule(t *testing.T, s store.Store, rule models.RiskRule) {
+	rule.Enabled = true
+	require.NoError(t, s.RiskRules().Save(context.Background(), &rule))
+}
+
+func TestEngine_Assess(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	e := New(s)
+
+	saveRule(t, s, models.RiskRule{Id: "amount", Kind: models.RiskRuleAmount, Action: models.RiskDecisionForce3ds, Score: 30,
+		Params: models.RiskRuleParams{Currency: "EUR", MinAmount: 10000}})
+	saveRule(t, s, models.RiskRule{Id: "country", Kind: models.RiskRuleBinCountry, Action: models.RiskDecisionReview, Score: 50,
+		Params: models.RiskRuleParams{Countries: []string{"FR"}}})
+	saveRule(t, s, models.RiskRule{Id: "blocklist", Kind: models.RiskRuleCardBlocklist, Action: models.RiskDecisionBlock, Score: 90,
+		Params: models.RiskRuleParams{Fingerprints: []string{cards.Fingerprint(fingerprintKey, "4000002500000003")}}})
+
+	tests := []struct {
+		name       string
+		cardNumber string
+		amount     int64
+		want       Assessment
+	}{
+		{"no match", "4242424242424242", 100, Assessment{Decision: models.RiskDecisionAllow}},
+		{"amount", "4242424242424242", 10000, Assessment{Decision: models.RiskDecisionForce3ds, Score: 30, Rules: []string{"amount"}}},
+		{"most severe action", "4000002500000003", 10000, Assessment{Decision: models.RiskDecisionBlock, Score: 100,
+			Rules: []string{"amount", "country", "blocklist"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := createPayment(t, s, tt.cardNumber, tt.amount)
+			a, err := e.Assess(ctx, p)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Decision, a.Decision)
+			assert.Equal(t, tt.want.Score, a.Score)
+			assert.ElementsMatch(t, tt.want.Rules, a.Rules)
+		})
+	}
+}
+
+func TestEngine_Assess_binTable(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	e := New(s, WithBinTable(cards.BinTable{"4571": "DK"}))
+
+	saveRule(t, s, models.RiskRule{Id: "country", Kind: models.RiskRuleBinCountry, Action: models.RiskDecisionReview, Score: 50,
+		Params: models.RiskRuleParams{Countries: []string{"DK"}}})
+
+	a, err := e.Assess(ctx, createPayment(t, s, "4571000000000001", 100))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"country"}, a.Rules)
+
+	a, err = e.Assess(ctx, createPayment(t, s, "4000002080000001", 100))
+	require.NoError(t, err)
+	assert.Empty(t, a.Rules, "the test cards are not in the table")
+}
+
+func TestEngine_Assess_velocity(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	e := New(s)
+
+	saveRule(t, s, models.RiskRule{Id: "velocity", Kind: models.RiskRuleVelocity, Action: models.RiskDecisionBlock,
+		Params: models.RiskRuleParams{Key: models.RiskVelocityCard, MaxCount: 2, WindowSeconds: 3600}})
+
+	for i, want := range []models.RiskDecision{models.RiskDecisionAllow, models.RiskDecisionAllow, models.RiskDecisionBlock} {
+		p := createPayment(t, s, "4242424242424242", 100)
+		a, err := e.Assess(ctx, p)
+		require.NoError(t, err)
+		assert.Equal(t, want, a.Decision, "payment %d", i+1)
+	}
+
+	p := createPayment(t, s, "5555555555554444", 100)
+	a, err := e.Assess(ctx, p)
+	require.NoError(t, err)
+	assert.Equal(t, models.RiskDecisionAllow, a.Decision, "other cards must not be counted")
+
+	e.(*engineImpl).now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	a, err = e.Assess(ctx, p)
+	require.NoError(t, err)
+	assert.Equal(t, models.RiskDecisionAllow, a.Decision, "payments outside the window must not be counted")
+}
+
+func TestEngine_Assess_disabled(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	e := New(s)
+
+	rule := &models.RiskRule{Id: "amount", Kind: models.RiskRuleAmount, Action: models.RiskDecisionBlock,
+		Params: models.RiskRuleParams{Currency: "EUR"}}
+	require.NoError(t, s.RiskRules().Save(ctx, rule))
+
+	a, err := e.Assess(ctx, createPayment(t, s, "4242424242424242", 100))
+	require.NoError(t, err)
+	assert.Equal(t, models.RiskDecisionAllow, a.Decision)
+}
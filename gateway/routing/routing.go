@@ -0,0 +1,197 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/models"
+	"strings"
+)
+
+// ErrUnknownAcquirer is returned when no acquirer is registered under the requested name.
+var ErrUnknownAcquirer = errors.New("unknown acquirer")
+
+// Rule routes the payments it matches to the given acquirers. Empty conditions match any payment.
+type Rule struct {
+	// Currencies are the ISO 4217 codes of the payment currencies.
+	Currencies []string `json:"currencies,omitempty"`
+	// Brands are the card brands (see cards.Brand), e.g. "visa" or "mastercard".
+	Brands []string `json:"brands,omitempty"`
+	// Countries are the ISO 3166 codes of the card issuer countries, as implied by the card BIN (see WithBinTable).
+	Countries []string `json:"countries,omitempty"`
+	// MinAmount and MaxAmount are the inclusive bounds of the payment amount, zero MaxAmount is unbounded.
+	MinAmount int64 `json:"min_amount,omitempty"`
+	MaxAmount int64 `json:"max_amount,omitempty"`
+
+	// Acquirers are the names of the acquirers to process the payment with: the primary one first,
+	// followed by the ones to fail over to.
+	Acquirers []string `json:"acquirers"`
+}
+
+// Match returns true if the payment satisfies all conditions of the rule.
+// The issuer country of the card is looked up in the given BIN table.
+func (r *Rule) Match(p *models.Payment, bins cards.BinTable) bool {
+	switch {
+	case len(r.Currencies) > 0 && !contains(r.Currencies, p.Currency):
+		return false
+	case len(r.Brands) > 0 && !contains(r.Brands, string(cards.BrandOf(p.CardNumber))):
+		return false
+	case len(r.Countries) > 0 && !contains(r.Countries, bins.Country(p.CardNumber)):
+		return false
+	case p.Amount < r.MinAmount:
+		return false
+	case r.MaxAmount > 0 && p.Amount > r.MaxAmount:
+		return false
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router keeps the acquirers registered by name and selects the ones to process a payment with.
+type Router interface {
+	// Acquirer returns the acquirer registered under the given name.
+	Acquirer(name string) (acquiring.AcquirerAdapter, error)
+	// Names returns the names of the registered acquirers in the order of registration.
+	Names() []string
+	// Route returns the names of the acquirers to process the payment with, the primary one first.
+	// The route of the first matching rule is used, or the default route if none matches.
+	Route(p *models.Payment) []string
+	// Failover returns the name of the acquirer that follows the current acquirer of the payment in its route,
+	// or false if there is none.
+	Failover(p *models.Payment) (string, bool)
+}
+
+type routerImpl struct {
+	acquirers    map[string]acquiring.AcquirerAdapter
+	names        []string
+	rules        []Rule
+	defaultRoute []string
+	bins         cards.BinTable
+}
+
+// Option configures the Router.
+type Option func(*routerImpl)
+
+// WithAcquirer registers the acquirer under the given name.
+func WithAcquirer(name string, acq acquiring.AcquirerAdapter) Option {
+	return func(r *routerImpl) {
+		if _, ok := r.acquirers[name]; !ok {
+			r.names = append(r.names, name)
+		}
+		r.acquirers[name] = acq
+	}
+}
+
+// WithRules appends routing rules, which are matched in order.
+func WithRules(rules ...Rule) Option {
+	return func(r *routerImpl) {
+		r.rules = append(r.rules, rules...)
+	}
+}
+
+// WithDefaultRoute sets the acquirers of the payments that match no rule.
+// By default, these are all registered acquirers in the order of registration.
+func WithDefaultRoute(names ...string) Option {
+	return func(r *routerImpl) {
+		r.defaultRoute = names
+	}
+}
+
+// WithBinTable sets the table the issuer countries of the cards are looked up in.
+// By default, it is cards.TestBins, which only covers the acquirer simulator test cards.
+func WithBinTable(t cards.BinTable) Option {
+	return func(r *routerImpl) {
+		r.bins = t
+	}
+}
+
+// New creates a new Router. Returns an error if no acquirers are registered,
+// or a route refers to an acquirer that is not registered.
+func New(opts ...Option) (Router, error) {
+	r := &routerImpl{
+		acquirers: make(map[string]acquiring.AcquirerAdapter),
+		bins:      cards.TestBins,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	if len(r.names) == 0 {
+		return nil, fmt.Errorf("no acquirers are registered")
+	}
+	if len(r.defaultRoute) == 0 {
+		r.defaultRoute = r.names
+	}
+
+	if err := r.validate(r.defaultRoute); err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+	for i := range r.rules {
+		if err := r.validate(r.rules[i].Acquirers); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *routerImpl) validate(route []string) error {
+	if len(route) == 0 {
+		return fmt.Errorf("no acquirers in the route")
+	}
+	seen := make(map[string]bool)
+	for _, name := range route {
+		if _, ok := r.acquirers[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownAcquirer, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("acquirer %s is repeated in the route", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// Acquirer returns the acquirer registered under the given name, or ErrUnknownAcquirer.
+func (r *routerImpl) Acquirer(name string) (acquiring.AcquirerAdapter, error) {
+	acq, ok := r.acquirers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAcquirer, name)
+	}
+	return acq, nil
+}
+
+// Names returns the names of the registered acquirers in the order of registration.
+func (r *routerImpl) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// Route returns the names of the acquirers to process the payment with, the primary one first.
+func (r *routerImpl) Route(p *models.Payment) []string {
+	for i := range r.rules {
+		if r.rules[i].Match(p, r.bins) {
+			return r.rules[i].Acquirers
+		}
+	}
+	return r.defaultRoute
+}
+
+// Failover returns the name of the acquirer that follows the current acquirer of the payment in its route.
+// There is none if the current acquirer is the last one, or it is no longer in the route of the payment.
+func (r *routerImpl) Failover(p *models.Payment) (string, bool) {
+	route := r.Route(p)
+	for i, name := range route {
+		if name == p.Acquirer && i+1 < len(route) {
+			return route[i+1], true
+		}
+	}
+	return "", false
+}
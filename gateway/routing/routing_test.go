@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring/simulator"
+	"mkuznets.com/go/upsp/gateway/cards"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/money"
+	"testing"
+)
+
+func newTestRouter(t *testing.T, opts ...Option) Router {
+	opts = append([]Option{
+		WithAcquirer("a", simulator.New(acquirer.New(acquirer.NewStore()))),
+		WithAcquirer("b", simulator.New(acquirer.New(acquirer.NewStore()))),
+		WithAcquirer("c", simulator.New(acquirer.New(acquirer.NewStore()))),
+	}, opts...)
+	r, err := New(opts...)
+	require.NoError(t, err)
+	return r
+}
+
+func TestRouter_Route(t *testing.T) {
+	r := newTestRouter(t, WithRules(
+		Rule{Currencies: []string{"usd"}, Acquirers: []string{"b"}},
+		Rule{Brands: []string{"mastercard"}, Acquirers: []string{"c", "a"}},
+		Rule{Countries: []string{"GB", "DE"}, Acquirers: []string{"c"}},
+		Rule{MinAmount: 1000, MaxAmount: 5000, Acquirers: []string{"b", "c"}},
+	))
+
+	tests := []struct {
+		name    string
+		payment *models.Payment
+		route   []string
+	}{
+		{"currency", &models.Payment{Money: money.New(100, "USD"), CardNumber: "5555555555554444"}, []string{"b"}},
+		{"brand", &models.Payment{Money: money.New(100, "EUR"), CardNumber: "5555555555554444"}, []string{"c", "a"}},
+		{"bin country", &models.Payment{Money: money.New(100, "EUR"), CardNumber: "4000008260000000"}, []string{"c"}},
+		{"amount", &models.Payment{Money: money.New(1000, "EUR"), CardNumber: "4242424242424242"}, []string{"b", "c"}},
+		{"default", &models.Payment{Money: money.New(5001, "EUR"), CardNumber: "4242424242424242"}, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.route, r.Route(tt.payment))
+		})
+	}
+}
+
+func TestRouter_Route_binTable(t *testing.T) {
+	r := newTestRouter(t, WithBinTable(cards.BinTable{"4571": "DK"}),
+		WithRules(Rule{Countries: []string{"DK"}, Acquirers: []string{"c"}}))
+
+	assert.Equal(t, []string{"c"}, r.Route(&models.Payment{Money: money.New(100, "DKK"), CardNumber: "4571000000000001"}))
+	assert.Equal(t, []string{"a", "b", "c"}, r.Route(&models.Payment{Money: money.New(100, "DKK"), CardNumber: "4242424242424242"}),
+		"the test cards are not in the table")
+}
+
+func TestRouter_Failover(t *testing.T) {
+	r := newTestRouter(t, WithDefaultRoute("b", "a"))
+
+	next, ok := r.Failover(&models.Payment{Acquirer: "b"})
+	assert.True(t, ok)
+	assert.Equal(t, "a", next)
+
+	_, ok = r.Failover(&models.Payment{Acquirer: "a"})
+	assert.False(t, ok, "last acquirer of the route")
+
+	_, ok = r.Failover(&models.Payment{Acquirer: "c"})
+	assert.False(t, ok, "acquirer is not in the route")
+}
+
+func TestRouter_Acquirer(t *testing.T) {
+	r := newTestRouter(t)
+	assert.Equal(t, []string{"a", "b", "c"}, r.Names())
+
+	_, err := r.Acquirer("a")
+	assert.NoError(t, err)
+	_, err = r.Acquirer("d")
+	assert.ErrorIs(t, err, ErrUnknownAcquirer)
+}
+
+func TestNew_Invalid(t *testing.T) {
+	acq := simulator.New(acquirer.New(acquirer.NewStore()))
+	cases := map[string][]Option{
+		"no acquirers":      nil,
+		"unknown default":   {WithAcquirer("a", acq), WithDefaultRoute("b")},
+		"unknown in rule":   {WithAcquirer("a", acq), WithRules(Rule{Acquirers: []string{"a", "b"}})},
+		"empty rule route":  {WithAcquirer("a", acq), WithRules(Rule{Currencies: []string{"EUR"}})},
+		"repeated acquirer": {WithAcquirer("a", acq), WithRules(Rule{Acquirers: []string{"a", "a"}})},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(opts...)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package settlement
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"strings"
+	"time"
+)
+
+// Reconciler is a service that ingests acquirer settlement reports and reconciles them against gateway payments.
+// It works both as a synchronous reconciler and as a background worker.
+type Reconciler interface {
+	Start(ctx context.Context)
+	Reconcile(ctx context.Context) error
+}
+
+type reconcilerImpl struct {
+	s      store.Store
+	router routing.Router
+}
+
+// New creates a new Reconciler of the settlement reports of all acquirers registered in the router.
+func New(s store.Store, router routing.Router) Reconciler {
+	return &reconcilerImpl{
+		s:      s,
+		router: router,
+	}
+}
+
+// Start initiates a background worker that regularly ingests new settlement reports.
+func (r *reconcilerImpl) Start(ctx context.Context) {
+	for {
+		if err := r.Reconcile(ctx); err != nil {
+			log.Printf("[ERR] settlement reconciliation failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// Reconcile ingests all settlement batches of every acquirer that have not been ingested yet, matches their lines
+// to gateway payments, and flags gateway payments that should have been settled but were not.
+// A failure of one acquirer does not prevent the others from being reconciled.
+func (r *reconcilerImpl) Reconcile(ctx context.Context) error {
+	var errs []string
+	for _, name := range r.router.Names() {
+		if err := r.reconcile(ctx, name); err != nil {
+			errs = append(errs, fmt.Sprintf("acquirer %s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reconcile ingests the settlement batches of a single acquirer and flags its payments that have not been settled.
+func (r *reconcilerImpl) reconcile(ctx context.Context, name string) error {
+	acq, err := r.router.Acquirer(name)
+	if err != nil {
+		return err
+	}
+
+	batches, err := acq.ListSettlementBatches(ctx)
+	if err != nil {
+		return err
+	}
+
+	var lastCutoff time.Time
+	for _, b := range batches {
+		if b.CutoffAt.After(lastCutoff) {
+			lastCutoff = b.CutoffAt
+		}
+
+		_, err := r.s.Settlements().GetBatch(ctx, b.Id)
+		switch {
+		case err == nil:
+			continue
+		case err != store.ErrNotFound:
+			return err
+		}
+
+		if err := r.ingest(ctx, acq, b); err != nil {
+			return fmt.Errorf("could not ingest settlement batch %s: %w", b.Id, err)
+		}
+	}
+
+	if lastCutoff.IsZero() {
+		return nil
+	}
+	return r.s.Settlements().DetectMissing(ctx, name, lastCutoff)
+}
+
+func (r *reconcilerImpl) ingest(ctx context.Context, acq acquiring.AcquirerAdapter, b *acquiring.SettlementBatch) error {
+	entries, err := acq.GetSettlementEntries(ctx, b.Id)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]*models.SettlementLine, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, &models.SettlementLine{
+			BatchId:     e.BatchId,
+			AcquiringId: e.PaymentId,
+			Type:        models.SettlementEntryType(e.Type),
+			Currency:    e.Currency,
+			Amount:      e.Amount,
+			Fee:         e.Fee,
+			Net:         e.Net,
+			CreatedAt:   e.CreatedAt,
+		})
+	}
+
+	// Lines are matched against the lines settled before, so concurrent ingestions of batches that settle
+	// the same payment must be serialised not to miss duplicates.
+	return r.s.Tx(ctx, func(ctx context.Context) error {
+		seen := make(map[string]bool)
+		for _, line := range lines {
+			if err := r.match(ctx, line, seen); err != nil {
+				return err
+			}
+		}
+
+		return r.s.Settlements().CreateBatch(ctx, &models.SettlementBatch{
+			Id:       b.Id,
+			Date:     b.Date,
+			Currency: b.Currency,
+			CutoffAt: b.CutoffAt,
+			Gross:    b.Gross,
+			Fees:     b.Fees,
+			Net:      b.Net,
+			Lines:    lines,
+		})
+	}, store.WithIsolation(store.Serializable))
+}
+
+// match sets the payment ID and the reconciliation status of the settlement line.
+func (r *reconcilerImpl) match(ctx context.Context, line *models.SettlementLine, seen map[string]bool) error {
+	p, err := r.s.Payments().GetByAcquiringId(ctx, line.AcquiringId)
+	switch {
+	case err == store.ErrNotFound:
+		line.Status = models.SettlementStatusUnknownPayment
+		return nil
+	case err != nil:
+		return err
+	}
+	line.PaymentId = p.Id
+
+	key := line.AcquiringId + "/" + string(line.Type)
+	n, err := r.s.Settlements().CountLines(ctx, line.AcquiringId, line.Type)
+	if err != nil {
+		return err
+	}
+	if n > 0 || seen[key] {
+		line.Status = models.SettlementStatusDuplicate
+		return nil
+	}
+	seen[key] = true
+
+	if !strings.EqualFold(line.Currency, p.Currency) {
+		line.Status = models.SettlementStatusCurrencyMismatch
+		return nil
+	}
+
+	expected := p.Amount
+	if line.Type != models.SettlementEntryPayment {
+		expected = -p.Amount
+	}
+	if line.Amount != expected {
+		line.Status = models.SettlementStatusAmountMismatch
+		return nil
+	}
+
+	line.Status = models.SettlementStatusMatched
+	return nil
+}
@@ -0,0 +1,128 @@
+package settlement
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"testing"
+	"time"
+)
+
+// fakeAcquirer serves a fixed settlement report. Other adapter methods are not used by the reconciler.
+type fakeAcquirer struct {
+	acquiring.AcquirerAdapter
+	batches []*acquiring.SettlementBatch
+	entries map[string][]*acquiring.SettlementEntry
+}
+
+func (a *fakeAcquirer) ListSettlementBatches(ctx context.Context) ([]*acquiring.SettlementBatch, error) {
+	return a.batches, nil
+}
+
+func (a *fakeAcquirer) GetSettlementEntries(ctx context.Context, batchId string) ([]*acquiring.SettlementEntry, error) {
+	return a.entries[batchId], nil
+}
+
+// createPayment creates a paid payment with the given acquirer payment id.
+func createPayment(t *testing.T, s store.Store, acquiringId string) *models.Payment {
+	return storetest.CreatePayment(t, s.Payments(), storetest.WithAmount(1000), storetest.WithState(models.PaymentStateActionPaid),
+		func(p *models.Payment) {
+			p.Acquirer = "simulator"
+			p.AcquiringId = acquiringId
+		})
+}
+
+func TestReconciler_Reconcile(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+
+	matched := createPayment(t, s, "acq-matched")
+	duplicate := createPayment(t, s, "acq-duplicate")
+	createPayment(t, s, "acq-amount")
+	createPayment(t, s, "acq-currency")
+
+	cutoff := time.Now().UTC().Add(-time.Hour)
+	entry := func(batchId, paymentId, currency string, amount int64) *acquiring.SettlementEntry {
+		return &acquiring.SettlementEntry{
+			BatchId:   batchId,
+			PaymentId: paymentId,
+			Type:      acquiring.SettlementEntryPayment,
+			Currency:  currency,
+			Amount:    amount,
+			Net:       amount,
+			CreatedAt: cutoff.Add(-time.Hour),
+		}
+	}
+
+	acq := &fakeAcquirer{
+		batches: []*acquiring.SettlementBatch{
+			{Id: "batch-1", Currency: "EUR", CutoffAt: cutoff.Add(-24 * time.Hour)},
+			{Id: "batch-2", Currency: "EUR", CutoffAt: cutoff},
+		},
+		entries: map[string][]*acquiring.SettlementEntry{
+			"batch-1": {
+				entry("batch-1", "acq-matched", "EUR", 1000),
+				entry("batch-1", "acq-duplicate", "EUR", 1000),
+			},
+			"batch-2": {
+				entry("batch-2", "acq-duplicate", "EUR", 1000),
+				entry("batch-2", "acq-amount", "EUR", 999),
+				entry("batch-2", "acq-currency", "JPY", 1000),
+				entry("batch-2", "acq-unknown", "EUR", 1000),
+			},
+		},
+	}
+
+	router, err := routing.New(routing.WithAcquirer("simulator", acq))
+	require.NoError(t, err)
+	r := New(s, router)
+
+	require.NoError(t, r.Reconcile(ctx))
+
+	lines, err := s.Settlements().ListUnmatchedLines(ctx)
+	require.NoError(t, err)
+
+	statuses := make(map[string]models.SettlementStatus)
+	for _, line := range lines {
+		statuses[line.AcquiringId] = line.Status
+	}
+	assert.Equal(t, map[string]models.SettlementStatus{
+		"acq-duplicate": models.SettlementStatusDuplicate,
+		"acq-amount":    models.SettlementStatusAmountMismatch,
+		"acq-currency":  models.SettlementStatusCurrencyMismatch,
+		"acq-unknown":   models.SettlementStatusUnknownPayment,
+	}, statuses)
+
+	for _, line := range lines {
+		if line.AcquiringId == "acq-duplicate" {
+			assert.Equal(t, "batch-2", line.BatchId)
+			assert.Equal(t, duplicate.Id, line.PaymentId)
+		}
+	}
+
+	n, err := s.Settlements().CountLines(ctx, matched.AcquiringId, models.SettlementEntryPayment)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	batches, err := s.Settlements().ListBatches(ctx)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	assert.Equal(t, "batch-2", batches[0].Id)
+	assert.Equal(t, 4, batches[0].LineCount)
+	assert.Equal(t, 0, batches[0].MatchedCount)
+	assert.Equal(t, "batch-1", batches[1].Id)
+	assert.Equal(t, 2, batches[1].MatchedCount)
+
+	t.Run("idempotent", func(t *testing.T) {
+		require.NoError(t, r.Reconcile(ctx))
+
+		again, err := s.Settlements().ListUnmatchedLines(ctx)
+		require.NoError(t, err)
+		assert.Len(t, again, len(lines))
+	})
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+// Discrepancies is an interface for accessing state discrepancies between gateway and acquirer payments.
+type Discrepancies interface {
+	Create(ctx context.Context, discrepancy *models.Discrepancy) error
+	List(ctx context.Context, status models.DiscrepancyStatus) ([]*models.Discrepancy, error)
+}
+
+type discrepanciesImpl struct {
+	s *storeImpl
+}
+
+// Create persists a new discrepancy. An unrepaired discrepancy that has already been recorded
+// for the same payment with the same kind and status is not recorded again.
+func (d *discrepanciesImpl) Create(ctx context.Context, discrepancy *models.Discrepancy) error {
+	discrepancy.DetectedAt = time.Now().UTC()
+
+	_, err := d.s.querier(ctx).Exec(ctx, `
+		INSERT INTO payment_discrepancies (payment_id, kind, status, details, state, acquiring_id, acquiring_state, acquiring_version, acquirer_state, acquirer_version, detected_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (payment_id, kind, status) WHERE status <> 'repaired' DO NOTHING;
+		`,
+		discrepancy.PaymentId,
+		discrepancy.Kind,
+		discrepancy.Status,
+		discrepancy.Details,
+		discrepancy.State,
+		discrepancy.AcquiringId,
+		discrepancy.AcquiringState,
+		discrepancy.AcquiringVersion,
+		discrepancy.AcquirerState,
+		discrepancy.AcquirerVersion,
+		discrepancy.DetectedAt,
+	)
+	return err
+}
+
+// List returns all discrepancies with the given status, most recent first.
+func (d *discrepanciesImpl) List(ctx context.Context, status models.DiscrepancyStatus) ([]*models.Discrepancy, error) {
+	rows, err := d.s.querier(ctx).Query(ctx, `
+		SELECT id, payment_id, kind, status, details, state, acquiring_id, acquiring_state, acquiring_version, acquirer_state, acquirer_version, detected_at
+		FROM payment_discrepancies
+		WHERE status = $1
+		ORDER BY detected_at DESC;
+		`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var discrepancies []*models.Discrepancy
+	for rows.Next() {
+		var m models.Discrepancy
+		err := rows.Scan(
+			&m.Id,
+			&m.PaymentId,
+			&m.Kind,
+			&m.Status,
+			&m.Details,
+			&m.State,
+			&m.AcquiringId,
+			&m.AcquiringState,
+			&m.AcquiringVersion,
+			&m.AcquirerState,
+			&m.AcquirerVersion,
+			&m.DetectedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		discrepancies = append(discrepancies, &m)
+	}
+	return discrepancies, rows.Err()
+}
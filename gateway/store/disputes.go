@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+// Disputes is an interface for accessing gateway disputes.
+type Disputes interface {
+	Create(ctx context.Context, dispute *models.Dispute) (string, error)
+	Get(ctx context.Context, id string) (*models.Dispute, error)
+	GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Dispute, error)
+	List(ctx context.Context) ([]*models.Dispute, error)
+	Update(ctx context.Context, id string, op func(dispute *models.Dispute) error) error
+}
+
+type disputesImpl struct {
+	s *storeImpl
+}
+
+const disputeColumns = `id, payment_id, state, reason, amount, currency, evidence, evidence_due_by, acquiring_id, acquiring_state, acquiring_version, created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDispute(row scanner) (*models.Dispute, error) {
+	var dispute models.Dispute
+	err := row.Scan(
+		&dispute.Id,
+		&dispute.PaymentId,
+		&dispute.State,
+		&dispute.Reason,
+		&dispute.Amount,
+		&dispute.Currency,
+		&dispute.Evidence,
+		&dispute.EvidenceDueBy,
+		&dispute.AcquiringId,
+		&dispute.AcquiringState,
+		&dispute.AcquiringVersion,
+		&dispute.CreatedAt,
+		&dispute.UpdatedAt,
+	)
+	return &dispute, err
+}
+
+// Create persists a new dispute model.
+func (d *disputesImpl) Create(ctx context.Context, dispute *models.Dispute) (string, error) {
+	var id string
+
+	err := d.s.querier(ctx).QueryRow(ctx, `
+		INSERT INTO disputes (id, payment_id, state, reason, amount, currency, evidence, evidence_due_by, acquiring_id, acquiring_state, acquiring_version, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id;
+		`,
+		dispute.Id,
+		dispute.PaymentId,
+		dispute.State,
+		dispute.Reason,
+		dispute.Amount,
+		dispute.Currency,
+		dispute.Evidence,
+		dispute.EvidenceDueBy,
+		dispute.AcquiringId,
+		dispute.AcquiringState,
+		dispute.AcquiringVersion,
+		time.Now().UTC(),
+		time.Now().UTC(),
+	).Scan(&id)
+
+	return id, err
+}
+
+// Get returns a dispute model by ID.
+func (d *disputesImpl) Get(ctx context.Context, id string) (*models.Dispute, error) {
+	return scanDispute(d.s.querier(ctx).QueryRow(ctx, `SELECT `+disputeColumns+` FROM disputes WHERE id = $1;`, id))
+}
+
+// GetByAcquiringId returns a dispute model by the ID of the acquirer dispute.
+func (d *disputesImpl) GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Dispute, error) {
+	return scanDispute(d.s.querier(ctx).QueryRow(ctx, `SELECT `+disputeColumns+` FROM disputes WHERE acquiring_id = $1;`, acquiringId))
+}
+
+// List returns all disputes, most recent first.
+func (d *disputesImpl) List(ctx context.Context) ([]*models.Dispute, error) {
+	rows, err := d.s.querier(ctx).Query(ctx, `SELECT `+disputeColumns+` FROM disputes ORDER BY created_at DESC;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var disputes []*models.Dispute
+	for rows.Next() {
+		dispute, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, dispute)
+	}
+	return disputes, rows.Err()
+}
+
+// Update mutates a dispute by ID using the given op function.
+func (d *disputesImpl) Update(ctx context.Context, id string, op func(dispute *models.Dispute) error) error {
+	dispute, err := d.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err = op(dispute); err != nil {
+		return err
+	}
+
+	_, err = d.s.querier(ctx).Exec(ctx, `
+		UPDATE disputes
+		SET state = $2,
+			evidence = $3,
+			evidence_due_by = $4,
+			acquiring_state = $5,
+			acquiring_version = $6,
+			updated_at = $7
+		WHERE id = $1;
+		`,
+		dispute.Id,
+		dispute.State,
+		dispute.Evidence,
+		dispute.EvidenceDueBy,
+		dispute.AcquiringState,
+		dispute.AcquiringVersion,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
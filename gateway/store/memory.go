@@ -0,0 +1,281 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"sync"
+	"time"
+)
+
+// memListenerBuffer is the number of notifications a listener of the in-memory store may fall behind by.
+// Further notifications are dropped, like those sent while a Postgres listener reconnects.
+const memListenerBuffer = 1024
+
+// memData is the state of the in-memory store. Transactions work on a copy of it.
+type memData struct {
+	payments      map[string]models.Payment
+	disputes      map[string]models.Dispute
+	merchants     map[string]models.Merchant
+	riskRules     map[string]models.RiskRule
+	discrepancies []models.Discrepancy
+	events        []models.PaymentEvent
+	batches       []models.SettlementBatch
+	lines         []models.SettlementLine
+	missing       []memMissingSettlement
+}
+
+// memMissingSettlement is a missing settlement entry, which is kept once resolved.
+type memMissingSettlement struct {
+	models.MissingSettlement
+	ResolvedAt *time.Time
+}
+
+func newMemData() *memData {
+	return &memData{
+		payments:  make(map[string]models.Payment),
+		disputes:  make(map[string]models.Dispute),
+		merchants: make(map[string]models.Merchant),
+		riskRules: make(map[string]models.RiskRule),
+	}
+}
+
+// clone returns a copy of the data that can be changed without affecting the original.
+// Objects are stored by value and are never changed in place, so copying the containers is enough.
+func (d *memData) clone() *memData {
+	c := &memData{
+		payments:      make(map[string]models.Payment, len(d.payments)),
+		disputes:      make(map[string]models.Dispute, len(d.disputes)),
+		merchants:     make(map[string]models.Merchant, len(d.merchants)),
+		riskRules:     make(map[string]models.RiskRule, len(d.riskRules)),
+		discrepancies: append([]models.Discrepancy(nil), d.discrepancies...),
+		events:        append([]models.PaymentEvent(nil), d.events...),
+		batches:       append([]models.SettlementBatch(nil), d.batches...),
+		lines:         append([]models.SettlementLine(nil), d.lines...),
+		missing:       append([]memMissingSettlement(nil), d.missing...),
+	}
+	for k, v := range d.payments {
+		c.payments[k] = v
+	}
+	for k, v := range d.disputes {
+		c.disputes[k] = v
+	}
+	for k, v := range d.merchants {
+		c.merchants[k] = v
+	}
+	for k, v := range d.riskRules {
+		c.riskRules[k] = v
+	}
+	return c
+}
+
+// memTx is a transaction of the in-memory store.
+type memTx struct {
+	data  *memData
+	hooks []func()
+}
+
+type memStore struct {
+	// mu serialises transactions, so every transaction sees the data committed by the previous ones.
+	mu   sync.Mutex
+	data *memData
+
+	locksMu sync.Mutex
+	locks   map[string]bool
+
+	listenersMu sync.Mutex
+	listeners   map[string]map[chan string]struct{}
+
+	payments      Payments
+	disputes      Disputes
+	settlements   Settlements
+	discrepancies Discrepancies
+	merchants     Merchants
+	riskRules     RiskRules
+	paymentEvents *memPaymentEvents
+}
+
+// NewMemory creates a new Store instance that keeps the data in memory.
+// It has the same transactional semantics as the Postgres store, but the data is lost when the process exits,
+// and only gateway instances in this process share it. Transactions are serialised.
+func NewMemory() Store {
+	s := &memStore{
+		data:      newMemData(),
+		locks:     make(map[string]bool),
+		listeners: make(map[string]map[chan string]struct{}),
+	}
+	s.paymentEvents = &memPaymentEvents{s: s}
+	s.payments = &memPayments{s: s, events: s.paymentEvents, notifier: newNotifier()}
+	s.disputes = &memDisputes{s: s}
+	s.settlements = &memSettlements{s: s}
+	s.discrepancies = &memDiscrepancies{s: s}
+	s.merchants = &memMerchants{s: s}
+	s.riskRules = &memRiskRules{s: s}
+	return s
+}
+
+// Payments returns an interface for accessing gateway payments.
+func (s *memStore) Payments() Payments {
+	return s.payments
+}
+
+// Disputes returns an interface for accessing gateway disputes.
+func (s *memStore) Disputes() Disputes {
+	return s.disputes
+}
+
+// Settlements returns an interface for accessing ingested settlement reports.
+func (s *memStore) Settlements() Settlements {
+	return s.settlements
+}
+
+// Discrepancies returns an interface for accessing state discrepancies between gateway and acquirer payments.
+func (s *memStore) Discrepancies() Discrepancies {
+	return s.discrepancies
+}
+
+// Merchants returns an interface for accessing merchant settings.
+func (s *memStore) Merchants() Merchants {
+	return s.merchants
+}
+
+// RiskRules returns an interface for accessing the fraud and risk rules applied to new payments.
+func (s *memStore) RiskRules() RiskRules {
+	return s.riskRules
+}
+
+// PaymentEvents returns an interface for accessing the history of payment state changes.
+func (s *memStore) PaymentEvents() PaymentEvents {
+	return s.paymentEvents
+}
+
+// Tx wraps the given op function in a transaction. The op may include multiple operations tied to the same Store instance.
+// The changes of the op are applied only if it succeeds. A Tx nested in another one is a savepoint:
+// if its op fails, only the changes of the op are discarded.
+// Transactions are serialised, so they are never retried and the isolation level option has no effect.
+func (s *memStore) Tx(ctx context.Context, op func(context.Context) error, _ ...TxOption) error {
+	if t := ctx.Value(dbContextKey("memtx")); t != nil {
+		parent := t.(*memTx)
+		sp := &memTx{data: parent.data.clone()}
+		if err := op(context.WithValue(ctx, dbContextKey("memtx"), sp)); err != nil {
+			return err
+		}
+		parent.data = sp.data
+		parent.hooks = append(parent.hooks, sp.hooks...)
+		return nil
+	}
+
+	tx := &memTx{}
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		tx.data = s.data.clone()
+		if err := op(context.WithValue(ctx, dbContextKey("memtx"), tx)); err != nil {
+			return err
+		}
+		s.data = tx.data
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	for _, fn := range tx.hooks {
+		fn()
+	}
+	return nil
+}
+
+// run calls fn with the data of the current transaction, or in a new transaction if there is none.
+func (s *memStore) run(ctx context.Context, fn func(d *memData) error) error {
+	return s.Tx(ctx, func(ctx context.Context) error {
+		return fn(s.txData(ctx))
+	})
+}
+
+// txData returns the data of the current transaction. Must be called in a transaction.
+func (s *memStore) txData(ctx context.Context) *memData {
+	return ctx.Value(dbContextKey("memtx")).(*memTx).data
+}
+
+// afterCommit runs the given function once the outermost transaction is committed,
+// or right away if there is no transaction. The function is not run if the transaction
+// or the savepoint it is registered in is rolled back.
+func (s *memStore) afterCommit(ctx context.Context, fn func()) {
+	t := ctx.Value(dbContextKey("memtx"))
+	if t == nil {
+		fn()
+		return
+	}
+	tx := t.(*memTx)
+	tx.hooks = append(tx.hooks, fn)
+}
+
+// WithLock runs the given op function holding a lock on the given key,
+// which makes the op exclusive among the users of this Store instance.
+// It does not wait for the lock: if it is held already, ErrLocked is returned.
+// As in the Postgres store, the lock cannot be taken within a transaction.
+func (s *memStore) WithLock(ctx context.Context, key string, op func(context.Context) error) error {
+	if ctx.Value(dbContextKey("memtx")) != nil {
+		return ErrLockInTx
+	}
+
+	s.locksMu.Lock()
+	if s.locks[key] {
+		s.locksMu.Unlock()
+		return ErrLocked
+	}
+	s.locks[key] = true
+	s.locksMu.Unlock()
+
+	defer func() {
+		s.locksMu.Lock()
+		delete(s.locks, key)
+		s.locksMu.Unlock()
+	}()
+
+	return op(ctx)
+}
+
+// notify sends the payload to the listeners of the channel once the current transaction is committed.
+func (s *memStore) notify(ctx context.Context, channel, payload string) {
+	s.afterCommit(ctx, func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+
+		for ch := range s.listeners[channel] {
+			select {
+			case ch <- payload:
+			default:
+				// The listener has fallen too far behind.
+			}
+		}
+	})
+}
+
+// listen calls fn with the payload of every notification sent to the given channel.
+// It blocks until the context is cancelled.
+func (s *memStore) listen(ctx context.Context, channel string, fn func(payload string)) error {
+	ch := make(chan string, memListenerBuffer)
+
+	s.listenersMu.Lock()
+	if s.listeners[channel] == nil {
+		s.listeners[channel] = make(map[chan string]struct{})
+	}
+	s.listeners[channel][ch] = struct{}{}
+	s.listenersMu.Unlock()
+
+	defer func() {
+		s.listenersMu.Lock()
+		delete(s.listeners[channel], ch)
+		s.listenersMu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case payload := <-ch:
+			fn(payload)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+type memDiscrepancies struct {
+	s *memStore
+}
+
+// Create persists a new discrepancy. An unrepaired discrepancy that has already been recorded
+// for the same payment with the same kind and status is not recorded again.
+func (m *memDiscrepancies) Create(ctx context.Context, discrepancy *models.Discrepancy) error {
+	discrepancy.DetectedAt = time.Now().UTC()
+
+	return m.s.run(ctx, func(d *memData) error {
+		if discrepancy.Status != models.DiscrepancyStatusRepaired {
+			for _, record := range d.discrepancies {
+				if record.PaymentId == discrepancy.PaymentId && record.Kind == discrepancy.Kind && record.Status == discrepancy.Status {
+					return nil
+				}
+			}
+		}
+
+		record := *discrepancy
+		record.Id = int64(len(d.discrepancies) + 1)
+		d.discrepancies = append(d.discrepancies, record)
+		return nil
+	})
+}
+
+// List returns all discrepancies with the given status, most recent first.
+func (m *memDiscrepancies) List(ctx context.Context, status models.DiscrepancyStatus) ([]*models.Discrepancy, error) {
+	var discrepancies []*models.Discrepancy
+	err := m.s.run(ctx, func(d *memData) error {
+		for i := len(d.discrepancies) - 1; i >= 0; i-- {
+			if record := d.discrepancies[i]; record.Status == status {
+				discrepancies = append(discrepancies, &record)
+			}
+		}
+		return nil
+	})
+	return discrepancies, err
+}
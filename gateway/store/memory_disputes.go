@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/models"
+	"sort"
+	"time"
+)
+
+type memDisputes struct {
+	s *memStore
+}
+
+// Create persists a new dispute model.
+func (m *memDisputes) Create(ctx context.Context, dispute *models.Dispute) (string, error) {
+	err := m.s.run(ctx, func(d *memData) error {
+		if _, ok := d.disputes[dispute.Id]; ok {
+			return fmt.Errorf("dispute %s already exists", dispute.Id)
+		}
+
+		now := time.Now().UTC()
+		record := *dispute
+		record.CreatedAt = now
+		record.UpdatedAt = now
+		d.disputes[dispute.Id] = record
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return dispute.Id, nil
+}
+
+// Get returns a dispute model by ID.
+func (m *memDisputes) Get(ctx context.Context, id string) (*models.Dispute, error) {
+	var dispute *models.Dispute
+	err := m.s.run(ctx, func(d *memData) error {
+		record, ok := d.disputes[id]
+		if !ok {
+			return ErrNotFound
+		}
+		dispute = &record
+		return nil
+	})
+	return dispute, err
+}
+
+// GetByAcquiringId returns a dispute model by the ID of the acquirer dispute.
+func (m *memDisputes) GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Dispute, error) {
+	var dispute *models.Dispute
+	err := m.s.run(ctx, func(d *memData) error {
+		for _, record := range d.disputes {
+			if record.AcquiringId == acquiringId {
+				record := record
+				dispute = &record
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return dispute, err
+}
+
+// List returns all disputes, most recent first.
+func (m *memDisputes) List(ctx context.Context) ([]*models.Dispute, error) {
+	var disputes []*models.Dispute
+	err := m.s.run(ctx, func(d *memData) error {
+		for _, record := range d.disputes {
+			record := record
+			disputes = append(disputes, &record)
+		}
+		return nil
+	})
+	sort.Slice(disputes, func(i, j int) bool {
+		return disputes[i].CreatedAt.After(disputes[j].CreatedAt)
+	})
+	return disputes, err
+}
+
+// Update mutates a dispute by ID using the given op function.
+func (m *memDisputes) Update(ctx context.Context, id string, op func(dispute *models.Dispute) error) error {
+	dispute, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err = op(dispute); err != nil {
+		return err
+	}
+
+	return m.s.run(ctx, func(d *memData) error {
+		record, ok := d.disputes[id]
+		if !ok {
+			return nil
+		}
+		record.State = dispute.State
+		record.Evidence = dispute.Evidence
+		record.EvidenceDueBy = dispute.EvidenceDueBy
+		record.AcquiringState = dispute.AcquiringState
+		record.AcquiringVersion = dispute.AcquiringVersion
+		record.UpdatedAt = time.Now().UTC()
+		d.disputes[id] = record
+		return nil
+	})
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+type memMerchants struct {
+	s *memStore
+}
+
+// Get returns a merchant by ID.
+func (m *memMerchants) Get(ctx context.Context, id string) (*models.Merchant, error) {
+	var merchant *models.Merchant
+	err := m.s.run(ctx, func(d *memData) error {
+		record, ok := d.merchants[id]
+		if !ok {
+			return ErrNotFound
+		}
+		merchant = &record
+		return nil
+	})
+	return merchant, err
+}
+
+// Save creates a merchant or updates the settings of an existing one.
+func (m *memMerchants) Save(ctx context.Context, merchant *models.Merchant) error {
+	return m.s.run(ctx, func(d *memData) error {
+		now := time.Now().UTC()
+		record, ok := d.merchants[merchant.Id]
+		if !ok {
+			record = models.Merchant{Id: merchant.Id, CreatedAt: now}
+		}
+		record.AsyncPayments = merchant.AsyncPayments
+		record.UpdatedAt = now
+		d.merchants[merchant.Id] = record
+
+		merchant.CreatedAt = record.CreatedAt
+		merchant.UpdatedAt = record.UpdatedAt
+		return nil
+	})
+}
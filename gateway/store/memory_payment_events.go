@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"strings"
+	"time"
+)
+
+type memPaymentEvents struct {
+	s *memStore
+}
+
+// create records the current state of the payment as a new event and notifies the listeners (see Listen).
+// The notification is delivered once the transaction that records the event is committed.
+// Must be called in a transaction. Transactions are serialised, so event IDs follow the commit order.
+func (e *memPaymentEvents) create(ctx context.Context, payment *models.Payment) error {
+	d := e.s.txData(ctx)
+	d.events = append(d.events, models.PaymentEvent{
+		Id:         int64(len(d.events) + 1),
+		PaymentId:  payment.Id,
+		MerchantId: payment.MerchantId,
+		State:      payment.State,
+		CreatedAt:  time.Now().UTC(),
+	})
+	e.s.notify(ctx, paymentEventsChannel, payment.Id+":"+payment.MerchantId)
+	return nil
+}
+
+// ListByPayment returns the events of the given payment with IDs greater than after, oldest first.
+func (e *memPaymentEvents) ListByPayment(ctx context.Context, paymentId string, after int64) ([]*models.PaymentEvent, error) {
+	return e.list(ctx, after, -1, func(event *models.PaymentEvent) bool {
+		return event.PaymentId == paymentId
+	})
+}
+
+// ListByMerchant returns up to limit events of the payments of the given merchant with IDs greater than after, oldest first.
+func (e *memPaymentEvents) ListByMerchant(ctx context.Context, merchantId string, after int64, limit int) ([]*models.PaymentEvent, error) {
+	return e.list(ctx, after, limit, func(event *models.PaymentEvent) bool {
+		return event.MerchantId == merchantId
+	})
+}
+
+// list returns up to limit events matching the filter with IDs greater than after, oldest first.
+// A negative limit means no limit.
+func (e *memPaymentEvents) list(ctx context.Context, after int64, limit int, filter func(event *models.PaymentEvent) bool) ([]*models.PaymentEvent, error) {
+	var events []*models.PaymentEvent
+	err := e.s.run(ctx, func(d *memData) error {
+		// Event IDs are their positions in the list, starting from one.
+		for i := int(after); i < len(d.events) && len(events) != limit; i++ {
+			event := d.events[i]
+			if filter(&event) {
+				events = append(events, &event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// LastId returns the ID of the most recent event, or zero if there are none.
+func (e *memPaymentEvents) LastId(ctx context.Context) (int64, error) {
+	var id int64
+	err := e.s.run(ctx, func(d *memData) error {
+		id = int64(len(d.events))
+		return nil
+	})
+	return id, err
+}
+
+// Listen calls fn with the payment and the merchant IDs of every committed event.
+// It blocks until the context is cancelled.
+func (e *memPaymentEvents) Listen(ctx context.Context, fn func(paymentId, merchantId string)) error {
+	return e.s.listen(ctx, paymentEventsChannel, func(payload string) {
+		paymentId, merchantId, _ := strings.Cut(payload, ":")
+		fn(paymentId, merchantId)
+	})
+}
@@ -0,0 +1,330 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/models"
+	"sort"
+	"time"
+)
+
+type memPayments struct {
+	s        *memStore
+	events   *memPaymentEvents
+	notifier *notifier
+}
+
+// copyPayment returns a copy of the payment that shares no memory with the original.
+func copyPayment(payment models.Payment) *models.Payment {
+	if payment.NextAttemptAt != nil {
+		next := *payment.NextAttemptAt
+		payment.NextAttemptAt = &next
+	}
+	return &payment
+}
+
+// Create persists a new payment model and records its initial state as a payment event.
+// If the payment is due for a transition attempt, a notification is sent to the transitioners (see ListenDue).
+func (p *memPayments) Create(ctx context.Context, payment *models.Payment) (string, error) {
+	next := nextAttemptAt(payment)
+	err := p.s.Tx(ctx, func(ctx context.Context) error {
+		d := p.s.txData(ctx)
+		if _, ok := d.payments[payment.Id]; ok {
+			return fmt.Errorf("payment %s already exists", payment.Id)
+		}
+
+		now := time.Now().UTC()
+		record := *copyPayment(*payment)
+		record.NextAttemptAt = next
+		record.Version = 1
+		record.CreatedAt = now
+		record.UpdatedAt = now
+		d.payments[payment.Id] = record
+		payment.Version = record.Version
+
+		if err := p.events.create(ctx, payment); err != nil {
+			return err
+		}
+
+		if isDue(next) {
+			p.s.notify(ctx, paymentsDueChannel, payment.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return payment.Id, nil
+}
+
+// Get returns a payment model by ID.
+func (p *memPayments) Get(ctx context.Context, id string) (*models.Payment, error) {
+	var payment *models.Payment
+	err := p.s.run(ctx, func(d *memData) error {
+		record, ok := d.payments[id]
+		if !ok {
+			return ErrNotFound
+		}
+		payment = copyPayment(record)
+		return nil
+	})
+	return payment, err
+}
+
+// GetByAcquiringId returns a payment model by the ID of the acquirer payment.
+func (p *memPayments) GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Payment, error) {
+	var payment *models.Payment
+	err := p.s.run(ctx, func(d *memData) error {
+		for _, record := range d.payments {
+			if record.AcquiringId == acquiringId {
+				payment = copyPayment(record)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return payment, err
+}
+
+// ClaimDue returns IDs of up to limit active payments that are due for a transition attempt, oldest first,
+// and postpones their next attempt by the lease duration, so that concurrent workers do not pick them up meanwhile.
+// Claiming does not change the payment version.
+func (p *memPayments) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]string, error) {
+	var ids []string
+	err := p.s.run(ctx, func(d *memData) error {
+		var due []models.Payment
+		for _, record := range d.payments {
+			if isDue(record.NextAttemptAt) {
+				due = append(due, record)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt)
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+
+		next := time.Now().UTC().Add(lease)
+		for _, record := range due {
+			record.NextAttemptAt = &next
+			d.payments[record.Id] = record
+			ids = append(ids, record.Id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// Claim postpones the next attempt of the given payment by the lease duration if the payment is due
+// for a transition attempt. It reports whether the payment was claimed.
+func (p *memPayments) Claim(ctx context.Context, id string, lease time.Duration) (bool, error) {
+	claimed := false
+	err := p.s.run(ctx, func(d *memData) error {
+		record, ok := d.payments[id]
+		if !ok || !isDue(record.NextAttemptAt) {
+			return nil
+		}
+		next := time.Now().UTC().Add(lease)
+		record.NextAttemptAt = &next
+		d.payments[id] = record
+		claimed = true
+		return nil
+	})
+	return claimed, err
+}
+
+// Reschedule sets the time of the next transition attempt of an active payment, unless the payment has changed
+// since the given version. Like claiming, rescheduling does not change the payment version.
+func (p *memPayments) Reschedule(ctx context.Context, id string, version int64, next time.Time) error {
+	return p.s.run(ctx, func(d *memData) error {
+		record, ok := d.payments[id]
+		if !ok || record.Version != version || record.NextAttemptAt == nil {
+			return nil
+		}
+		next := next.UTC()
+		record.NextAttemptAt = &next
+		d.payments[id] = record
+		return nil
+	})
+}
+
+// ListenDue calls fn with the ID of every payment that becomes due for a transition attempt immediately,
+// i.e. created or rescheduled to now. Notifications are delivered once the transaction that made the payment due
+// is committed. ListenDue blocks until the context is cancelled.
+func (p *memPayments) ListenDue(ctx context.Context, fn func(id string)) error {
+	return p.s.listen(ctx, paymentsDueChannel, fn)
+}
+
+// Watch returns a channel that receives a value when an update of the payment is committed,
+// and the function that stops watching.
+func (p *memPayments) Watch(id string) (<-chan struct{}, func()) {
+	return p.notifier.watch(id)
+}
+
+// ListByStates returns a list of IDs of payments in any of the given states.
+func (p *memPayments) ListByStates(ctx context.Context, states []models.PaymentState) ([]string, error) {
+	var payments []models.Payment
+	err := p.s.run(ctx, func(d *memData) error {
+		for _, record := range d.payments {
+			for _, state := range states {
+				if record.State == state {
+					payments = append(payments, record)
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+	ids := make([]string, 0, len(payments))
+	for _, payment := range payments {
+		ids = append(ids, payment.Id)
+	}
+	return ids, nil
+}
+
+// ListDeadLetter returns all payments the transitioner has given up on (see models.PaymentStateNeedsAttention),
+// oldest first.
+func (p *memPayments) ListDeadLetter(ctx context.Context) ([]*models.Payment, error) {
+	var payments []*models.Payment
+	err := p.s.run(ctx, func(d *memData) error {
+		for _, record := range d.payments {
+			if record.State == models.PaymentStateNeedsAttention {
+				payments = append(payments, copyPayment(record))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(payments, func(i, j int) bool {
+		return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+	})
+	return payments, nil
+}
+
+// ListActiveAcquirers returns the names of the acquirers that active payments are routed to, in alphabetical order.
+func (p *memPayments) ListActiveAcquirers(ctx context.Context) ([]string, error) {
+	var names []string
+	err := p.s.run(ctx, func(d *memData) error {
+		seen := make(map[string]bool)
+		for _, record := range d.payments {
+			if record.State.IsActive() && record.Acquirer != "" && !seen[record.Acquirer] {
+				seen[record.Acquirer] = true
+				names = append(names, record.Acquirer)
+			}
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// CountByCardFingerprint returns the number of payments with the given card fingerprint created since the given time.
+func (p *memPayments) CountByCardFingerprint(ctx context.Context, fingerprint string, since time.Time) (int, error) {
+	return p.count(ctx, since, func(record *models.Payment) bool {
+		return record.CardFingerprint == fingerprint
+	})
+}
+
+// CountByClientIp returns the number of payments requested from the given IP address since the given time.
+func (p *memPayments) CountByClientIp(ctx context.Context, ip string, since time.Time) (int, error) {
+	return p.count(ctx, since, func(record *models.Payment) bool {
+		return record.ClientIp == ip
+	})
+}
+
+func (p *memPayments) count(ctx context.Context, since time.Time, match func(record *models.Payment) bool) (int, error) {
+	n := 0
+	err := p.s.run(ctx, func(d *memData) error {
+		for _, record := range d.payments {
+			if !record.CreatedAt.Before(since) && match(&record) {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Update mutates a payment by ID using the given op function.
+// The update is a compare-and-swap: it is applied only if the payment has not been changed since it was read,
+// and fails with a ConflictError otherwise. With the ForUpdate option, the payment is read in the transaction
+// of the update, which the in-memory store serialises with all other transactions.
+// Watchers of the payment are notified once the update is committed (see Watch).
+// If the op changes the payment state, the new state is recorded as a payment event.
+// If the op makes the payment due for a transition attempt, a notification is sent to the transitioners (see ListenDue).
+func (p *memPayments) Update(ctx context.Context, id string, op func(payment *models.Payment) error, opts ...UpdateOption) error {
+	var o updateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.forUpdate {
+		return p.s.Tx(ctx, func(ctx context.Context) error {
+			return p.update(ctx, id, op, &o)
+		})
+	}
+	return p.update(ctx, id, op, &o)
+}
+
+func (p *memPayments) update(ctx context.Context, id string, op func(payment *models.Payment) error, o *updateOptions) error {
+	payment, err := p.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if o.version != nil && payment.Version != *o.version {
+		return &ConflictError{Id: id, Version: *o.version}
+	}
+	version := payment.Version
+	prevState := payment.State
+	wasDue := isDue(payment.NextAttemptAt)
+
+	if err = op(payment); err != nil {
+		return err
+	}
+
+	next := nextAttemptAt(payment)
+	return p.s.Tx(ctx, func(ctx context.Context) error {
+		d := p.s.txData(ctx)
+		current, ok := d.payments[id]
+		if !ok || current.Version != version {
+			return &ConflictError{Id: id, Version: version}
+		}
+
+		// The ID, the merchant, and the creation time cannot be updated.
+		record := *copyPayment(*payment)
+		record.Id = current.Id
+		record.MerchantId = current.MerchantId
+		record.CreatedAt = current.CreatedAt
+		record.NextAttemptAt = next
+		record.UpdatedAt = time.Now().UTC()
+		record.Version = version + 1
+		d.payments[id] = record
+		payment.Version = record.Version
+
+		if payment.State != prevState {
+			if err := p.events.create(ctx, payment); err != nil {
+				return err
+			}
+		}
+		p.s.afterCommit(ctx, func() {
+			p.notifier.notify(payment.Id)
+		})
+
+		if !wasDue && isDue(next) {
+			p.s.notify(ctx, paymentsDueChannel, payment.Id)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"sort"
+	"time"
+)
+
+type memRiskRules struct {
+	s *memStore
+}
+
+// List returns all risk rules in the order of creation.
+func (r *memRiskRules) List(ctx context.Context) ([]*models.RiskRule, error) {
+	var rules []*models.RiskRule
+	err := r.s.run(ctx, func(d *memData) error {
+		for _, record := range d.riskRules {
+			rules = append(rules, copyRiskRule(&record))
+		}
+		return nil
+	})
+	sort.Slice(rules, func(i, j int) bool {
+		if !rules[i].CreatedAt.Equal(rules[j].CreatedAt) {
+			return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+		}
+		return rules[i].Id < rules[j].Id
+	})
+	return rules, err
+}
+
+// Get returns a risk rule by ID.
+func (r *memRiskRules) Get(ctx context.Context, id string) (*models.RiskRule, error) {
+	var rule *models.RiskRule
+	err := r.s.run(ctx, func(d *memData) error {
+		record, ok := d.riskRules[id]
+		if !ok {
+			return ErrNotFound
+		}
+		rule = copyRiskRule(&record)
+		return nil
+	})
+	return rule, err
+}
+
+// Save creates a risk rule or replaces an existing one.
+func (r *memRiskRules) Save(ctx context.Context, rule *models.RiskRule) error {
+	return r.s.run(ctx, func(d *memData) error {
+		now := time.Now().UTC()
+		createdAt := now
+		if record, ok := d.riskRules[rule.Id]; ok {
+			createdAt = record.CreatedAt
+		}
+		rule.CreatedAt = createdAt
+		rule.UpdatedAt = now
+		d.riskRules[rule.Id] = *copyRiskRule(rule)
+		return nil
+	})
+}
+
+// Delete removes a risk rule by ID.
+func (r *memRiskRules) Delete(ctx context.Context, id string) error {
+	return r.s.run(ctx, func(d *memData) error {
+		if _, ok := d.riskRules[id]; !ok {
+			return ErrNotFound
+		}
+		delete(d.riskRules, id)
+		return nil
+	})
+}
+
+// copyRiskRule returns a copy of the rule that does not share the params lists with the original.
+func copyRiskRule(rule *models.RiskRule) *models.RiskRule {
+	c := *rule
+	c.Params.Countries = append([]string(nil), rule.Params.Countries...)
+	c.Params.Fingerprints = append([]string(nil), rule.Params.Fingerprints...)
+	return &c
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/models"
+	"sort"
+	"time"
+)
+
+type memSettlements struct {
+	s *memStore
+}
+
+// GetBatch returns an ingested settlement batch by the acquirer batch ID, without lines.
+func (st *memSettlements) GetBatch(ctx context.Context, id string) (*models.SettlementBatch, error) {
+	var batch *models.SettlementBatch
+	err := st.s.run(ctx, func(d *memData) error {
+		for _, record := range d.batches {
+			if record.Id == id {
+				batch = &record
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+	return batch, err
+}
+
+// CreateBatch persists an ingested settlement batch along with its lines.
+func (st *memSettlements) CreateBatch(ctx context.Context, batch *models.SettlementBatch) error {
+	return st.s.run(ctx, func(d *memData) error {
+		for _, record := range d.batches {
+			if record.Id == batch.Id {
+				return fmt.Errorf("settlement batch %s already exists", batch.Id)
+			}
+		}
+
+		record := *batch
+		record.Lines = nil
+		record.IngestedAt = time.Now().UTC()
+		d.batches = append(d.batches, record)
+
+		for _, line := range batch.Lines {
+			l := *line
+			l.Id = int64(len(d.lines) + 1)
+			l.BatchId = batch.Id
+			d.lines = append(d.lines, l)
+		}
+		return nil
+	})
+}
+
+// ListBatches returns all ingested settlement batches with line counts, most recent first.
+func (st *memSettlements) ListBatches(ctx context.Context) ([]*models.SettlementBatch, error) {
+	var batches []*models.SettlementBatch
+	err := st.s.run(ctx, func(d *memData) error {
+		for _, record := range d.batches {
+			record := record
+			for _, l := range d.lines {
+				if l.BatchId != record.Id {
+					continue
+				}
+				record.LineCount++
+				if l.Status == models.SettlementStatusMatched {
+					record.MatchedCount++
+				}
+			}
+			batches = append(batches, &record)
+		}
+		return nil
+	})
+	sort.Slice(batches, func(i, j int) bool {
+		if !batches[i].CutoffAt.Equal(batches[j].CutoffAt) {
+			return batches[i].CutoffAt.After(batches[j].CutoffAt)
+		}
+		return batches[i].Currency < batches[j].Currency
+	})
+	return batches, err
+}
+
+// CountLines returns the number of settled lines of the given type for the acquirer payment.
+func (st *memSettlements) CountLines(ctx context.Context, acquiringId string, entryType models.SettlementEntryType) (int, error) {
+	var n int
+	err := st.s.run(ctx, func(d *memData) error {
+		n = countLines(d, acquiringId, entryType)
+		return nil
+	})
+	return n, err
+}
+
+func countLines(d *memData, acquiringId string, entryType models.SettlementEntryType) int {
+	n := 0
+	for _, l := range d.lines {
+		if l.AcquiringId == acquiringId && l.Type == entryType {
+			n++
+		}
+	}
+	return n
+}
+
+// ListUnmatchedLines returns all settlement lines that did not match a gateway payment.
+func (st *memSettlements) ListUnmatchedLines(ctx context.Context) ([]*models.SettlementLine, error) {
+	var lines []*models.SettlementLine
+	err := st.s.run(ctx, func(d *memData) error {
+		for _, l := range d.lines {
+			if l.Status != models.SettlementStatusMatched {
+				l := l
+				lines = append(lines, &l)
+			}
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// DetectMissing records settlement entries expected for gateway payments of the given acquirer last updated
+// before the given time that have not been settled, and resolves previously missing entries that have been settled since.
+func (st *memSettlements) DetectMissing(ctx context.Context, acquirer string, before time.Time) error {
+	return st.s.run(ctx, func(d *memData) error {
+		now := time.Now().UTC()
+
+		recorded := make(map[string]bool)
+		for _, m := range d.missing {
+			recorded[m.PaymentId+"/"+string(m.Type)] = true
+		}
+
+		for _, p := range d.payments {
+			if p.Acquirer != acquirer || !p.UpdatedAt.Before(before) {
+				continue
+			}
+
+			var expected []models.MissingSettlement
+			switch p.State {
+			case models.PaymentStateActionPaid, models.PaymentStateDisputed:
+				expected = append(expected, models.MissingSettlement{Type: models.SettlementEntryPayment, Amount: p.Amount})
+			case models.PaymentStateRefunded:
+				expected = append(expected,
+					models.MissingSettlement{Type: models.SettlementEntryPayment, Amount: p.Amount},
+					models.MissingSettlement{Type: models.SettlementEntryRefund, Amount: -p.Amount},
+				)
+			case models.PaymentStateChargedBack:
+				expected = append(expected,
+					models.MissingSettlement{Type: models.SettlementEntryPayment, Amount: p.Amount},
+					models.MissingSettlement{Type: models.SettlementEntryChargeback, Amount: -p.Amount},
+				)
+			}
+
+			for _, e := range expected {
+				if recorded[p.Id+"/"+string(e.Type)] || countLines(d, p.AcquiringId, e.Type) > 0 {
+					continue
+				}
+				e.PaymentId = p.Id
+				e.Currency = p.Currency
+				e.DetectedAt = now
+				d.missing = append(d.missing, memMissingSettlement{MissingSettlement: e})
+			}
+		}
+
+		for i, m := range d.missing {
+			p, ok := d.payments[m.PaymentId]
+			if m.ResolvedAt == nil && ok && countLines(d, p.AcquiringId, m.Type) > 0 {
+				d.missing[i].ResolvedAt = &now
+			}
+		}
+		return nil
+	})
+}
+
+// ListMissing returns all unresolved missing settlement entries.
+func (st *memSettlements) ListMissing(ctx context.Context) ([]*models.MissingSettlement, error) {
+	var missing []*models.MissingSettlement
+	err := st.s.run(ctx, func(d *memData) error {
+		for _, m := range d.missing {
+			if m.ResolvedAt == nil {
+				m := m.MissingSettlement
+				missing = append(missing, &m)
+			}
+		}
+		return nil
+	})
+	sort.Slice(missing, func(i, j int) bool {
+		if !missing[i].DetectedAt.Equal(missing[j].DetectedAt) {
+			return missing[i].DetectedAt.Before(missing[j].DetectedAt)
+		}
+		return missing[i].PaymentId < missing[j].PaymentId
+	})
+	return missing, err
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"mkuznets.com/go/upsp/money"
+	"testing"
+	"time"
+)
+
+func TestMemStore_Tx(t *testing.T) {
+	ctx := context.Background()
+	errAbort := errors.New("abort")
+
+	t.Run("commit", func(t *testing.T) {
+		s := NewMemory()
+		committed := false
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m1"}); err != nil {
+				return err
+			}
+			s.(*memStore).afterCommit(ctx, func() { committed = true })
+			assert.False(t, committed)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.True(t, committed)
+
+		_, err = s.Merchants().Get(ctx, "m1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		s := NewMemory()
+		committed := false
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m1"}); err != nil {
+				return err
+			}
+			s.(*memStore).afterCommit(ctx, func() { committed = true })
+
+			// Changes are visible within the transaction.
+			_, err := s.Merchants().Get(ctx, "m1")
+			assert.NoError(t, err)
+			return errAbort
+		})
+		assert.ErrorIs(t, err, errAbort)
+		assert.False(t, committed)
+
+		_, err = s.Merchants().Get(ctx, "m1")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("nested rollback", func(t *testing.T) {
+		s := NewMemory()
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m1"}); err != nil {
+				return err
+			}
+			return s.Tx(ctx, func(ctx context.Context) error {
+				if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m2"}); err != nil {
+					return err
+				}
+				return errAbort
+			})
+		})
+		assert.ErrorIs(t, err, errAbort)
+
+		// The outer op fails with the error of the inner one, so both are rolled back.
+		for _, id := range []string{"m1", "m2"} {
+			_, err = s.Merchants().Get(ctx, id)
+			assert.ErrorIs(t, err, ErrNotFound)
+		}
+	})
+
+	t.Run("savepoint", func(t *testing.T) {
+		s := NewMemory()
+		committed := false
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m1"}); err != nil {
+				return err
+			}
+			err := s.Tx(ctx, func(ctx context.Context) error {
+				if err := s.Merchants().Save(ctx, &models.Merchant{Id: "m2"}); err != nil {
+					return err
+				}
+				s.(*memStore).afterCommit(ctx, func() { committed = true })
+				return errAbort
+			})
+			assert.ErrorIs(t, err, errAbort)
+
+			// The outer transaction goes on without the changes of the inner one.
+			_, err = s.Merchants().Get(ctx, "m2")
+			assert.ErrorIs(t, err, ErrNotFound)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.False(t, committed, "hooks of a rolled back savepoint must not run")
+
+		_, err = s.Merchants().Get(ctx, "m1")
+		assert.NoError(t, err)
+		_, err = s.Merchants().Get(ctx, "m2")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("nested commit", func(t *testing.T) {
+		s := NewMemory()
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			return s.Tx(ctx, func(ctx context.Context) error {
+				return s.Merchants().Save(ctx, &models.Merchant{Id: "m1"})
+			})
+		})
+		assert.NoError(t, err)
+
+		_, err = s.Merchants().Get(ctx, "m1")
+		assert.NoError(t, err)
+	})
+}
+
+func TestMemStore_WithLock(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+
+	err := s.WithLock(ctx, "key", func(ctx context.Context) error {
+		return s.WithLock(ctx, "key", func(ctx context.Context) error {
+			return nil
+		})
+	})
+	assert.ErrorIs(t, err, ErrLocked)
+
+	err = s.WithLock(ctx, "key", func(ctx context.Context) error {
+		return nil
+	})
+	assert.NoError(t, err, "lock must be released")
+
+	err = s.Tx(ctx, func(ctx context.Context) error {
+		return s.WithLock(ctx, "key", func(ctx context.Context) error {
+			return nil
+		})
+	})
+	assert.ErrorIs(t, err, ErrLockInTx)
+}
+
+func TestMemPayments_Update(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("success", func(t *testing.T) {
+		s := NewMemory()
+		p := storetest.CreatePayment(t, s.Payments(), storetest.WithId("p1"), storetest.WithMerchantId("m1"))
+		assert.Equal(t, int64(1), p.Version)
+
+		err := s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+			return py.SetState(models.PaymentStateCancelled)
+		})
+		require.NoError(t, err)
+
+		updated, err := s.Payments().Get(ctx, p.Id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateCancelled, updated.State)
+		assert.Equal(t, int64(2), updated.Version)
+		assert.Nil(t, updated.NextAttemptAt, "final payments are not picked up")
+
+		events, err := s.PaymentEvents().ListByPayment(ctx, p.Id, 0)
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, models.PaymentStateProcessing, events[0].State)
+		assert.Equal(t, models.PaymentStateCancelled, events[1].State)
+		assert.Equal(t, "m1", events[1].MerchantId)
+	})
+
+	t.Run("concurrent update", func(t *testing.T) {
+		s := NewMemory()
+		p := storetest.CreatePayment(t, s.Payments(), storetest.WithId("p1"), storetest.WithMerchantId("m1"))
+
+		err := s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+			// Another update is committed after this one has read the payment.
+			return s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+				py.Attempts++
+				return nil
+			})
+		})
+		var conflict *ConflictError
+		require.ErrorAs(t, err, &conflict)
+		assert.Equal(t, int64(1), conflict.Version)
+	})
+
+	t.Run("if version", func(t *testing.T) {
+		s := NewMemory()
+		p := storetest.CreatePayment(t, s.Payments(), storetest.WithId("p1"), storetest.WithMerchantId("m1"))
+
+		err := s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+			t.Fatal("op must not be called")
+			return nil
+		}, IfVersion(p.Version+1))
+		var conflict *ConflictError
+		assert.ErrorAs(t, err, &conflict)
+
+		err = s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+			py.Attempts++
+			return nil
+		}, IfVersion(p.Version), ForUpdate())
+		assert.NoError(t, err)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		s := NewMemory()
+		err := s.Payments().Update(ctx, "unknown", func(py *models.Payment) error {
+			return nil
+		})
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("watch", func(t *testing.T) {
+		s := NewMemory()
+		p := storetest.CreatePayment(t, s.Payments(), storetest.WithId("p1"), storetest.WithMerchantId("m1"))
+
+		changed, stop := s.Payments().Watch(p.Id)
+		defer stop()
+
+		errAbort := errors.New("abort")
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			err := s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+				py.Attempts++
+				return nil
+			})
+			require.NoError(t, err)
+			return errAbort
+		})
+		assert.ErrorIs(t, err, errAbort)
+		assert.Len(t, changed, 0, "watchers must not be notified of rolled back updates")
+
+		err = s.Payments().Update(ctx, p.Id, func(py *models.Payment) error {
+			py.Attempts++
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Len(t, changed, 1)
+	})
+}
+
+func TestMemPayments_ClaimDue(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	p := storetest.CreatePayment(t, s.Payments(), storetest.WithId("p1"), storetest.WithMerchantId("m1"))
+
+	ids, err := s.Payments().ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []string{p.Id}, ids)
+
+	ids, err = s.Payments().ClaimDue(ctx, 10, time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, ids, "claimed payments must not be claimed again until the lease expires")
+
+	claimed, err := s.Payments().Claim(ctx, p.Id, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+}
+
+func TestMemPayments_Reschedule(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+	p := storetest.CreatePayment(t, s.Payments())
+
+	next := time.Now().UTC().Add(time.Hour)
+	require.NoError(t, s.Payments().Reschedule(ctx, p.Id, p.Version, next))
+	got, err := s.Payments().Get(ctx, p.Id)
+	require.NoError(t, err)
+	require.NotNil(t, got.NextAttemptAt)
+	assert.True(t, next.Equal(*got.NextAttemptAt))
+	assert.Equal(t, p.Version, got.Version, "rescheduling must not change the version")
+
+	require.NoError(t, s.Payments().Reschedule(ctx, p.Id, p.Version-1, time.Now()))
+	got, err = s.Payments().Get(ctx, p.Id)
+	require.NoError(t, err)
+	assert.True(t, next.Equal(*got.NextAttemptAt), "changed payments must not be rescheduled")
+}
+
+func TestMemPayments_CountByCardFingerprint(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+
+	for _, id := range []string{"p1", "p2", "p3"} {
+		fingerprint := "f1"
+		if id == "p3" {
+			fingerprint = "f2"
+		}
+		_, err := s.Payments().Create(ctx, &models.Payment{
+			Id:              id,
+			Money:           money.New(100, "EUR"),
+			State:           models.PaymentStateProcessing,
+			CardFingerprint: fingerprint,
+			ClientIp:        "192.0.2.1",
+		})
+		require.NoError(t, err)
+	}
+
+	n, err := s.Payments().CountByCardFingerprint(ctx, "f1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = s.Payments().CountByCardFingerprint(ctx, "f1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n, "payments created before the given time must not be counted")
+
+	n, err = s.Payments().CountByClientIp(ctx, "192.0.2.1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestMemPayments_ListActiveAcquirers(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+
+	payments := []*models.Payment{
+		{Id: "p1", State: models.PaymentStateProcessing, Acquirer: "secondary"},
+		{Id: "p2", State: models.PaymentStateActionPaid, Acquirer: "primary"},
+		{Id: "p3", State: models.PaymentStateDisputed, Acquirer: "primary"},
+		{Id: "p4", State: models.PaymentStateRefunded, Acquirer: "legacy"},
+		{Id: "p5", State: models.PaymentStateProcessing},
+	}
+	for _, p := range payments {
+		p.Money = money.New(100, "EUR")
+		_, err := s.Payments().Create(ctx, p)
+		require.NoError(t, err)
+	}
+
+	names, err := s.Payments().ListActiveAcquirers(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary", "secondary"}, names)
+}
+
+func TestMemRiskRules(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemory()
+
+	rule := &models.RiskRule{
+		Id:      "r1",
+		Kind:    models.RiskRuleBinCountry,
+		Action:  models.RiskDecisionBlock,
+		Enabled: true,
+		Params:  models.RiskRuleParams{Countries: []string{"FR"}},
+	}
+	require.NoError(t, s.RiskRules().Save(ctx, rule))
+	assert.False(t, rule.CreatedAt.IsZero())
+
+	rule.Params.Countries[0] = "DE"
+	saved, err := s.RiskRules().Get(ctx, "r1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"FR"}, saved.Params.Countries, "stored rule must not share params with the saved one")
+
+	saved.Action = models.RiskDecisionReview
+	require.NoError(t, s.RiskRules().Save(ctx, saved))
+	rules, err := s.RiskRules().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, models.RiskDecisionReview, rules[0].Action)
+	assert.Equal(t, rule.CreatedAt, rules[0].CreatedAt)
+
+	require.NoError(t, s.RiskRules().Delete(ctx, "r1"))
+	assert.ErrorIs(t, s.RiskRules().Delete(ctx, "r1"), ErrNotFound)
+	_, err = s.RiskRules().Get(ctx, "r1")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
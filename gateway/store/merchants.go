@@ -0,0 +1,52 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+// Merchants is an interface for accessing merchant settings.
+type Merchants interface {
+	Get(ctx context.Context, id string) (*models.Merchant, error)
+	Save(ctx context.Context, merchant *models.Merchant) error
+}
+
+type merchantsImpl struct {
+	s *storeImpl
+}
+
+// Get returns a merchant by ID.
+func (m *merchantsImpl) Get(ctx context.Context, id string) (*models.Merchant, error) {
+	var merchant models.Merchant
+	err := m.s.querier(ctx).QueryRow(ctx, `
+		SELECT id, async_payments, created_at, updated_at
+		FROM merchants
+		WHERE id = $1;
+		`, id).Scan(
+		&merchant.Id,
+		&merchant.AsyncPayments,
+		&merchant.CreatedAt,
+		&merchant.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &merchant, nil
+}
+
+// Save creates a merchant or updates the settings of an existing one.
+func (m *merchantsImpl) Save(ctx context.Context, merchant *models.Merchant) error {
+	now := time.Now().UTC()
+
+	return m.s.querier(ctx).QueryRow(ctx, `
+		INSERT INTO merchants (id, async_payments, created_at, updated_at)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (id) DO UPDATE SET async_payments = excluded.async_payments, updated_at = excluded.updated_at
+		RETURNING created_at, updated_at;
+		`,
+		merchant.Id,
+		merchant.AsyncPayments,
+		now,
+	).Scan(&merchant.CreatedAt, &merchant.UpdatedAt)
+}
@@ -0,0 +1,8 @@
+DROP TABLE payment_discrepancies;
+DROP TABLE settlement_missing;
+DROP TABLE settlement_lines;
+DROP TABLE settlement_batches;
+DROP TABLE disputes;
+DROP TABLE merchants;
+DROP TABLE payment_events;
+DROP TABLE payments;
@@ -0,0 +1,142 @@
+CREATE TABLE payments
+(
+    id                text PRIMARY KEY,
+    merchant_id       text        NOT NULL default '',
+    amount            bigint      NOT NULL,
+    currency          text        NOT NULL,
+
+    card_number       text        NOT NULL,
+    expiry_date       text        NOT NULL,
+    card_holder       text        NOT NULL,
+    cvv               text        NOT NULL,
+
+    state             text        NOT NULL,
+    version           bigint      NOT NULL default 1,
+
+    acquiring_id      text        NOT NULL default '',
+    acquiring_state   text        NOT NULL default '',
+    acquiring_version text        NOT NULL default '',
+
+    next_attempt_at   timestamptz,
+    attempts          integer     NOT NULL default 0,
+    last_error        text        NOT NULL default '',
+
+    created_at        timestamptz NOT NULL,
+    updated_at        timestamptz NOT NULL
+);
+
+CREATE INDEX "payments__state" ON payments (state);
+CREATE INDEX "payments__acquiring_id" ON payments (acquiring_id);
+CREATE INDEX "payments__merchant_id" ON payments (merchant_id);
+CREATE INDEX "payments__next_attempt_at" ON payments (next_attempt_at) WHERE next_attempt_at IS NOT NULL;
+
+CREATE TABLE payment_events
+(
+    id          bigserial PRIMARY KEY,
+    payment_id  text        NOT NULL REFERENCES payments (id),
+    merchant_id text        NOT NULL default '',
+    state       text        NOT NULL,
+    created_at  timestamptz NOT NULL
+);
+
+CREATE INDEX "payment_events__payment_id" ON payment_events (payment_id, id);
+CREATE INDEX "payment_events__merchant_id" ON payment_events (merchant_id, id);
+
+CREATE TABLE merchants
+(
+    id             text PRIMARY KEY,
+    async_payments boolean     NOT NULL default false,
+    created_at     timestamptz NOT NULL,
+    updated_at     timestamptz NOT NULL
+);
+
+CREATE TABLE disputes
+(
+    id                text PRIMARY KEY,
+    payment_id        text        NOT NULL REFERENCES payments (id),
+    state             text        NOT NULL,
+    reason            text        NOT NULL,
+    amount            bigint      NOT NULL,
+    currency          text        NOT NULL,
+
+    evidence          text        NOT NULL default '',
+    evidence_due_by   timestamptz NOT NULL,
+
+    acquiring_id      text        NOT NULL,
+    acquiring_state   text        NOT NULL default '',
+    acquiring_version text        NOT NULL default '',
+
+    created_at        timestamptz NOT NULL,
+    updated_at        timestamptz NOT NULL
+);
+
+CREATE UNIQUE INDEX "disputes__acquiring_id" ON disputes (acquiring_id);
+CREATE INDEX "disputes__payment_id" ON disputes (payment_id);
+
+CREATE TABLE settlement_batches
+(
+    id              text PRIMARY KEY,
+    settlement_date text        NOT NULL,
+    currency        text        NOT NULL,
+    cutoff_at       timestamptz NOT NULL,
+
+    gross           bigint      NOT NULL,
+    fees            bigint      NOT NULL,
+    net             bigint      NOT NULL,
+
+    ingested_at     timestamptz NOT NULL
+);
+
+CREATE TABLE settlement_lines
+(
+    id           bigserial PRIMARY KEY,
+    batch_id     text        NOT NULL REFERENCES settlement_batches (id),
+    acquiring_id text        NOT NULL,
+    payment_id   text        NOT NULL default '',
+    type         text        NOT NULL,
+
+    amount       bigint      NOT NULL,
+    fee          bigint      NOT NULL,
+    net          bigint      NOT NULL,
+
+    status       text        NOT NULL,
+    created_at   timestamptz NOT NULL
+);
+
+CREATE INDEX "settlement_lines__acquiring_id" ON settlement_lines (acquiring_id, type);
+CREATE INDEX "settlement_lines__batch_id" ON settlement_lines (batch_id);
+
+CREATE TABLE settlement_missing
+(
+    payment_id  text        NOT NULL REFERENCES payments (id),
+    type        text        NOT NULL,
+    currency    text        NOT NULL,
+    amount      bigint      NOT NULL,
+
+    detected_at timestamptz NOT NULL,
+    resolved_at timestamptz,
+
+    PRIMARY KEY (payment_id, type)
+);
+
+CREATE TABLE payment_discrepancies
+(
+    id                bigserial PRIMARY KEY,
+    payment_id        text        NOT NULL REFERENCES payments (id),
+    kind              text        NOT NULL,
+    status            text        NOT NULL,
+    details           text        NOT NULL default '',
+
+    state             text        NOT NULL,
+    acquiring_id      text        NOT NULL,
+    acquiring_state   text        NOT NULL,
+    acquiring_version text        NOT NULL,
+    acquirer_state    text        NOT NULL default '',
+    acquirer_version  text        NOT NULL default '',
+
+    detected_at       timestamptz NOT NULL
+);
+
+CREATE INDEX "payment_discrepancies__payment_id" ON payment_discrepancies (payment_id);
+CREATE UNIQUE INDEX "payment_discrepancies__unrepaired" ON payment_discrepancies (payment_id, kind, status)
+    WHERE status <> 'repaired';
@@ -0,0 +1,3 @@
+-- Payments created before routing was introduced were processed by the only acquirer, registered as "simulator".
+ALTER TABLE payments ADD COLUMN acquirer text NOT NULL DEFAULT 'simulator';
+ALTER TABLE payments ALTER COLUMN acquirer SET DEFAULT '';
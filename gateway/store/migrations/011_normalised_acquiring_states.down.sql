@@ -0,0 +1,28 @@
+-- Voided payments are restored as cancelled: whether the simulator reversed them is not recorded.
+UPDATE payments
+SET acquiring_state = CASE acquiring_state
+    WHEN 'created' THEN 'new'
+    WHEN 'action_required' THEN '3d_secure_required'
+    WHEN 'captured' THEN 'confirmed'
+    WHEN 'voided' THEN 'cancelled'
+    WHEN 'declined' THEN 'rejected'
+    ELSE acquiring_state END
+WHERE acquiring_state IN ('created', 'action_required', 'captured', 'voided', 'declined');
+
+UPDATE payment_discrepancies
+SET acquiring_state = CASE acquiring_state
+    WHEN 'created' THEN 'new'
+    WHEN 'action_required' THEN '3d_secure_required'
+    WHEN 'captured' THEN 'confirmed'
+    WHEN 'voided' THEN 'cancelled'
+    WHEN 'declined' THEN 'rejected'
+    ELSE acquiring_state END,
+    acquirer_state = CASE acquirer_state
+    WHEN 'created' THEN 'new'
+    WHEN 'action_required' THEN '3d_secure_required'
+    WHEN 'captured' THEN 'confirmed'
+    WHEN 'voided' THEN 'cancelled'
+    WHEN 'declined' THEN 'rejected'
+    ELSE acquirer_state END;
+
+ALTER TABLE payments DROP COLUMN decline_code;
@@ -0,0 +1,34 @@
+-- Acquiring states are stored as reported by the acquirer adapter, in the normalised form of the gateway.
+ALTER TABLE payments ADD COLUMN decline_code text NOT NULL DEFAULT '';
+
+UPDATE payments
+SET acquiring_state = CASE acquiring_state
+    WHEN 'new' THEN 'created'
+    WHEN '3d_secure_required' THEN 'action_required'
+    WHEN 'confirmed' THEN 'captured'
+    WHEN 'cancelled' THEN 'voided'
+    WHEN 'reversed' THEN 'voided'
+    WHEN 'rejected' THEN 'declined'
+    ELSE acquiring_state END
+WHERE acquiring_state IN ('new', '3d_secure_required', 'confirmed', 'cancelled', 'reversed', 'rejected');
+
+-- The simulator did not report why payments were rejected before.
+UPDATE payments SET decline_code = 'unknown' WHERE acquiring_state = 'declined';
+
+UPDATE payment_discrepancies
+SET acquiring_state = CASE acquiring_state
+    WHEN 'new' THEN 'created'
+    WHEN '3d_secure_required' THEN 'action_required'
+    WHEN 'confirmed' THEN 'captured'
+    WHEN 'cancelled' THEN 'voided'
+    WHEN 'reversed' THEN 'voided'
+    WHEN 'rejected' THEN 'declined'
+    ELSE acquiring_state END,
+    acquirer_state = CASE acquirer_state
+    WHEN 'new' THEN 'created'
+    WHEN '3d_secure_required' THEN 'action_required'
+    WHEN 'confirmed' THEN 'captured'
+    WHEN 'cancelled' THEN 'voided'
+    WHEN 'reversed' THEN 'voided'
+    WHEN 'rejected' THEN 'declined'
+    ELSE acquirer_state END;
@@ -0,0 +1,6 @@
+DROP TABLE risk_rules;
+
+ALTER TABLE payments DROP COLUMN risk_decision;
+ALTER TABLE payments DROP COLUMN risk_score;
+ALTER TABLE payments DROP COLUMN client_ip;
+ALTER TABLE payments DROP COLUMN card_fingerprint;
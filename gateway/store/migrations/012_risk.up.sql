@@ -0,0 +1,21 @@
+-- Payments created before risk rules were introduced have no card fingerprint or client IP,
+-- so velocity and blocklist rules do not count them.
+ALTER TABLE payments ADD COLUMN card_fingerprint text NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN client_ip text NOT NULL DEFAULT '';
+ALTER TABLE payments ADD COLUMN risk_score integer NOT NULL DEFAULT 0;
+ALTER TABLE payments ADD COLUMN risk_decision text NOT NULL DEFAULT '';
+
+CREATE INDEX "payments__card_fingerprint" ON payments (card_fingerprint, created_at);
+CREATE INDEX "payments__client_ip" ON payments (client_ip, created_at);
+
+CREATE TABLE risk_rules
+(
+    id         text PRIMARY KEY,
+    kind       text        NOT NULL,
+    action     text        NOT NULL,
+    score      integer     NOT NULL default 0,
+    enabled    boolean     NOT NULL default true,
+    params     jsonb       NOT NULL default '{}',
+    created_at timestamptz NOT NULL,
+    updated_at timestamptz NOT NULL
+);
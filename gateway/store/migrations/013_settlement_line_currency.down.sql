@@ -0,0 +1 @@
+ALTER TABLE settlement_lines DROP COLUMN currency;
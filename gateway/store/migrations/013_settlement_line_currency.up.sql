@@ -0,0 +1,7 @@
+-- Lines ingested before are in the currency of their batch.
+ALTER TABLE settlement_lines ADD COLUMN currency text NOT NULL DEFAULT '';
+
+UPDATE settlement_lines l
+SET currency = b.currency
+FROM settlement_batches b
+WHERE l.batch_id = b.id;
@@ -0,0 +1,8 @@
+-- Locks taken outside of transactions are leases rather than session advisory locks,
+-- so that they do not pin a pooled connection while they are held.
+CREATE TABLE locks
+(
+    key          text PRIMARY KEY,
+    owner        text        NOT NULL,
+    locked_until timestamptz NOT NULL
+);
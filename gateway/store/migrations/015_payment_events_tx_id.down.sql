@@ -0,0 +1,6 @@
+DROP INDEX "payment_events__payment_id";
+DROP INDEX "payment_events__merchant_id";
+CREATE INDEX "payment_events__payment_id" ON payment_events (payment_id, id);
+CREATE INDEX "payment_events__merchant_id" ON payment_events (merchant_id, id);
+
+ALTER TABLE payment_events DROP COLUMN tx_id;
@@ -0,0 +1,9 @@
+-- Events are ordered by the ID of the transaction that recorded them instead of being serialised by a global lock.
+-- Events recorded before are older than any transaction to come and keep the order of their IDs.
+ALTER TABLE payment_events ADD COLUMN tx_id bigint NOT NULL DEFAULT 0;
+ALTER TABLE payment_events ALTER COLUMN tx_id DROP DEFAULT;
+
+DROP INDEX "payment_events__payment_id";
+DROP INDEX "payment_events__merchant_id";
+CREATE INDEX "payment_events__payment_id" ON payment_events (payment_id, tx_id, id);
+CREATE INDEX "payment_events__merchant_id" ON payment_events (merchant_id, tx_id, id);
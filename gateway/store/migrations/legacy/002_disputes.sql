@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS disputes
+(
+    id                text PRIMARY KEY,
+    payment_id        text        NOT NULL REFERENCES payments (id),
+    state             text        NOT NULL,
+    reason            text        NOT NULL,
+    amount            bigint      NOT NULL,
+    currency          text        NOT NULL,
+
+    evidence          text        NOT NULL default '',
+    evidence_due_by   timestamptz NOT NULL,
+
+    acquiring_id      text        NOT NULL,
+    acquiring_state   text        NOT NULL default '',
+    acquiring_version text        NOT NULL default '',
+
+    created_at        timestamptz NOT NULL,
+    updated_at        timestamptz NOT NULL
+);
+
+CREATE UNIQUE INDEX "disputes__acquiring_id" ON disputes (acquiring_id);
+CREATE INDEX "disputes__payment_id" ON disputes (payment_id);
@@ -0,0 +1,47 @@
+CREATE INDEX "payments__acquiring_id" ON payments (acquiring_id);
+
+CREATE TABLE IF NOT EXISTS settlement_batches
+(
+    id              text PRIMARY KEY,
+    settlement_date text        NOT NULL,
+    currency        text        NOT NULL,
+    cutoff_at       timestamptz NOT NULL,
+
+    gross           bigint      NOT NULL,
+    fees            bigint      NOT NULL,
+    net             bigint      NOT NULL,
+
+    ingested_at     timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS settlement_lines
+(
+    id           bigserial PRIMARY KEY,
+    batch_id     text        NOT NULL REFERENCES settlement_batches (id),
+    acquiring_id text        NOT NULL,
+    payment_id   text        NOT NULL default '',
+    type         text        NOT NULL,
+
+    amount       bigint      NOT NULL,
+    fee          bigint      NOT NULL,
+    net          bigint      NOT NULL,
+
+    status       text        NOT NULL,
+    created_at   timestamptz NOT NULL
+);
+
+CREATE INDEX "settlement_lines__acquiring_id" ON settlement_lines (acquiring_id, type);
+CREATE INDEX "settlement_lines__batch_id" ON settlement_lines (batch_id);
+
+CREATE TABLE IF NOT EXISTS settlement_missing
+(
+    payment_id  text        NOT NULL REFERENCES payments (id),
+    type        text        NOT NULL,
+    currency    text        NOT NULL,
+    amount      bigint      NOT NULL,
+
+    detected_at timestamptz NOT NULL,
+    resolved_at timestamptz,
+
+    PRIMARY KEY (payment_id, type)
+);
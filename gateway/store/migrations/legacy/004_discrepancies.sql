@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS payment_discrepancies
+(
+    id                bigserial PRIMARY KEY,
+    payment_id        text        NOT NULL REFERENCES payments (id),
+    kind              text        NOT NULL,
+    status            text        NOT NULL,
+    details           text        NOT NULL default '',
+
+    state             text        NOT NULL,
+    acquiring_id      text        NOT NULL,
+    acquiring_state   text        NOT NULL,
+    acquiring_version text        NOT NULL,
+    acquirer_state    text        NOT NULL default '',
+    acquirer_version  text        NOT NULL default '',
+
+    detected_at       timestamptz NOT NULL
+);
+
+CREATE INDEX "payment_discrepancies__payment_id" ON payment_discrepancies (payment_id);
+CREATE UNIQUE INDEX "payment_discrepancies__unrepaired" ON payment_discrepancies (payment_id, kind, status)
+    WHERE status <> 'repaired';
@@ -0,0 +1,7 @@
+ALTER TABLE payments ADD COLUMN next_attempt_at timestamptz;
+
+UPDATE payments
+SET next_attempt_at = now()
+WHERE state IN ('processing', 'action_required', 'paid', 'disputed');
+
+CREATE INDEX "payments__next_attempt_at" ON payments (next_attempt_at) WHERE next_attempt_at IS NOT NULL;
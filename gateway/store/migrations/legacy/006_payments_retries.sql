@@ -0,0 +1,2 @@
+ALTER TABLE payments ADD COLUMN attempts integer NOT NULL default 0;
+ALTER TABLE payments ADD COLUMN last_error text NOT NULL default '';
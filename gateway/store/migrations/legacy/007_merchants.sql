@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS merchants
+(
+    id             text PRIMARY KEY,
+    async_payments boolean     NOT NULL default false,
+    created_at     timestamptz NOT NULL,
+    updated_at     timestamptz NOT NULL
+);
+
+ALTER TABLE payments ADD COLUMN merchant_id text NOT NULL default '';
+
+CREATE INDEX "payments__merchant_id" ON payments (merchant_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS payment_events
+(
+    id          bigserial PRIMARY KEY,
+    payment_id  text        NOT NULL REFERENCES payments (id),
+    merchant_id text        NOT NULL default '',
+    state       text        NOT NULL,
+    created_at  timestamptz NOT NULL
+);
+
+CREATE INDEX "payment_events__payment_id" ON payment_events (payment_id, id);
+CREATE INDEX "payment_events__merchant_id" ON payment_events (merchant_id, id);
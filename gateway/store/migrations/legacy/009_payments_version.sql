@@ -0,0 +1 @@
+ALTER TABLE payments ADD COLUMN version bigint NOT NULL default 1;
@@ -0,0 +1,435 @@
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+//go:embed legacy/*.sql
+var legacyFiles embed.FS
+
+// legacySteps are the former ./sql scripts that led up to the baseline schema, oldest first, each with a query
+// that reports whether the script has been applied. The first script, which created the payments table, is not
+// included: a database without it is new and is created from the baseline migration.
+var legacySteps = []struct {
+	file  string
+	probe string
+}{
+	{"002_disputes.sql", tableExists("disputes")},
+	{"003_settlements.sql", tableExists("settlement_batches")},
+	{"004_discrepancies.sql", tableExists("payment_discrepancies")},
+	{"005_payments_queue.sql", columnExists("payments", "next_attempt_at")},
+	{"006_payments_retries.sql", columnExists("payments", "attempts")},
+	{"007_merchants.sql", tableExists("merchants")},
+	{"008_payment_events.sql", tableExists("payment_events")},
+	{"009_payments_version.sql", columnExists("payments", "version")},
+}
+
+func tableExists(table string) string {
+	return fmt.Sprintf(`SELECT to_regclass('%s') IS NOT NULL;`, table)
+}
+
+func columnExists(table, column string) string {
+	return fmt.Sprintf(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = '%s' AND column_name = '%s'
+		);`, table, column)
+}
+
+// baselineVersion is the version of the migration that creates the whole schema from scratch.
+// Databases created before migrations were embedded already have this schema, and are marked as migrated to it.
+const baselineVersion = 9
+
+// lockKey is the advisory lock that serialises concurrent migrations.
+const lockKey = 0x75707370 // "upsp"
+
+var (
+	// ErrPending is returned by Migrator.Check if the database schema is behind the gateway.
+	ErrPending = errors.New("database schema has pending migrations")
+	// ErrUnknown is returned by Migrator.Check if the database schema has migrations the gateway does not know,
+	// i.e. it has been migrated by a newer version of the gateway.
+	ErrUnknown = errors.New("database schema has unknown migrations")
+)
+
+// Migration is a versioned change of the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration along with the time it was applied, nil if it has not been applied.
+type Status struct {
+	*Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded migrations to the database.
+type Migrator interface {
+	// Up applies all pending migrations in order and returns them.
+	Up(ctx context.Context) ([]*Migration, error)
+	// Down reverts up to the given number of the most recent migrations and returns them.
+	Down(ctx context.Context, steps int) ([]*Migration, error)
+	// Status returns all known migrations and those applied to the database, oldest first.
+	Status(ctx context.Context) ([]*Status, error)
+	// Check returns ErrPending or ErrUnknown if the database schema is not the one the gateway expects.
+	Check(ctx context.Context) error
+}
+
+type migratorImpl struct {
+	pool       *pgxpool.Pool
+	migrations []*Migration
+}
+
+// New creates a new Migrator of the embedded migrations.
+func New(pool *pgxpool.Pool) (Migrator, error) {
+	migrations, err := Load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &migratorImpl{pool: pool, migrations: migrations}, nil
+}
+
+var filePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Load reads migrations from the files of the given file system named <version>_<name>.up.sql
+// and <version>_<name>.down.sql, and returns them ordered by version.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := filePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, migration.Name, m[2])
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if m[3] == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction, and returns them.
+func (m *migratorImpl) Up(ctx context.Context) ([]*Migration, error) {
+	var done []*Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		if err := m.init(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			err := m.apply(ctx, conn, migration.Up,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now());`, migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("could not apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts up to the given number of the most recent migrations, each in its own transaction, and returns them.
+func (m *migratorImpl) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var done []*Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		if err := m.init(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		known := make(map[int]*Migration)
+		for _, migration := range m.migrations {
+			known[migration.Version] = migration
+		}
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for _, version := range versions {
+			if len(done) == steps {
+				break
+			}
+			migration, ok := known[version]
+			if !ok {
+				return fmt.Errorf("%w: cannot revert migration %d", ErrUnknown, version)
+			}
+			err := m.apply(ctx, conn, migration.Down, `DELETE FROM schema_migrations WHERE version = $1;`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("could not revert migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status returns all known migrations and those applied to the database, oldest first.
+func (m *migratorImpl) Status(ctx context.Context) ([]*Status, error) {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []*Status
+	for _, migration := range m.migrations {
+		s := &Status{Migration: migration}
+		if a, ok := applied[migration.Version]; ok {
+			s.AppliedAt = &a.appliedAt
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, s)
+	}
+	for version, a := range applied {
+		a := a
+		statuses = append(statuses, &Status{Migration: &Migration{Version: version, Name: a.name}, AppliedAt: &a.appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Check returns ErrPending if some migrations have not been applied to the database,
+// or ErrUnknown if the database has migrations the gateway does not know.
+func (m *migratorImpl) Check(ctx context.Context) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range statuses {
+		switch {
+		case s.AppliedAt == nil:
+			return fmt.Errorf("%w: %d_%s is not applied", ErrPending, s.Version, s.Name)
+		case s.Up == "":
+			return fmt.Errorf("%w: %d_%s is applied", ErrUnknown, s.Version, s.Name)
+		}
+	}
+	return nil
+}
+
+// withLock runs the op on a dedicated connection holding an advisory lock,
+// so that gateway instances starting at the same time do not migrate the database concurrently.
+func (m *migratorImpl) withLock(ctx context.Context, op func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("could not acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1, hashtext('schema_migrations'));`, lockKey); err != nil {
+		return fmt.Errorf("could not acquire migration lock: %w", err)
+	}
+	defer func() {
+		// The unlock must not depend on the op context, which may be cancelled by now.
+		_, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1, hashtext('schema_migrations'));`, lockKey)
+		if err != nil {
+			// Closing the session is the only remaining way to release the lock.
+			_ = conn.Conn().Close(context.Background())
+		}
+	}()
+
+	return op(conn)
+}
+
+// init creates the schema_migrations table if it does not exist. A database created before migrations were embedded
+// (by the sql/ scripts, tern or docker-compose) is brought up to the baseline schema by the legacy scripts it lacks,
+// and is marked as migrated to the baseline.
+func (m *migratorImpl) init(ctx context.Context, conn *pgxpool.Conn) error {
+	var exists, legacy bool
+	err := conn.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL, to_regclass('payments') IS NOT NULL;`).
+		Scan(&exists, &legacy)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	return m.tx(ctx, conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE schema_migrations
+			(
+				version    integer PRIMARY KEY,
+				name       text        NOT NULL,
+				applied_at timestamptz NOT NULL
+			);
+			`)
+		if err != nil || !legacy {
+			return err
+		}
+
+		if err := upgradeLegacy(ctx, tx); err != nil {
+			return err
+		}
+
+		log.Printf("[INFO] existing database schema is marked as migrated to the baseline version %d", baselineVersion)
+		_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, 'baseline', now());`, baselineVersion)
+		return err
+	})
+}
+
+// upgradeLegacy applies the legacy scripts that have not been applied to a database created by the former ./sql scripts.
+// The applied scripts must be the first ones: a schema with gaps has been changed by hand and is not upgraded.
+func upgradeLegacy(ctx context.Context, tx pgx.Tx) error {
+	var pending []string
+	for _, step := range legacySteps {
+		var applied bool
+		if err := tx.QueryRow(ctx, step.probe).Scan(&applied); err != nil {
+			return err
+		}
+		switch {
+		case !applied:
+			pending = append(pending, step.file)
+		case len(pending) > 0:
+			return fmt.Errorf("legacy database schema has %s applied, but not %s: upgrade it by hand", step.file, pending[0])
+		}
+	}
+
+	for _, file := range pending {
+		script, err := fs.ReadFile(legacyFiles, "legacy/"+file)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO] applying legacy script %s", file)
+		if _, err := tx.Exec(ctx, string(script)); err != nil {
+			return fmt.Errorf("could not apply legacy script %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+type appliedMigration struct {
+	name      string
+	appliedAt time.Time
+}
+
+// applied returns the migrations applied to the database by version. It is empty if the database is not initialised.
+func (m *migratorImpl) applied(ctx context.Context, conn *pgxpool.Conn) (map[int]appliedMigration, error) {
+	applied := make(map[int]appliedMigration)
+
+	var exists bool
+	if err := conn.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL;`).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := conn.Query(ctx, `SELECT version, name, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version int
+			a       appliedMigration
+		)
+		if err := rows.Scan(&version, &a.name, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = a
+	}
+	return applied, rows.Err()
+}
+
+// apply runs the migration script and records the change in schema_migrations in one transaction.
+func (m *migratorImpl) apply(ctx context.Context, conn *pgxpool.Conn, script, record string, args ...interface{}) error {
+	return m.tx(ctx, conn, func(tx pgx.Tx) error {
+		// Without arguments, the script runs with the simple protocol, which allows multiple statements.
+		if _, err := tx.Exec(ctx, script); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, record, args...)
+		return err
+	})
+}
+
+func (m *migratorImpl) tx(ctx context.Context, conn *pgxpool.Conn, op func(tx pgx.Tx) error) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if err := op(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	return nil
+}
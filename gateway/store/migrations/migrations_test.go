@@ -0,0 +1,72 @@
+package migrations
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad_Embedded(t *testing.T) {
+	migrations, err := Load(files)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	assert.Equal(t, baselineVersion, migrations[0].Version)
+	assert.Equal(t, "baseline", migrations[0].Name)
+	for i := 1; i < len(migrations); i++ {
+		assert.Greater(t, migrations[i].Version, migrations[i-1].Version)
+	}
+}
+
+func Test_legacySteps(t *testing.T) {
+	entries, err := fs.ReadDir(legacyFiles, "legacy")
+	require.NoError(t, err)
+	require.Len(t, entries, len(legacySteps), "every legacy script must have a step")
+
+	for i, step := range legacySteps {
+		assert.Equal(t, entries[i].Name(), step.file, "legacy steps must be ordered")
+		script, err := fs.ReadFile(legacyFiles, "legacy/"+step.file)
+		require.NoError(t, err)
+		assert.NotEmpty(t, script)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load(fstest.MapFS{
+		"010_b.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"010_b.down.sql": {Data: []byte("DROP TABLE b;")},
+		"002_a.up.sql":   {Data: []byte("CREATE TABLE a ();")},
+		"002_a.down.sql": {Data: []byte("DROP TABLE a;")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []*Migration{
+		{Version: 2, Name: "a", Up: "CREATE TABLE a ();", Down: "DROP TABLE a;"},
+		{Version: 10, Name: "b", Up: "CREATE TABLE b ();", Down: "DROP TABLE b;"},
+	}, migrations)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	cases := map[string]fstest.MapFS{
+		"missing down": {
+			"001_a.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"missing up": {
+			"001_a.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"name mismatch": {
+			"001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"unexpected file": {
+			"001_a.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(fsys)
+			assert.Error(t, err)
+		})
+	}
+}
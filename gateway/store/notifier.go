@@ -0,0 +1,49 @@
+package store
+
+import "sync"
+
+// notifier lets in-process watchers wait for changes of objects by ID.
+type notifier struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan struct{}]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{watchers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// watch returns a channel that receives a value when the object with the given ID changes,
+// and the function that stops watching.
+func (n *notifier) watch(id string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	n.mu.Lock()
+	if n.watchers[id] == nil {
+		n.watchers[id] = make(map[chan struct{}]struct{})
+	}
+	n.watchers[id][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		delete(n.watchers[id], ch)
+		if len(n.watchers[id]) == 0 {
+			delete(n.watchers, id)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// notify wakes up the watchers of the object with the given ID.
+func (n *notifier) notify(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for ch := range n.watchers[id] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// The watcher has a pending notification already.
+		}
+	}
+}
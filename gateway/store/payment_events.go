@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"strings"
+	"time"
+)
+
+// paymentEventsChannel is the notification channel that receives committed payment events.
+const paymentEventsChannel = "payment_events"
+
+// PaymentEvents is an interface for accessing the history of payment state changes.
+type PaymentEvents interface {
+	ListByPayment(ctx context.Context, paymentId string, after int64) ([]*models.PaymentEvent, error)
+	ListByMerchant(ctx context.Context, merchantId string, after int64, limit int) ([]*models.PaymentEvent, error)
+	LastId(ctx context.Context) (int64, error)
+	Listen(ctx context.Context, fn func(paymentId, merchantId string)) error
+}
+
+type paymentEventsImpl struct {
+	s *storeImpl
+}
+
+const paymentEventColumns = `id, payment_id, merchant_id, state, created_at`
+
+func scanPaymentEvent(row scanner) (*models.PaymentEvent, error) {
+	var event models.PaymentEvent
+	err := row.Scan(
+		&event.Id,
+		&event.PaymentId,
+		&event.MerchantId,
+		&event.State,
+		&event.CreatedAt,
+	)
+	return &event, err
+}
+
+// visibleEvents selects the events whose transactions are older than every transaction still in progress.
+// Transactions get their IDs before they commit, so events ordered by the transaction ID are final up to
+// this horizon: no event can be committed before an event that has already been listed.
+const visibleEvents = `e.tx_id < txid_snapshot_xmin(txid_current_snapshot())`
+
+// afterEvent selects the events listed after the event with the ID of the $2 parameter,
+// or all events if there is no such event.
+const afterEvent = `(e.tx_id, e.id) > ((SELECT coalesce(max(tx_id), 0) FROM payment_events WHERE id = $2), $2)`
+
+// create records the current state of the payment as a new event and notifies the listeners (see Listen).
+// The notification is delivered once the transaction that records the event is committed.
+// Must be called in a transaction.
+func (e *paymentEventsImpl) create(ctx context.Context, payment *models.Payment) error {
+	_, err := e.s.querier(ctx).Exec(ctx, `
+		INSERT INTO payment_events (payment_id, merchant_id, state, created_at, tx_id)
+		VALUES ($1, $2, $3, $4, txid_current());
+		`,
+		payment.Id,
+		payment.MerchantId,
+		payment.State,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.s.querier(ctx).Exec(ctx, `SELECT pg_notify($1, $2);`, paymentEventsChannel, payment.Id+":"+payment.MerchantId)
+	return err
+}
+
+// ListByPayment returns the events of the given payment listed after the given event ID, oldest first.
+//
+// Events are listed in the order of their transactions, and only once no older transaction is in progress,
+// so that readers that resume after an event never miss one committed later. Event IDs are unique but are not
+// ordered by the commit time, so they must be used as an opaque cursor only.
+func (e *paymentEventsImpl) ListByPayment(ctx context.Context, paymentId string, after int64) ([]*models.PaymentEvent, error) {
+	return e.list(ctx, `
+		SELECT `+paymentEventColumns+`
+		FROM payment_events e
+		WHERE e.payment_id = $1 AND `+afterEvent+` AND `+visibleEvents+`
+		ORDER BY e.tx_id, e.id;
+		`, paymentId, after)
+}
+
+// ListByMerchant returns up to limit events of the payments of the given merchant listed after the given event ID,
+// oldest first. See ListByPayment for the order of events.
+func (e *paymentEventsImpl) ListByMerchant(ctx context.Context, merchantId string, after int64, limit int) ([]*models.PaymentEvent, error) {
+	return e.list(ctx, `
+		SELECT `+paymentEventColumns+`
+		FROM payment_events e
+		WHERE e.merchant_id = $1 AND `+afterEvent+` AND `+visibleEvents+`
+		ORDER BY e.tx_id, e.id
+		LIMIT $3;
+		`, merchantId, after, limit)
+}
+
+func (e *paymentEventsImpl) list(ctx context.Context, query string, args ...interface{}) ([]*models.PaymentEvent, error) {
+	rows, err := e.s.querier(ctx).Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*models.PaymentEvent
+	for rows.Next() {
+		event, err := scanPaymentEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// LastId returns the ID of the most recent event that can be listed, or zero if there are none.
+// Listing the events after it yields only the events that have not been listed yet.
+func (e *paymentEventsImpl) LastId(ctx context.Context) (int64, error) {
+	var id int64
+	err := e.s.querier(ctx).QueryRow(ctx, `
+		SELECT coalesce((SELECT e.id FROM payment_events e WHERE `+visibleEvents+` ORDER BY e.tx_id DESC, e.id DESC LIMIT 1), 0);
+		`).Scan(&id)
+	return id, err
+}
+
+// Listen calls fn with the payment and the merchant IDs of every committed event.
+// It blocks until the context is cancelled or the connection fails.
+func (e *paymentEventsImpl) Listen(ctx context.Context, fn func(paymentId, merchantId string)) error {
+	return e.s.listen(ctx, paymentEventsChannel, func(payload string) {
+		paymentId, merchantId, _ := strings.Cut(payload, ":")
+		fn(paymentId, merchantId)
+	})
+}
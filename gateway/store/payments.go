@@ -2,73 +2,196 @@ package store
 
 import (
 	"context"
+	"fmt"
 	"mkuznets.com/go/upsp/gateway/models"
 	"time"
 )
 
+// paymentsDueChannel is the notification channel that receives IDs of payments due for a transition attempt.
+const paymentsDueChannel = "payments_due"
+
 // Payments is an interface for accessing gateway payments.
 type Payments interface {
 	Create(ctx context.Context, payment *models.Payment) (string, error)
 	Get(ctx context.Context, id string) (*models.Payment, error)
-	ListAll(ctx context.Context) ([]string, error)
-	Update(ctx context.Context, id string, op func(payment *models.Payment) error) error
+	GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Payment, error)
+	ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]string, error)
+	Claim(ctx context.Context, id string, lease time.Duration) (bool, error)
+	Reschedule(ctx context.Context, id string, version int64, next time.Time) error
+	ListenDue(ctx context.Context, fn func(id string)) error
+	Watch(id string) (<-chan struct{}, func())
+	ListByStates(ctx context.Context, states []models.PaymentState) ([]string, error)
+	ListDeadLetter(ctx context.Context) ([]*models.Payment, error)
+	ListActiveAcquirers(ctx context.Context) ([]string, error)
+	CountByCardFingerprint(ctx context.Context, fingerprint string, since time.Time) (int, error)
+	CountByClientIp(ctx context.Context, ip string, since time.Time) (int, error)
+	Update(ctx context.Context, id string, op func(payment *models.Payment) error, opts ...UpdateOption) error
+}
+
+// ConflictError is returned by Payments.Update when the payment has been changed concurrently,
+// i.e. its version is no longer the one the update is based on.
+type ConflictError struct {
+	Id      string
+	Version int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("payment %s has changed concurrently since version %d", e.Id, e.Version)
+}
+
+type updateOptions struct {
+	forUpdate bool
+	version   *int64
+}
+
+// UpdateOption configures Payments.Update.
+type UpdateOption func(*updateOptions)
+
+// ForUpdate locks the payment row with SELECT ... FOR UPDATE until the end of the transaction,
+// so that the update waits for concurrent updates instead of failing with a ConflictError.
+func ForUpdate() UpdateOption {
+	return func(o *updateOptions) {
+		o.forUpdate = true
+	}
+}
+
+// IfVersion makes the update fail with a ConflictError unless the payment has the given version.
+func IfVersion(version int64) UpdateOption {
+	return func(o *updateOptions) {
+		o.version = &version
+	}
 }
 
 type paymentsImpl struct {
-	s Store
+	s        *storeImpl
+	events   *paymentEventsImpl
+	notifier *notifier
 }
 
-// Create persists a new payment model.
+// Create persists a new payment model and records its initial state as a payment event.
+// If the payment is due for a transition attempt, a notification is sent to the transitioners (see ListenDue).
 func (p *paymentsImpl) Create(ctx context.Context, payment *models.Payment) (string, error) {
 	var id string
 
-	err := p.s.querier(ctx).QueryRow(ctx, `
-		INSERT INTO payments (id, amount, currency, card_number, expiry_date, card_holder, cvv, state, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id;
-		`,
-		payment.Id,
-		payment.Amount,
-		payment.Currency,
-		payment.CardNumber,
-		payment.ExpiryDate,
-		payment.CardHolder,
-		payment.Cvv,
-		payment.State,
-		time.Now().UTC(),
-		time.Now().UTC(),
-	).Scan(&id)
-
-	return id, err
+	next := nextAttemptAt(payment)
+	err := p.s.Tx(ctx, func(ctx context.Context) error {
+		err := p.s.querier(ctx).QueryRow(ctx, `
+			INSERT INTO payments (id, amount, currency, card_number, expiry_date, card_holder, cvv, state, next_attempt_at, created_at, updated_at, merchant_id, acquirer, card_fingerprint, client_ip)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			RETURNING id, version;
+			`,
+			payment.Id,
+			payment.Amount,
+			payment.Currency,
+			payment.CardNumber,
+			payment.ExpiryDate,
+			payment.CardHolder,
+			payment.Cvv,
+			payment.State,
+			next,
+			time.Now().UTC(),
+			time.Now().UTC(),
+			payment.MerchantId,
+			payment.Acquirer,
+			payment.CardFingerprint,
+			payment.ClientIp,
+		).Scan(&id, &payment.Version)
+		if err != nil {
+			return err
+		}
+
+		if err := p.events.create(ctx, payment); err != nil {
+			return err
+		}
+
+		if isDue(next) {
+			return p.notifyDue(ctx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
 }
 
 // Get returns a payment model by ID.
 func (p *paymentsImpl) Get(ctx context.Context, id string) (*models.Payment, error) {
+	return p.get(ctx, id, false)
+}
+
+const paymentColumns = `id, amount, currency, card_number, expiry_date, card_holder, cvv, card_fingerprint, client_ip, risk_score, risk_decision, state, created_at, updated_at, acquirer, acquiring_id, acquiring_state, acquiring_version, decline_code, next_attempt_at, attempts, last_error, merchant_id, version`
+
+func scanPayment(row scanner) (*models.Payment, error) {
 	var payment models.Payment
-	err := p.s.querier(ctx).QueryRow(ctx, `
-		SELECT id, amount, currency, card_number, expiry_date, card_holder, cvv, state, created_at, updated_at, acquiring_id, acquiring_state, acquiring_version
-		FROM payments
-		WHERE id = $1;
-		`, id).Scan(&payment.Id,
+	err := row.Scan(
+		&payment.Id,
 		&payment.Amount,
 		&payment.Currency,
 		&payment.CardNumber,
 		&payment.ExpiryDate,
 		&payment.CardHolder,
 		&payment.Cvv,
+		&payment.CardFingerprint,
+		&payment.ClientIp,
+		&payment.RiskScore,
+		&payment.RiskDecision,
 		&payment.State,
 		&payment.CreatedAt,
 		&payment.UpdatedAt,
+		&payment.Acquirer,
 		&payment.AcquiringId,
 		&payment.AcquiringState,
 		&payment.AcquiringVersion,
+		&payment.DeclineCode,
+		&payment.NextAttemptAt,
+		&payment.Attempts,
+		&payment.LastError,
+		&payment.MerchantId,
+		&payment.Version,
 	)
 	return &payment, err
 }
 
-// ListAll returns a list of all payment IDs.
-func (p *paymentsImpl) ListAll(ctx context.Context) ([]string, error) {
-	rows, err := p.s.querier(ctx).Query(ctx, `SELECT id FROM payments;`)
+// get returns a payment model by ID, locking the payment row until the end of the transaction if forUpdate is set.
+func (p *paymentsImpl) get(ctx context.Context, id string, forUpdate bool) (*models.Payment, error) {
+	query := `SELECT ` + paymentColumns + ` FROM payments WHERE id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+	return scanPayment(p.s.querier(ctx).QueryRow(ctx, query, id))
+}
+
+// GetByAcquiringId returns a payment model by the ID of the acquirer payment.
+func (p *paymentsImpl) GetByAcquiringId(ctx context.Context, acquiringId string) (*models.Payment, error) {
+	var id string
+	err := p.s.querier(ctx).QueryRow(ctx, `SELECT id FROM payments WHERE acquiring_id = $1;`, acquiringId).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(ctx, id)
+}
+
+// ClaimDue returns IDs of up to limit active payments that are due for a transition attempt, oldest first,
+// and postpones their next attempt by the lease duration, so that concurrent workers do not pick them up meanwhile.
+// Payments locked by concurrent workers are skipped. Claiming does not change the payment version.
+func (p *paymentsImpl) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]string, error) {
+	now := time.Now().UTC()
+
+	rows, err := p.s.querier(ctx).Query(ctx, `
+		UPDATE payments
+		SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id
+			FROM payments
+			WHERE next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id;
+		`, now, now.Add(lease), limit)
 	if err != nil {
 		return nil, err
 	}
@@ -82,50 +205,271 @@ func (p *paymentsImpl) ListAll(ctx context.Context) ([]string, error) {
 		}
 		ids = append(ids, id)
 	}
-	return ids, nil
+	return ids, rows.Err()
+}
+
+// Claim postpones the next attempt of the given payment by the lease duration if the payment is due
+// for a transition attempt and is not locked by a concurrent worker. It reports whether the payment was claimed.
+func (p *paymentsImpl) Claim(ctx context.Context, id string, lease time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	tag, err := p.s.querier(ctx).Exec(ctx, `
+		UPDATE payments
+		SET next_attempt_at = $3
+		WHERE id IN (
+			SELECT id
+			FROM payments
+			WHERE id = $1 AND next_attempt_at <= $2
+			FOR UPDATE SKIP LOCKED
+		);
+		`, id, now, now.Add(lease))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Reschedule sets the time of the next transition attempt of an active payment, unless the payment has changed
+// since the given version. Like claiming, rescheduling does not change the payment version.
+func (p *paymentsImpl) Reschedule(ctx context.Context, id string, version int64, next time.Time) error {
+	_, err := p.s.querier(ctx).Exec(ctx, `
+		UPDATE payments
+		SET next_attempt_at = $3
+		WHERE id = $1 AND version = $2 AND next_attempt_at IS NOT NULL;
+		`, id, version, next.UTC())
+	return err
+}
+
+// ListenDue calls fn with the ID of every payment that becomes due for a transition attempt immediately,
+// i.e. created or rescheduled to now. Notifications are delivered once the transaction that made the payment due
+// is committed. ListenDue blocks until the context is cancelled or the connection fails.
+func (p *paymentsImpl) ListenDue(ctx context.Context, fn func(id string)) error {
+	return p.s.listen(ctx, paymentsDueChannel, fn)
+}
+
+// Watch returns a channel that receives a value when an update of the payment made by this process is committed,
+// and the function that stops watching. Updates made by other processes are not observed.
+func (p *paymentsImpl) Watch(id string) (<-chan struct{}, func()) {
+	return p.notifier.watch(id)
+}
+
+// notifyDue notifies the transitioners that the payment is due for a transition attempt.
+func (p *paymentsImpl) notifyDue(ctx context.Context, id string) error {
+	_, err := p.s.querier(ctx).Exec(ctx, `SELECT pg_notify($1, $2);`, paymentsDueChannel, id)
+	return err
+}
+
+// ListByStates returns a list of IDs of payments in any of the given states.
+func (p *paymentsImpl) ListByStates(ctx context.Context, states []models.PaymentState) ([]string, error) {
+	names := make([]string, 0, len(states))
+	for _, state := range states {
+		names = append(names, string(state))
+	}
+
+	rows, err := p.s.querier(ctx).Query(ctx, `SELECT id FROM payments WHERE state = ANY($1) ORDER BY created_at;`, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ListDeadLetter returns all payments the transitioner has given up on (see models.PaymentStateNeedsAttention),
+// oldest first.
+func (p *paymentsImpl) ListDeadLetter(ctx context.Context) ([]*models.Payment, error) {
+	rows, err := p.s.querier(ctx).Query(ctx, `SELECT `+paymentColumns+` FROM payments WHERE state = $1 ORDER BY created_at;`,
+		models.PaymentStateNeedsAttention)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []*models.Payment
+	for rows.Next() {
+		payment, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, rows.Err()
+}
+
+// ListActiveAcquirers returns the names of the acquirers that active payments are routed to, in alphabetical order.
+func (p *paymentsImpl) ListActiveAcquirers(ctx context.Context) ([]string, error) {
+	states := make([]string, 0, len(models.ActiveStates()))
+	for _, state := range models.ActiveStates() {
+		states = append(states, string(state))
+	}
+
+	rows, err := p.s.querier(ctx).Query(ctx, `
+		SELECT DISTINCT acquirer FROM payments WHERE state = ANY($1) AND acquirer <> '' ORDER BY acquirer;
+		`, states)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// CountByCardFingerprint returns the number of payments with the given card fingerprint created since the given time.
+func (p *paymentsImpl) CountByCardFingerprint(ctx context.Context, fingerprint string, since time.Time) (int, error) {
+	var n int
+	err := p.s.querier(ctx).QueryRow(ctx, `
+		SELECT count(*) FROM payments WHERE card_fingerprint = $1 AND created_at >= $2;
+		`, fingerprint, since).Scan(&n)
+	return n, err
+}
+
+// CountByClientIp returns the number of payments requested from the given IP address since the given time.
+func (p *paymentsImpl) CountByClientIp(ctx context.Context, ip string, since time.Time) (int, error) {
+	var n int
+	err := p.s.querier(ctx).QueryRow(ctx, `
+		SELECT count(*) FROM payments WHERE client_ip = $1 AND created_at >= $2;
+		`, ip, since).Scan(&n)
+	return n, err
 }
 
 // Update mutates a payment by ID using the given op function.
-func (p *paymentsImpl) Update(ctx context.Context, id string, op func(payment *models.Payment) error) error {
-	payment, err := p.Get(ctx, id)
+// The update is a compare-and-swap: it is applied only if the payment has not been changed since it was read,
+// and fails with a ConflictError otherwise. With the ForUpdate option, the payment is locked when it is read instead,
+// so that concurrent updates wait for each other.
+// Watchers of the payment in this process are notified once the update is committed (see Watch).
+// If the op changes the payment state, the new state is recorded as a payment event.
+// If the op makes the payment due for a transition attempt, a notification is sent to the transitioners (see ListenDue).
+func (p *paymentsImpl) Update(ctx context.Context, id string, op func(payment *models.Payment) error, opts ...UpdateOption) error {
+	var o updateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.forUpdate {
+		// The row lock is held until the end of the transaction, so the read and the write must share one.
+		return p.s.Tx(ctx, func(ctx context.Context) error {
+			return p.update(ctx, id, op, &o)
+		})
+	}
+	return p.update(ctx, id, op, &o)
+}
+
+func (p *paymentsImpl) update(ctx context.Context, id string, op func(payment *models.Payment) error, o *updateOptions) error {
+	payment, err := p.get(ctx, id, o.forUpdate)
 	if err != nil {
 		return err
 	}
+	if o.version != nil && payment.Version != *o.version {
+		return &ConflictError{Id: id, Version: *o.version}
+	}
+	version := payment.Version
+	prevState := payment.State
+	wasDue := isDue(payment.NextAttemptAt)
+
 	if err = op(payment); err != nil {
 		return err
 	}
 
-	_, err = p.s.querier(ctx).Exec(ctx, `
-		UPDATE payments
-		SET amount = $2,
-			currency = $3,
-			card_number = $4,
-			expiry_date = $5,
-			card_holder = $6,
-			cvv = $7,
-			state = $8,
-			acquiring_id = $9,
-			acquiring_state = $10,
-			acquiring_version = $11,
-			updated_at = $12
-		WHERE id = $1;
-		`,
-		payment.Id,
-		payment.Amount,
-		payment.Currency,
-		payment.CardNumber,
-		payment.ExpiryDate,
-		payment.CardHolder,
-		payment.Cvv,
-		payment.State,
-		payment.AcquiringId,
-		payment.AcquiringState,
-		payment.AcquiringVersion,
-		time.Now().UTC(),
-	)
-	if err != nil {
-		return err
+	next := nextAttemptAt(payment)
+	return p.s.Tx(ctx, func(ctx context.Context) error {
+		tag, err := p.s.querier(ctx).Exec(ctx, `
+			UPDATE payments
+			SET amount = $2,
+				currency = $3,
+				card_number = $4,
+				expiry_date = $5,
+				card_holder = $6,
+				cvv = $7,
+				state = $8,
+				acquiring_id = $9,
+				acquiring_state = $10,
+				acquiring_version = $11,
+				next_attempt_at = $12,
+				attempts = $13,
+				last_error = $14,
+				updated_at = $15,
+				acquirer = $16,
+				decline_code = $17,
+				risk_score = $18,
+				risk_decision = $19,
+				version = version + 1
+			WHERE id = $1 AND version = $20;
+			`,
+			payment.Id,
+			payment.Amount,
+			payment.Currency,
+			payment.CardNumber,
+			payment.ExpiryDate,
+			payment.CardHolder,
+			payment.Cvv,
+			payment.State,
+			payment.AcquiringId,
+			payment.AcquiringState,
+			payment.AcquiringVersion,
+			next,
+			payment.Attempts,
+			payment.LastError,
+			time.Now().UTC(),
+			payment.Acquirer,
+			payment.DeclineCode,
+			payment.RiskScore,
+			payment.RiskDecision,
+			version,
+		)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return &ConflictError{Id: id, Version: version}
+		}
+		payment.Version = version + 1
+
+		if payment.State != prevState {
+			if err := p.events.create(ctx, payment); err != nil {
+				return err
+			}
+		}
+		p.s.afterCommit(ctx, func() {
+			p.notifier.notify(payment.Id)
+		})
+
+		if !wasDue && isDue(next) {
+			return p.notifyDue(ctx, payment.Id)
+		}
+		return nil
+	})
+}
+
+// nextAttemptAt returns the time of the next transition attempt of the payment to be persisted.
+// Payments that are not active are not picked up; new payments are due immediately.
+func nextAttemptAt(payment *models.Payment) *time.Time {
+	if !payment.State.IsActive() {
+		return nil
+	}
+	if payment.NextAttemptAt == nil {
+		now := time.Now().UTC()
+		return &now
 	}
+	return payment.NextAttemptAt
+}
 
-	return nil
+// isDue reports whether the next attempt time has come.
+func isDue(next *time.Time) bool {
+	return next != nil && !next.After(time.Now().UTC())
 }
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/store/migrations"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDsnEnv is the environment variable with the connection string of the Postgres database used by the tests.
+// The tests that need Postgres are skipped if it is not set.
+const testDsnEnv = "UPSP_TEST_DSN"
+
+// newPgStore returns a Store backed by the test Postgres database with the schema migrated to the latest version.
+func newPgStore(t *testing.T, opts ...Option) *storeImpl {
+	dsn := os.Getenv(testDsnEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDsnEnv)
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.Connect(ctx, dsn)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	m, err := migrations.New(pool)
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+
+	return New(pool, opts...).(*storeImpl)
+}
+
+func TestStore_WithLock(t *testing.T) {
+	noop := func(ctx context.Context) error { return nil }
+
+	t.Run("exclusive", func(t *testing.T) {
+		ctx := context.Background()
+		s := newPgStore(t)
+		key := uuid.NewString()
+
+		err := s.WithLock(ctx, key, func(ctx context.Context) error {
+			return s.WithLock(ctx, key, noop)
+		})
+		assert.ErrorIs(t, err, ErrLocked)
+		assert.NoError(t, s.WithLock(ctx, key, noop), "lock must be released")
+
+		err = s.Tx(ctx, func(ctx context.Context) error {
+			return s.WithLock(ctx, key, noop)
+		})
+		assert.ErrorIs(t, err, ErrLockInTx)
+	})
+
+	t.Run("expired lease", func(t *testing.T) {
+		ctx := context.Background()
+		s := newPgStore(t)
+		key := uuid.NewString()
+
+		// A lease left behind by a crashed instance.
+		_, err := s.pool.Exec(ctx, `INSERT INTO locks (key, owner, locked_until) VALUES ($1, 'crashed', now() + interval '1 hour');`, key)
+		require.NoError(t, err)
+		assert.ErrorIs(t, s.WithLock(ctx, key, noop), ErrLocked)
+
+		_, err = s.pool.Exec(ctx, `UPDATE locks SET locked_until = now() - interval '1 second' WHERE key = $1;`, key)
+		require.NoError(t, err)
+		assert.NoError(t, s.WithLock(ctx, key, noop), "expired lease must be taken over")
+	})
+
+	t.Run("renewal", func(t *testing.T) {
+		ctx := context.Background()
+		lease := 300 * time.Millisecond
+		s := newPgStore(t, WithLockLease(lease))
+		key := uuid.NewString()
+
+		err := s.WithLock(ctx, key, func(opCtx context.Context) error {
+			time.Sleep(3 * lease)
+			assert.ErrorIs(t, s.WithLock(ctx, key, noop), ErrLocked, "lease must be renewed while the op runs")
+			assert.NoError(t, opCtx.Err())
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("lost lease", func(t *testing.T) {
+		ctx := context.Background()
+		lease := 300 * time.Millisecond
+		s := newPgStore(t, WithLockLease(lease))
+		key := uuid.NewString()
+
+		err := s.WithLock(ctx, key, func(opCtx context.Context) error {
+			// Another instance takes over the lease, e.g. after this one has stalled past its expiry.
+			_, err := s.pool.Exec(ctx, `UPDATE locks SET owner = 'other' WHERE key = $1;`, key)
+			require.NoError(t, err)
+
+			select {
+			case <-opCtx.Done():
+			case <-time.After(3 * lease):
+				t.Error("op must be cancelled once the lease is lost")
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		var owner string
+		require.NoError(t, s.pool.QueryRow(ctx, `SELECT owner FROM locks WHERE key = $1;`, key).Scan(&owner))
+		assert.Equal(t, "other", owner, "the lock of another owner must not be released")
+	})
+}
+
+func TestStore_Tx(t *testing.T) {
+	// lockRow creates a row to update concurrently. The locks table is used, as it has no constraints to satisfy.
+	lockRow := func(t *testing.T, s *storeImpl) string {
+		key := uuid.NewString()
+		_, err := s.pool.Exec(context.Background(), `INSERT INTO locks (key, owner, locked_until) VALUES ($1, '', now());`, key)
+		require.NoError(t, err)
+		return key
+	}
+	setOwner := func(ctx context.Context, s *storeImpl, key, owner string) error {
+		_, err := s.querier(ctx).Exec(ctx, `UPDATE locks SET owner = $2 WHERE key = $1;`, key, owner)
+		return err
+	}
+	ownerOf := func(t *testing.T, s *storeImpl, key string) string {
+		var owner string
+		require.NoError(t, s.pool.QueryRow(context.Background(), `SELECT owner FROM locks WHERE key = $1;`, key).Scan(&owner))
+		return owner
+	}
+
+	t.Run("savepoint", func(t *testing.T) {
+		ctx := context.Background()
+		s := newPgStore(t)
+		outer, inner := lockRow(t, s), lockRow(t, s)
+		errAbort := errors.New("abort")
+
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			if err := setOwner(ctx, s, outer, "outer"); err != nil {
+				return err
+			}
+			err := s.Tx(ctx, func(ctx context.Context) error {
+				if err := setOwner(ctx, s, inner, "inner"); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			assert.ErrorIs(t, err, errAbort)
+			return nil
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, "outer", ownerOf(t, s, outer))
+		assert.Equal(t, "", ownerOf(t, s, inner), "changes of the failed savepoint must be rolled back")
+	})
+
+	t.Run("serialization failure", func(t *testing.T) {
+		ctx := context.Background()
+		s := newPgStore(t)
+		key := lockRow(t, s)
+
+		attempts := 0
+		err := s.Tx(ctx, func(ctx context.Context) error {
+			attempts++
+			var owner string
+			if err := s.querier(ctx).QueryRow(ctx, `SELECT owner FROM locks WHERE key = $1;`, key).Scan(&owner); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				// A concurrent transaction changes the row after this one has taken its snapshot.
+				if _, err := s.pool.Exec(ctx, `UPDATE locks SET owner = 'concurrent' WHERE key = $1;`, key); err != nil {
+					return err
+				}
+			}
+			return setOwner(ctx, s, key, "tx")
+		}, WithIsolation(RepeatableRead))
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, attempts, "transaction must be retried after a serialization failure")
+		assert.Equal(t, "tx", ownerOf(t, s, key))
+	})
+
+	t.Run("deadlock", func(t *testing.T) {
+		ctx := context.Background()
+		s := newPgStore(t)
+		a, b := lockRow(t, s), lockRow(t, s)
+
+		var attempts int32
+		var locked sync.WaitGroup
+		locked.Add(2)
+		run := func(first, second, owner string) error {
+			runs := 0
+			return s.Tx(ctx, func(ctx context.Context) error {
+				atomic.AddInt32(&attempts, 1)
+				runs++
+				if err := setOwner(ctx, s, first, owner); err != nil {
+					return err
+				}
+				if runs == 1 {
+					// Both transactions hold their first row before they try to update the other one.
+					locked.Done()
+					locked.Wait()
+				}
+				return setOwner(ctx, s, second, owner)
+			})
+		}
+
+		errs := make(chan error, 2)
+		go func() { errs <- run(a, b, "ab") }()
+		go func() { errs <- run(b, a, "ba") }()
+		require.NoError(t, <-errs)
+		require.NoError(t, <-errs)
+
+		assert.Equal(t, int32(3), atomic.LoadInt32(&attempts), "the deadlocked transaction must be retried once")
+		assert.Equal(t, ownerOf(t, s, a), ownerOf(t, s, b), "the retried transaction must update both rows")
+	})
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+// RiskRules is an interface for accessing the fraud and risk rules applied to new payments.
+type RiskRules interface {
+	List(ctx context.Context) ([]*models.RiskRule, error)
+	Get(ctx context.Context, id string) (*models.RiskRule, error)
+	Save(ctx context.Context, rule *models.RiskRule) error
+	Delete(ctx context.Context, id string) error
+}
+
+type riskRulesImpl struct {
+	s *storeImpl
+}
+
+const riskRuleColumns = `id, kind, action, score, enabled, params, created_at, updated_at`
+
+// List returns all risk rules in the order of creation.
+func (r *riskRulesImpl) List(ctx context.Context) ([]*models.RiskRule, error) {
+	rows, err := r.s.querier(ctx).Query(ctx, `
+		SELECT `+riskRuleColumns+`
+		FROM risk_rules
+		ORDER BY created_at, id;
+		`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*models.RiskRule
+	for rows.Next() {
+		rule, err := scanRiskRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Get returns a risk rule by ID.
+func (r *riskRulesImpl) Get(ctx context.Context, id string) (*models.RiskRule, error) {
+	row := r.s.querier(ctx).QueryRow(ctx, `
+		SELECT `+riskRuleColumns+`
+		FROM risk_rules
+		WHERE id = $1;
+		`, id)
+	return scanRiskRule(row)
+}
+
+// Save creates a risk rule or replaces an existing one.
+func (r *riskRulesImpl) Save(ctx context.Context, rule *models.RiskRule) error {
+	params, err := json.Marshal(&rule.Params)
+	if err != nil {
+		return fmt.Errorf("failed to encode risk rule params: %w", err)
+	}
+	now := time.Now().UTC()
+
+	return r.s.querier(ctx).QueryRow(ctx, `
+		INSERT INTO risk_rules (id, kind, action, score, enabled, params, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			kind = excluded.kind,
+			action = excluded.action,
+			score = excluded.score,
+			enabled = excluded.enabled,
+			params = excluded.params,
+			updated_at = excluded.updated_at
+		RETURNING created_at, updated_at;
+		`,
+		rule.Id,
+		rule.Kind,
+		rule.Action,
+		rule.Score,
+		rule.Enabled,
+		string(params),
+		now,
+	).Scan(&rule.CreatedAt, &rule.UpdatedAt)
+}
+
+// Delete removes a risk rule by ID.
+func (r *riskRulesImpl) Delete(ctx context.Context, id string) error {
+	tag, err := r.s.querier(ctx).Exec(ctx, `DELETE FROM risk_rules WHERE id = $1;`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func scanRiskRule(row scanner) (*models.RiskRule, error) {
+	var rule models.RiskRule
+	var params []byte
+	err := row.Scan(
+		&rule.Id,
+		&rule.Kind,
+		&rule.Action,
+		&rule.Score,
+		&rule.Enabled,
+		&params,
+		&rule.CreatedAt,
+		&rule.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(params, &rule.Params); err != nil {
+		return nil, fmt.Errorf("failed to decode risk rule params: %w", err)
+	}
+	return &rule, nil
+}
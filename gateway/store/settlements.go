@@ -0,0 +1,248 @@
+package store
+
+import (
+	"context"
+	"mkuznets.com/go/upsp/gateway/models"
+	"time"
+)
+
+// Settlements is an interface for accessing ingested settlement reports and their reconciliation results.
+type Settlements interface {
+	GetBatch(ctx context.Context, id string) (*models.SettlementBatch, error)
+	CreateBatch(ctx context.Context, batch *models.SettlementBatch) error
+	ListBatches(ctx context.Context) ([]*models.SettlementBatch, error)
+	CountLines(ctx context.Context, acquiringId string, entryType models.SettlementEntryType) (int, error)
+	ListUnmatchedLines(ctx context.Context) ([]*models.SettlementLine, error)
+	DetectMissing(ctx context.Context, acquirer string, before time.Time) error
+	ListMissing(ctx context.Context) ([]*models.MissingSettlement, error)
+}
+
+type settlementsImpl struct {
+	s *storeImpl
+}
+
+// GetBatch returns an ingested settlement batch by the acquirer batch ID, without lines.
+func (st *settlementsImpl) GetBatch(ctx context.Context, id string) (*models.SettlementBatch, error) {
+	var b models.SettlementBatch
+	err := st.s.querier(ctx).QueryRow(ctx, `
+		SELECT id, settlement_date, currency, cutoff_at, gross, fees, net, ingested_at
+		FROM settlement_batches
+		WHERE id = $1;
+		`, id).Scan(
+		&b.Id,
+		&b.Date,
+		&b.Currency,
+		&b.CutoffAt,
+		&b.Gross,
+		&b.Fees,
+		&b.Net,
+		&b.IngestedAt,
+	)
+	return &b, err
+}
+
+// CreateBatch persists an ingested settlement batch along with its lines.
+func (st *settlementsImpl) CreateBatch(ctx context.Context, batch *models.SettlementBatch) error {
+	return st.s.Tx(ctx, func(ctx context.Context) error {
+		_, err := st.s.querier(ctx).Exec(ctx, `
+			INSERT INTO settlement_batches (id, settlement_date, currency, cutoff_at, gross, fees, net, ingested_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+			`,
+			batch.Id,
+			batch.Date,
+			batch.Currency,
+			batch.CutoffAt,
+			batch.Gross,
+			batch.Fees,
+			batch.Net,
+			time.Now().UTC(),
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range batch.Lines {
+			_, err := st.s.querier(ctx).Exec(ctx, `
+				INSERT INTO settlement_lines (batch_id, acquiring_id, payment_id, type, currency, amount, fee, net, status, created_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+				`,
+				batch.Id,
+				line.AcquiringId,
+				line.PaymentId,
+				line.Type,
+				line.Currency,
+				line.Amount,
+				line.Fee,
+				line.Net,
+				line.Status,
+				line.CreatedAt,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ListBatches returns all ingested settlement batches with line counts, most recent first.
+func (st *settlementsImpl) ListBatches(ctx context.Context) ([]*models.SettlementBatch, error) {
+	rows, err := st.s.querier(ctx).Query(ctx, `
+		SELECT b.id, b.settlement_date, b.currency, b.cutoff_at, b.gross, b.fees, b.net, b.ingested_at,
+			(SELECT count(*) FROM settlement_lines l WHERE l.batch_id = b.id),
+			(SELECT count(*) FROM settlement_lines l WHERE l.batch_id = b.id AND l.status = $1)
+		FROM settlement_batches b
+		ORDER BY b.cutoff_at DESC, b.currency;
+		`, models.SettlementStatusMatched)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []*models.SettlementBatch
+	for rows.Next() {
+		var b models.SettlementBatch
+		err := rows.Scan(
+			&b.Id,
+			&b.Date,
+			&b.Currency,
+			&b.CutoffAt,
+			&b.Gross,
+			&b.Fees,
+			&b.Net,
+			&b.IngestedAt,
+			&b.LineCount,
+			&b.MatchedCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, &b)
+	}
+	return batches, rows.Err()
+}
+
+// CountLines returns the number of settled lines of the given type for the acquirer payment.
+func (st *settlementsImpl) CountLines(ctx context.Context, acquiringId string, entryType models.SettlementEntryType) (int, error) {
+	var n int
+	err := st.s.querier(ctx).QueryRow(ctx, `
+		SELECT count(*) FROM settlement_lines WHERE acquiring_id = $1 AND type = $2;
+		`, acquiringId, entryType).Scan(&n)
+	return n, err
+}
+
+// ListUnmatchedLines returns all settlement lines that did not match a gateway payment.
+func (st *settlementsImpl) ListUnmatchedLines(ctx context.Context) ([]*models.SettlementLine, error) {
+	rows, err := st.s.querier(ctx).Query(ctx, `
+		SELECT id, batch_id, acquiring_id, payment_id, type, currency, amount, fee, net, status, created_at
+		FROM settlement_lines
+		WHERE status <> $1
+		ORDER BY id;
+		`, models.SettlementStatusMatched)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []*models.SettlementLine
+	for rows.Next() {
+		var l models.SettlementLine
+		err := rows.Scan(
+			&l.Id,
+			&l.BatchId,
+			&l.AcquiringId,
+			&l.PaymentId,
+			&l.Type,
+			&l.Currency,
+			&l.Amount,
+			&l.Fee,
+			&l.Net,
+			&l.Status,
+			&l.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, &l)
+	}
+	return lines, rows.Err()
+}
+
+// DetectMissing records settlement entries expected for gateway payments of the given acquirer last updated
+// before the given time that have not been settled, and resolves previously missing entries that have been settled since.
+func (st *settlementsImpl) DetectMissing(ctx context.Context, acquirer string, before time.Time) error {
+	return st.s.Tx(ctx, func(ctx context.Context) error {
+		_, err := st.s.querier(ctx).Exec(ctx, `
+			WITH expected AS (
+				SELECT id, acquiring_id, currency, $2::text AS type, amount
+				FROM payments
+				WHERE state IN ($5, $6, $7, $8) AND updated_at < $1 AND acquirer = $9
+				UNION ALL
+				SELECT id, acquiring_id, currency, $3::text, -amount
+				FROM payments
+				WHERE state = $6 AND updated_at < $1 AND acquirer = $9
+				UNION ALL
+				SELECT id, acquiring_id, currency, $4::text, -amount
+				FROM payments
+				WHERE state = $8 AND updated_at < $1 AND acquirer = $9
+			)
+			INSERT INTO settlement_missing (payment_id, type, currency, amount, detected_at)
+			SELECT e.id, e.type, e.currency, e.amount, now()
+			FROM expected e
+			WHERE NOT EXISTS (
+				SELECT 1 FROM settlement_lines l WHERE l.acquiring_id = e.acquiring_id AND l.type = e.type
+			)
+			ON CONFLICT (payment_id, type) DO NOTHING;
+			`,
+			before,
+			models.SettlementEntryPayment,
+			models.SettlementEntryRefund,
+			models.SettlementEntryChargeback,
+			models.PaymentStateActionPaid,
+			models.PaymentStateRefunded,
+			models.PaymentStateDisputed,
+			models.PaymentStateChargedBack,
+			acquirer,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = st.s.querier(ctx).Exec(ctx, `
+			UPDATE settlement_missing m
+			SET resolved_at = now()
+			FROM payments p
+			WHERE m.payment_id = p.id
+				AND m.resolved_at IS NULL
+				AND EXISTS (
+					SELECT 1 FROM settlement_lines l WHERE l.acquiring_id = p.acquiring_id AND l.type = m.type
+				);
+			`)
+		return err
+	})
+}
+
+// ListMissing returns all unresolved missing settlement entries.
+func (st *settlementsImpl) ListMissing(ctx context.Context) ([]*models.MissingSettlement, error) {
+	rows, err := st.s.querier(ctx).Query(ctx, `
+		SELECT payment_id, type, currency, amount, detected_at
+		FROM settlement_missing
+		WHERE resolved_at IS NULL
+		ORDER BY detected_at, payment_id;
+		`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []*models.MissingSettlement
+	for rows.Next() {
+		var m models.MissingSettlement
+		if err := rows.Scan(&m.PaymentId, &m.Type, &m.Currency, &m.Amount, &m.DetectedAt); err != nil {
+			return nil, err
+		}
+		missing = append(missing, &m)
+	}
+	return missing, rows.Err()
+}
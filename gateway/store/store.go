@@ -2,36 +2,106 @@ package store
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/jackc/pgtype/pgxtype"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"time"
 )
 
 type dbContextKey string
 
+var (
+	// ErrLocked is returned by Store.WithLock when the lock is held by someone else.
+	ErrLocked = errors.New("locked by another session")
+	// ErrLockInTx is returned by Store.WithLock when it is called within a transaction.
+	ErrLockInTx = errors.New("locks cannot be taken within a transaction")
+	// ErrNotFound is returned when the requested object does not exist.
+	// It is pgx.ErrNoRows, so that every Store implementation reports missing objects the same way.
+	ErrNotFound = pgx.ErrNoRows
+)
+
 // Store is a database abstraction that is used to access gateway objects
 // and initiate transactions that span multiple database operations.
 type Store interface {
-	querier(ctx context.Context) pgxtype.Querier
-
 	// Payments returns an interface for accessing gateway payments.
 	Payments() Payments
+	// Disputes returns an interface for accessing gateway disputes.
+	Disputes() Disputes
+	// Settlements returns an interface for accessing ingested settlement reports.
+	Settlements() Settlements
+	// Discrepancies returns an interface for accessing state discrepancies between gateway and acquirer payments.
+	Discrepancies() Discrepancies
+	// Merchants returns an interface for accessing merchant settings.
+	Merchants() Merchants
+	// RiskRules returns an interface for accessing the fraud and risk rules applied to new payments.
+	RiskRules() RiskRules
+	// PaymentEvents returns an interface for accessing the history of payment state changes.
+	PaymentEvents() PaymentEvents
 	// Tx wraps the given op function in a transaction. The op may include multiple operations tied to the same Store instance.
-	Tx(ctx context.Context, op func(context.Context) error) error
+	// A Tx nested in another one is a savepoint: if its op fails, only the changes of the op are rolled back,
+	// and the outer op decides whether to fail too.
+	Tx(ctx context.Context, op func(context.Context) error, opts ...TxOption) error
+	// WithLock runs the given op function holding a lock on the given key,
+	// which makes the op exclusive across all gateway instances. It does not wait for the lock:
+	// if another session holds it, ErrLocked is returned. The lock must be taken outside of a transaction,
+	// otherwise ErrLockInTx is returned; the op may start transactions of its own.
+	WithLock(ctx context.Context, key string, op func(context.Context) error) error
 }
 
 type storeImpl struct {
-	pool     *pgxpool.Pool
-	payments Payments
+	pool          *pgxpool.Pool
+	txRetryPolicy TxRetryPolicy
+	lockLease     time.Duration
+	payments      Payments
+	disputes      Disputes
+	settlements   Settlements
+	discrepancies Discrepancies
+	merchants     Merchants
+	riskRules     RiskRules
+	paymentEvents *paymentEventsImpl
+}
+
+// Option configures the Postgres Store.
+type Option func(*storeImpl)
+
+// WithTxRetryPolicy sets the policy to retry transactions failed due to a serialization failure or a deadlock.
+func WithTxRetryPolicy(p TxRetryPolicy) Option {
+	return func(s *storeImpl) {
+		s.txRetryPolicy = p
+	}
+}
+
+// WithLockLease sets how long a lock taken by WithLock outlives a gateway instance that has stopped renewing it,
+// e.g. because it has crashed. A lease that is not positive is ignored.
+func WithLockLease(lease time.Duration) Option {
+	return func(s *storeImpl) {
+		if lease > 0 {
+			s.lockLease = lease
+		}
+	}
 }
 
-// New creates a new Store instance.
-func New(pool *pgxpool.Pool) Store {
+// New creates a new Store instance backed by Postgres.
+func New(pool *pgxpool.Pool, opts ...Option) Store {
 	s := &storeImpl{
-		pool: pool,
+		pool:          pool,
+		txRetryPolicy: DefaultTxRetryPolicy,
+		lockLease:     time.Minute,
 	}
-	s.payments = &paymentsImpl{s: s}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.paymentEvents = &paymentEventsImpl{s: s}
+	s.payments = &paymentsImpl{s: s, events: s.paymentEvents, notifier: newNotifier()}
+	s.disputes = &disputesImpl{s: s}
+	s.settlements = &settlementsImpl{s: s}
+	s.discrepancies = &discrepanciesImpl{s: s}
+	s.merchants = &merchantsImpl{s: s}
+	s.riskRules = &riskRulesImpl{s: s}
 	return s
 }
 
@@ -40,50 +110,254 @@ func (s *storeImpl) Payments() Payments {
 	return s.payments
 }
 
+// Disputes returns an interface for accessing gateway disputes.
+func (s *storeImpl) Disputes() Disputes {
+	return s.disputes
+}
+
+// Settlements returns an interface for accessing ingested settlement reports.
+func (s *storeImpl) Settlements() Settlements {
+	return s.settlements
+}
+
+// Discrepancies returns an interface for accessing state discrepancies between gateway and acquirer payments.
+func (s *storeImpl) Discrepancies() Discrepancies {
+	return s.discrepancies
+}
+
+// Merchants returns an interface for accessing merchant settings.
+func (s *storeImpl) Merchants() Merchants {
+	return s.merchants
+}
+
+// RiskRules returns an interface for accessing the fraud and risk rules applied to new payments.
+func (s *storeImpl) RiskRules() RiskRules {
+	return s.riskRules
+}
+
+// PaymentEvents returns an interface for accessing the history of payment state changes.
+func (s *storeImpl) PaymentEvents() PaymentEvents {
+	return s.paymentEvents
+}
+
+// pgTx is a transaction of the Postgres store or, if nested, a savepoint.
+type pgTx struct {
+	tx        pgx.Tx
+	isolation IsolationLevel
+	// hooks are run once the outermost transaction is committed (see afterCommit).
+	hooks []func()
+}
+
 func (s *storeImpl) querier(ctx context.Context) pgxtype.Querier {
 	t := ctx.Value(dbContextKey("tx"))
 	if t != nil {
-		return t.(pgx.Tx)
+		return t.(*pgTx).tx
 	}
 	return s.pool
 }
 
-func (s *storeImpl) tx(ctx context.Context) (pgx.Tx, bool, error) {
-	t := ctx.Value(dbContextKey("tx"))
-	if t != nil {
-		return t.(pgx.Tx), false, nil
+// Tx wraps the given op function in a transaction. The op may include multiple operations tied to the same Store instance.
+//
+// A Tx nested in another one runs the op in a savepoint, which is rolled back if the op fails.
+// The outermost Tx runs the op in a new transaction, which is committed if the op succeeds and rolled back otherwise.
+// If the transaction fails due to a serialization failure or a deadlock, the whole op is run again
+// in a new transaction according to the retry policy of the store, so the op must be safe to repeat.
+// Errors of a nested Tx must be returned by the outer op for the transaction to be retried.
+func (s *storeImpl) Tx(ctx context.Context, op func(context.Context) error, opts ...TxOption) error {
+	var o txOptions
+	for _, opt := range opts {
+		opt(&o)
 	}
-	tx, err := s.pool.Begin(ctx)
-	if err != nil {
-		return nil, false, fmt.Errorf("could not start transaction: %w", err)
+
+	if t := ctx.Value(dbContextKey("tx")); t != nil {
+		return s.savepoint(ctx, t.(*pgTx), op, &o)
+	}
+	if o.isolation == "" {
+		o.isolation = ReadCommitted
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.tx(ctx, op, &o)
+		if !isRetryable(err) || attempt >= s.txRetryPolicy.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(s.txRetryPolicy.backoff(attempt)):
+		}
 	}
-	return tx, true, nil
 }
 
-// Tx wraps the given op function in a transaction. The op may include multiple operations tied to the same Store instance.
-func (s *storeImpl) Tx(ctx context.Context, op func(context.Context) error) error {
-	tx, isInner, err := s.tx(ctx)
+// tx runs the op in a new transaction and runs the after-commit hooks once it is committed.
+func (s *storeImpl) tx(ctx context.Context, op func(context.Context) error, o *txOptions) error {
+	txOpts := pgx.TxOptions{IsoLevel: pgx.TxIsoLevel(o.isolation)}
+
+	tx, err := s.pool.BeginTx(ctx, txOpts)
 	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	t := &pgTx{tx: tx, isolation: o.isolation}
+	if err := op(context.WithValue(ctx, dbContextKey("tx"), t)); err != nil {
 		return err
 	}
 
-	ctx = context.WithValue(ctx, dbContextKey("tx"), tx)
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+	for _, fn := range t.hooks {
+		fn()
+	}
+	return nil
+}
+
+// savepoint runs the op in a savepoint of the parent transaction. The after-commit hooks of the op
+// are passed to the parent once the savepoint is released, and are dropped if it is rolled back.
+func (s *storeImpl) savepoint(ctx context.Context, parent *pgTx, op func(context.Context) error, o *txOptions) error {
+	if o.isolation != "" && o.isolation != parent.isolation {
+		return fmt.Errorf("nested transaction cannot change isolation level from %s to %s", parent.isolation, o.isolation)
+	}
 
-	if isInner {
-		defer func(tx pgx.Tx, ctx context.Context) {
-			_ = tx.Rollback(ctx)
-		}(tx, ctx)
+	sp, err := parent.tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not create savepoint: %w", err)
 	}
 
-	if err := op(ctx); err != nil {
+	t := &pgTx{tx: sp, isolation: parent.isolation}
+	if err := op(context.WithValue(ctx, dbContextKey("tx"), t)); err != nil {
+		// If the rollback fails, so does the parent transaction.
+		_ = sp.Rollback(ctx)
 		return err
 	}
 
-	if isInner {
-		if err := tx.Commit(ctx); err != nil {
-			return fmt.Errorf("could not commit transaction: %v", err)
+	if err := sp.Commit(ctx); err != nil {
+		return fmt.Errorf("could not release savepoint: %w", err)
+	}
+	parent.hooks = append(parent.hooks, t.hooks...)
+	return nil
+}
+
+// afterCommit runs the given function once the outermost transaction is committed,
+// or right away if there is no transaction. The function is not run if the transaction
+// or the savepoint it is registered in is rolled back.
+func (s *storeImpl) afterCommit(ctx context.Context, fn func()) {
+	t := ctx.Value(dbContextKey("tx"))
+	if t == nil {
+		fn()
+		return
+	}
+	tx := t.(*pgTx)
+	tx.hooks = append(tx.hooks, fn)
+}
+
+// WithLock runs the given op function holding a lock on the given key.
+//
+// The lock is a lease in the locks table: it is taken and renewed by short statements,
+// so that no connection is held while the op runs, e.g. during acquirer calls. If the lease cannot be renewed,
+// the op context is cancelled, as another gateway instance may take the lock once the lease has expired.
+// The statements run outside of any transaction, so the lock cannot be taken within one.
+// Leases replace the advisory locks used before, which held a connection or a transaction for as long as the op ran.
+func (s *storeImpl) WithLock(ctx context.Context, key string, op func(context.Context) error) error {
+	if ctx.Value(dbContextKey("tx")) != nil {
+		return ErrLockInTx
+	}
+
+	owner := uuid.NewString()
+	tag, err := s.pool.Exec(ctx, `
+		INSERT INTO locks (key, owner, locked_until)
+		VALUES ($1, $2, now() + $3::interval)
+		ON CONFLICT (key) DO UPDATE SET owner = excluded.owner, locked_until = excluded.locked_until
+		WHERE locks.locked_until < now();
+		`, key, owner, s.lockLease)
+	if err != nil {
+		return fmt.Errorf("could not acquire lock: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLocked
+	}
+
+	opCtx, cancel := context.WithCancel(ctx)
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		s.renewLock(opCtx, cancel, key, owner)
+	}()
+
+	defer func() {
+		cancel()
+		<-renewed
+		// The release must not depend on the op context, which is cancelled by now.
+		_, err := s.pool.Exec(context.Background(), `DELETE FROM locks WHERE key = $1 AND owner = $2;`, key, owner)
+		if err != nil {
+			log.Printf("[WARN] could not release lock %s, it expires in %s: %v", key, s.lockLease, err)
+		}
+	}()
+
+	return op(opCtx)
+}
+
+// renewLock extends the lease of the lock held by the owner until the context is cancelled.
+// If the lease cannot be extended, the lock is considered lost and cancel is called.
+func (s *storeImpl) renewLock(ctx context.Context, cancel func(), key, owner string) {
+	ticker := time.NewTicker(s.lockLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
+
+		tag, err := s.pool.Exec(ctx, `
+			UPDATE locks SET locked_until = now() + $3::interval
+			WHERE key = $1 AND owner = $2;
+			`, key, owner, s.lockLease)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("[ERR] could not renew lock %s: %v", key, err)
+			cancel()
+			return
+		case tag.RowsAffected() == 0:
+			log.Printf("[ERR] lock %s has expired and been taken over", key)
+			cancel()
+			return
+		}
+	}
+}
+
+// listen subscribes to the given notification channel on a dedicated connection and calls fn with the payload
+// of every notification. It blocks until the context is cancelled or the connection fails.
+func (s *storeImpl) listen(ctx context.Context, channel string, fn func(payload string)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("could not acquire connection: %w", err)
 	}
+	defer conn.Release()
 
-	return nil
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("could not listen to %s: %w", channel, err)
+	}
+
+	defer func() {
+		// The connection goes back to the pool, it must not keep receiving notifications.
+		if _, err := conn.Exec(context.Background(), "UNLISTEN *"); err != nil {
+			_ = conn.Conn().Close(context.Background())
+		}
+	}()
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		fn(n.Payload)
+	}
 }
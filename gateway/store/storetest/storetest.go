@@ -0,0 +1,71 @@
+// Package storetest provides payment fixtures for tests of the packages built on top of the gateway store.
+package storetest
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/money"
+	"testing"
+)
+
+// Option overrides a field of a fixture payment.
+type Option func(p *models.Payment)
+
+// Payments is the part of store.Payments used by the fixtures.
+// It is declared here so that the tests of the store package itself can use them without an import cycle.
+type Payments interface {
+	Create(ctx context.Context, payment *models.Payment) (string, error)
+}
+
+// WithId sets the payment id.
+func WithId(id string) Option {
+	return func(p *models.Payment) { p.Id = id }
+}
+
+// WithMerchantId sets the merchant of the payment.
+func WithMerchantId(merchantId string) Option {
+	return func(p *models.Payment) { p.MerchantId = merchantId }
+}
+
+// WithAmount sets the payment amount in minor units, keeping the currency.
+func WithAmount(amount int64) Option {
+	return func(p *models.Payment) { p.Money = money.New(amount, p.Money.Currency) }
+}
+
+// WithState sets the payment state.
+func WithState(state models.PaymentState) Option {
+	return func(p *models.Payment) { p.State = state }
+}
+
+// WithCardNumber sets the number of the card the payment is made with.
+func WithCardNumber(number string) Option {
+	return func(p *models.Payment) { p.CardNumber = number }
+}
+
+// NewPayment returns a processing payment of 1.00 EUR paid with a valid test card.
+func NewPayment(opts ...Option) *models.Payment {
+	p := &models.Payment{
+		Id:         uuid.NewString(),
+		Money:      money.New(100, "EUR"),
+		State:      models.PaymentStateProcessing,
+		CardNumber: "4242424242424242",
+		CardHolder: "Jane Doe",
+		ExpiryDate: "0130",
+		Cvv:        "123",
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// CreatePayment saves a payment built by NewPayment and fails the test if it cannot be saved.
+func CreatePayment(t testing.TB, payments Payments, opts ...Option) *models.Payment {
+	t.Helper()
+	p := NewPayment(opts...)
+	_, err := payments.Create(context.Background(), p)
+	require.NoError(t, err)
+	return p
+}
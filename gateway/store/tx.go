@@ -0,0 +1,64 @@
+package store
+
+import (
+	"errors"
+	"github.com/jackc/pgconn"
+	"mkuznets.com/go/upsp/backoff"
+	"time"
+)
+
+// IsolationLevel is the isolation level of a transaction.
+type IsolationLevel string
+
+const (
+	ReadCommitted  IsolationLevel = "read committed"
+	RepeatableRead IsolationLevel = "repeatable read"
+	Serializable   IsolationLevel = "serializable"
+)
+
+type txOptions struct {
+	isolation IsolationLevel
+}
+
+// TxOption configures a transaction started by Store.Tx.
+type TxOption func(*txOptions)
+
+// WithIsolation sets the isolation level of the transaction, ReadCommitted by default.
+// A nested transaction has the isolation level of the outer one and cannot request another.
+func WithIsolation(level IsolationLevel) TxOption {
+	return func(o *txOptions) {
+		o.isolation = level
+	}
+}
+
+// TxRetryPolicy defines how transactions failed due to a serialization failure or a deadlock are retried.
+type TxRetryPolicy struct {
+	// MaxAttempts is the number of times the transaction is run before the error is returned.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry. Each subsequent retry doubles the delay.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+}
+
+// DefaultTxRetryPolicy retries a transaction a few times within a second.
+var DefaultTxRetryPolicy = TxRetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   10 * time.Millisecond,
+	MaxDelay:    500 * time.Millisecond,
+}
+
+// backoff returns the delay before the next run after the given number of failed runs.
+func (p TxRetryPolicy) backoff(attempts int) time.Duration {
+	return backoff.Exponential(p.BaseDelay, p.MaxDelay, attempts)
+}
+
+// isRetryable reports whether the transaction has failed due to a serialization failure (SQLSTATE 40001)
+// or a deadlock (SQLSTATE 40P01), and succeeds if it is run again.
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
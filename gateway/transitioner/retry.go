@@ -0,0 +1,34 @@
+package transitioner
+
+import (
+	"mkuznets.com/go/upsp/backoff"
+	"time"
+)
+
+// RetryPolicy defines how failed transition attempts of a payment are retried by the background worker.
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry. Each subsequent retry doubles the delay.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// MaxAttempts is the number of consecutive failed attempts after which the payment needs attention.
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy retries a payment for about an hour before giving up.
+var DefaultRetryPolicy = RetryPolicy{
+	BaseDelay:   5 * time.Second,
+	MaxDelay:    10 * time.Minute,
+	MaxAttempts: 12,
+}
+
+// Backoff returns the delay before the next attempt after the given number of consecutive failed attempts.
+// The delay grows exponentially and is jittered (see backoff.Exponential).
+func (p RetryPolicy) Backoff(attempts int) time.Duration {
+	return backoff.Exponential(p.BaseDelay, p.MaxDelay, attempts)
+}
+
+// Exhausted returns true if the payment should not be retried after the given number of consecutive failed attempts.
+func (p RetryPolicy) Exhausted(attempts int) bool {
+	return attempts >= p.MaxAttempts
+}
@@ -2,129 +2,598 @@ package transitioner
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"log"
-	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
 	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/risk"
+	"mkuznets.com/go/upsp/gateway/routing"
 	"mkuznets.com/go/upsp/gateway/store"
+	"sync"
 	"time"
 )
 
+var (
+	// errNoChanges aborts a payment update that has nothing to change.
+	errNoChanges = errors.New("no changes")
+
+	// errPaymentChanged aborts persisting the outcome of a saga step if the payment has changed since the step started.
+	errPaymentChanged = errors.New("payment has changed concurrently")
+
+	// errDisputeChanged aborts persisting the outcome of an evidence submission if the dispute has changed meanwhile.
+	errDisputeChanged = errors.New("dispute has changed concurrently")
+)
+
 // Transitioner is a service that transitions payments through the acquiring process.
 // It works both as a synchronous transitioner and as a background worker.
 type Transitioner interface {
 	Start(ctx context.Context)
 	Transition(ctx context.Context, id string) error
+	TransitionDispute(ctx context.Context, id string) error
 }
 
 type transitionerImpl struct {
-	s   store.Store
-	acq acquirer.Acquirer
+	s      store.Store
+	router routing.Router
+
+	risk     risk.Engine
+	riskOpts []risk.Option
+
+	batchSize    int
+	pollInterval time.Duration
+	retryPolicy  RetryPolicy
+	concurrency  int
+	drainTimeout time.Duration
+
+	// settledMinDelay and settledMaxDelay bound the delay between syncs of settled payments.
+	settledMinDelay time.Duration
+	settledMaxDelay time.Duration
+
+	// locks serialises transitions of the same payment.
+	locks *keyedMutex
+}
+
+// Option configures the Transitioner.
+type Option func(*transitionerImpl)
+
+// WithBatchSize sets the maximum number of payments claimed by the background worker at once.
+func WithBatchSize(n int) Option {
+	return func(t *transitionerImpl) {
+		t.batchSize = n
+	}
+}
+
+// WithPollInterval sets the interval between transition attempts of an active payment,
+// and between the background worker runs when there are no due payments.
+func WithPollInterval(d time.Duration) Option {
+	return func(t *transitionerImpl) {
+		t.pollInterval = d
+	}
 }
 
-// New creates a new Transitioner.
-func New(s store.Store, acq acquirer.Acquirer) Transitioner {
+// WithRetryPolicy sets the policy to retry failed transitions in the background.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(t *transitionerImpl) {
+		t.retryPolicy = p
+	}
+}
+
+// WithConcurrency sets the number of payments the background worker transitions in parallel.
+func WithConcurrency(n int) Option {
+	return func(t *transitionerImpl) {
+		t.concurrency = n
+	}
+}
+
+// WithDrainTimeout sets how long the background worker waits for the transitions in progress
+// to finish once it is stopped.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(t *transitionerImpl) {
+		t.drainTimeout = d
+	}
+}
+
+// WithSettledResync sets the bounds of the delay between syncs of settled (paid or disputed) payments
+// with the acquirer. Within the bounds, the delay is the age of the payment, so that a payment is synced
+// less and less often as it gets older.
+func WithSettledResync(min, max time.Duration) Option {
+	return func(t *transitionerImpl) {
+		t.settledMinDelay = min
+		t.settledMaxDelay = max
+	}
+}
+
+// WithRiskOptions configures the risk engine that assesses new payments.
+func WithRiskOptions(opts ...risk.Option) Option {
+	return func(t *transitionerImpl) {
+		t.riskOpts = append(t.riskOpts, opts...)
+	}
+}
+
+// New creates a new Transitioner that processes payments with the acquirers selected by the router.
+func New(s store.Store, router routing.Router, opts ...Option) Transitioner {
 	t := &transitionerImpl{
-		s:   s,
-		acq: acq,
+		s:            s,
+		router:       router,
+		batchSize:    100,
+		pollInterval: 5 * time.Second,
+		retryPolicy:  DefaultRetryPolicy,
+		concurrency:  10,
+		drainTimeout: 30 * time.Second,
+		locks:        newKeyedMutex(),
+
+		settledMinDelay: time.Minute,
+		settledMaxDelay: 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.concurrency < 1 {
+		t.concurrency = 1
 	}
+	t.risk = risk.New(s, t.riskOpts...)
 	return t
 }
 
-// Start initiates a background worker that scans all gateway payments and syncs their status with the acquirer.
+// Start initiates a background worker that transitions active payments and syncs their status with the acquirer.
+//
+// Payments that become due immediately (e.g. new ones) are announced by the store notifications
+// and transitioned right away. A periodic sweep claims the rest of the due payments, e.g. those
+// rescheduled after an attempt, and catches up on notifications missed while the listener was down.
+// Each claimed payment is postponed by the poll interval, so that it is attempted again later unless
+// it reaches a final state. Failed attempts are retried according to the retry policy.
+// Settled payments are synced with the acquirer after a delay that grows with their age (see WithSettledResync).
+//
+// Claimed payments are transitioned by a pool of goroutines of the configured concurrency.
+// When the context is cancelled, the worker stops claiming payments and waits (up to the drain timeout)
+// for the transitions in progress to finish. Claimed payments that have not been started yet are
+// picked up again once their claim expires.
 func (t *transitionerImpl) Start(ctx context.Context) {
-	for {
-		ids, err := t.s.Payments().ListAll(ctx)
-		if err != nil {
-			log.Printf("[ERR] %v", err)
-			continue
+	// In-flight attempts use their own context, so that they are not interrupted half-way when the worker stops.
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < t.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				t.attempt(workCtx, id)
+			}
+		}()
+	}
+
+	var producers sync.WaitGroup
+	producers.Add(2)
+	go func() {
+		defer producers.Done()
+		t.listen(ctx, jobs)
+	}()
+	go func() {
+		defer producers.Done()
+		t.sweep(ctx, jobs)
+	}()
+	producers.Wait()
+	close(jobs)
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(t.drainTimeout):
+		log.Printf("[WARN] transitions in progress did not finish in %s, aborting", t.drainTimeout)
+		cancelWork()
+		<-drained
+	}
+}
+
+// listen claims payments announced as due by the store notifications and hands them over to the workers
+// until the context is cancelled. The subscription is re-established if it fails.
+func (t *transitionerImpl) listen(ctx context.Context, jobs chan<- string) {
+	for ctx.Err() == nil {
+		err := t.s.Payments().ListenDue(ctx, func(id string) {
+			claimed, err := t.s.Payments().Claim(ctx, id, t.pollInterval)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[ERR] could not claim payment %s: %v", id, err)
+				}
+				return
+			}
+			if !claimed {
+				// Another worker has got to it first.
+				return
+			}
+
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] payment notifications are interrupted, falling back to polling: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// sweep periodically claims due payments and hands them over to the workers until the context is cancelled.
+func (t *transitionerImpl) sweep(ctx context.Context, jobs chan<- string) {
+	for ctx.Err() == nil {
+		ids, err := t.s.Payments().ClaimDue(ctx, t.batchSize, t.pollInterval)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[ERR] could not claim payments: %v", err)
 		}
 
 		for _, id := range ids {
-			err := t.Transition(ctx, id)
-			if err != nil {
-				// Skip the payment since it is likely not persisted in the acquirer.
-				continue
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(ids) == t.batchSize {
+			// There may be more due payments, claim the next batch right away.
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// attempt transitions the payment and records the outcome of the attempt.
+func (t *transitionerImpl) attempt(ctx context.Context, id string) {
+	errT := t.Transition(ctx, id)
+	if errT == store.ErrLocked {
+		// Another gateway instance is transitioning the payment right now.
+		return
+	}
+	exhausted := false
+
+	err := t.s.Payments().Update(ctx, id, func(py *models.Payment) error {
+		if errT == nil {
+			if py.Attempts == 0 {
+				return errNoChanges
 			}
+			py.Attempts = 0
+			py.LastError = ""
+			next := time.Now().UTC().Add(t.nextDelay(py))
+			py.NextAttemptAt = &next
+			return nil
+		}
+
+		py.Attempts++
+		py.LastError = errT.Error()
+		if exhausted = t.retryPolicy.Exhausted(py.Attempts); exhausted {
+			return py.SetState(models.PaymentStateNeedsAttention)
 		}
+		next := time.Now().UTC().Add(t.retryPolicy.Backoff(py.Attempts))
+		py.NextAttemptAt = &next
+		return nil
+	}, store.ForUpdate())
+
+	if err == errNoChanges {
+		err = t.reschedule(ctx, id)
+	}
+
+	switch {
+	case err != nil:
+		log.Printf("[ERR] could not record transition attempt of payment %s: %v", id, err)
+	case exhausted:
+		log.Printf("[ERR] payment %s needs attention, giving up after %d attempts: %v", id, t.retryPolicy.MaxAttempts, errT)
+	case errors.Is(errT, models.ErrUnmappedAcquirerState):
+		log.Printf("[ERR] payment %s cannot be transitioned until the gateway supports the acquirer state: %v", id, errT)
+	case errT != nil:
+		log.Printf("[WARN] could not transition payment %s: %v", id, errT)
+	}
+}
 
-		time.Sleep(5 * time.Second)
+// reschedule sets the next attempt of a payment after a successful one, replacing the time set by the claim.
+func (t *transitionerImpl) reschedule(ctx context.Context, id string) error {
+	p, err := t.s.Payments().Get(ctx, id)
+	if err != nil {
+		return err
 	}
+	return t.s.Payments().Reschedule(ctx, id, p.Version, time.Now().UTC().Add(t.nextDelay(p)))
+}
 
+// nextDelay returns the delay before the next attempt after a successful one: the poll interval,
+// or the settled resync delay for settled payments.
+func (t *transitionerImpl) nextDelay(p *models.Payment) time.Duration {
+	if p.State.IsSettled() {
+		return t.settledDelay(p)
+	}
+	return t.pollInterval
+}
+
+// settledDelay returns the delay before the next sync of a settled payment: the age of the payment,
+// bounded by the settled resync delays.
+func (t *transitionerImpl) settledDelay(p *models.Payment) time.Duration {
+	d := time.Since(p.CreatedAt)
+	if d < t.settledMinDelay {
+		d = t.settledMinDelay
+	}
+	if d > t.settledMaxDelay {
+		d = t.settledMaxDelay
+	}
+	return d
 }
 
 // Transition synchronously transitions a payment of the given ID through the acquiring process.
 // The transition stops when the payment reaches one of the final states, PaymentStateActionRequired, or an error occurs.
+// Transitions of the same payment never run in parallel: within the process they wait for each other,
+// and store.ErrLocked is returned if another gateway instance is transitioning the payment.
+//
+// The transition is a saga: every acquirer call is a separate step, and its outcome is persisted
+// in a short local transaction before the next step begins. No transaction is held during acquirer calls,
+// and an interrupted transition resumes from the last persisted step.
+//
+// Before the payment reaches any acquirer, its risk is assessed by the risk rules: a blocked payment is rejected,
+// and a payment held for review needs attention until it is retried manually.
+//
+// The payment is processed by the primary acquirer of its route. If the acquirer fails before the payment
+// is authorised, the payment fails over to the next acquirer of the route.
 func (t *transitionerImpl) Transition(ctx context.Context, id string) error {
-	return t.s.Tx(ctx, func(ctx context.Context) error {
-		for {
-			p, err := t.s.Payments().Get(ctx, id)
-			if err != nil {
-				return err
+	unlock := t.locks.Lock(id)
+	defer unlock()
+
+	return t.s.WithLock(ctx, "payment:"+id, func(ctx context.Context) error {
+		return t.transition(ctx, id)
+	})
+}
+
+func (t *transitionerImpl) transition(ctx context.Context, id string) error {
+	for {
+		p, err := t.s.Payments().Get(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case p.AcquiringId == "" && p.RiskDecision == "":
+			if errC := t.assessRisk(ctx, p); errC != nil {
+				return errC
 			}
 
-			switch p.AcquiringState {
-			case "":
-				if errC := t.initialisePayment(ctx, p); errC != nil {
-					return errC
-				}
+		case p.AcquiringId == "" && p.State != models.PaymentStateProcessing:
+			// Blocked or held for review by the risk rules.
+			return nil
 
-			case string(acquirer.PaymentStateAuthorised):
-				if errC := t.confirmPayment(ctx, p); errC != nil {
-					return errC
-				}
+		case p.AcquiringId == "":
+			if errC := t.reservePayment(ctx, p); errC != nil {
+				return errC
+			}
+
+		case p.AcquiringState == "":
+			if errC := t.createPayment(ctx, p); errC != nil {
+				return errC
+			}
 
-			default:
-				return t.syncPayment(ctx, p)
+		case p.AcquiringState == string(acquiring.PaymentStateCreated):
+			if errC := t.authorisePayment(ctx, p); errC != nil {
+				return errC
 			}
+
+		case p.AcquiringState == string(acquiring.PaymentStateAuthorised):
+			if errC := t.confirmPayment(ctx, p); errC != nil {
+				return errC
+			}
+
+		default:
+			return t.syncPayment(ctx, p)
 		}
-	})
+	}
 }
 
-func (t *transitionerImpl) initialisePayment(ctx context.Context, payment *models.Payment) error {
-	aId := uuid.NewString()
+// advance persists the acquirer payment returned by a saga step,
+// unless the gateway payment has changed since the step started.
+func (t *transitionerImpl) advance(ctx context.Context, payment *models.Payment, rPayment *acquiring.Payment) error {
+	return t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
+		if py.AcquiringId != payment.AcquiringId || py.AcquiringVersion != payment.AcquiringVersion {
+			return errPaymentChanged
+		}
+		py.AcquiringVersion = rPayment.Version
+		py.AcquiringState = string(rPayment.State)
+		py.DeclineCode = string(rPayment.DeclineCode)
+		return py.SyncState()
+	}, store.ForUpdate())
+}
 
-	rCreate, err := t.acq.CreatePayment(&acquirer.CreatePaymentRequest{
-		Id:       acquirer.PaymentId(aId),
-		Amount:   payment.Amount,
-		Currency: payment.Currency,
-	})
+// resume recovers from a failed saga step. If the acquirer payment has moved on since the gateway last saw it,
+// the step has already been applied by an interrupted transition, and its outcome is persisted instead.
+// Otherwise, the step error is returned.
+func (t *transitionerImpl) resume(ctx context.Context, payment *models.Payment, errStep error) error {
+	if !errors.Is(errStep, acquiring.ErrVersionMismatch) {
+		return errStep
+	}
+
+	acq, err := t.acquirerOf(payment)
+	if err != nil {
+		return errStep
+	}
+	rGet, err := acq.GetPayment(ctx, payment.AcquiringId)
+	if err != nil {
+		return errStep
+	}
+	if rGet.Version == payment.AcquiringVersion {
+		return errStep
+	}
+
+	return t.advance(ctx, payment, rGet)
+}
+
+// failover switches the payment to the next acquirer of its route after the current one has failed a saga step
+// before the payment is authorised. The step error is returned if there is no acquirer to fail over to,
+// or the payment may have been authorised: the acquirer payment must be known to be new or not created.
+// The payment left behind in the failed acquirer (if any) is never authorised, so no funds are held there.
+func (t *transitionerImpl) failover(ctx context.Context, payment *models.Payment, errStep error) error {
+	next, ok := t.router.Failover(payment)
+	if !ok {
+		return errStep
+	}
+
+	if payment.AcquiringState != "" {
+		acq, err := t.acquirerOf(payment)
+		if err != nil {
+			return errStep
+		}
+		rGet, err := acq.GetPayment(ctx, payment.AcquiringId)
+		if err != nil || rGet.State != acquiring.PaymentStateCreated || rGet.Version != payment.AcquiringVersion {
+			return errStep
+		}
+	}
+
+	err := t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
+		if py.Acquirer != payment.Acquirer || py.AcquiringId != payment.AcquiringId || py.AcquiringVersion != payment.AcquiringVersion {
+			return errPaymentChanged
+		}
+		py.Acquirer = next
+		py.AcquiringId = uuid.NewString()
+		py.AcquiringState = ""
+		py.AcquiringVersion = ""
+		return nil
+	}, store.ForUpdate())
 	if err != nil {
 		return err
 	}
 
-	rAuth, err := t.acq.AuthorisePayment(rCreate.Id, rCreate.Version, &acquirer.AuthorisePaymentRequest{
-		CardNumber: payment.CardNumber,
-		ExpiryDate: payment.ExpiryDate,
-		CardHolder: payment.CardHolder,
-		Cvv:        payment.Cvv,
-	})
+	log.Printf("[WARN] payment %s fails over from acquirer %s to %s: %v", payment.Id, payment.Acquirer, next, errStep)
+	return nil
+}
+
+// acquirerOf returns the acquirer the payment is routed to.
+func (t *transitionerImpl) acquirerOf(payment *models.Payment) (acquiring.AcquirerAdapter, error) {
+	return t.router.Acquirer(payment.Acquirer)
+}
+
+// assessRisk evaluates the risk rules against the payment and persists the decision.
+// A blocked payment is rejected, and a payment held for review needs attention.
+func (t *transitionerImpl) assessRisk(ctx context.Context, payment *models.Payment) error {
+	a, err := t.risk.Assess(ctx, payment)
+	if err != nil {
+		return err
+	}
 
+	err = t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
+		if py.AcquiringId != "" || py.RiskDecision != "" {
+			return errPaymentChanged
+		}
+		py.RiskScore = a.Score
+		py.RiskDecision = a.Decision
+		switch a.Decision {
+		case models.RiskDecisionBlock:
+			return py.SetState(models.PaymentStateRejected)
+		case models.RiskDecisionReview:
+			return py.SetState(models.PaymentStateNeedsAttention)
+		}
+		return nil
+	}, store.ForUpdate())
+	if err != nil {
+		return err
+	}
+
+	if a.Decision != models.RiskDecisionAllow {
+		log.Printf("[INFO] payment %s risk decision is %s with score %d, matched rules: %v", payment.Id, a.Decision, a.Score, a.Rules)
+	}
+	return nil
+}
+
+// reservePayment routes the payment to the primary acquirer of its route and persists the ID of the acquirer
+// payment before the acquirer payment is created, so that an interrupted transition creates the same acquirer payment
+// rather than an orphaned one.
+func (t *transitionerImpl) reservePayment(ctx context.Context, payment *models.Payment) error {
 	return t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
-		py.AcquiringId = aId
-		py.AcquiringVersion = rAuth.Payment.Version
-		py.AcquiringState = string(rAuth.Payment.State)
-		py.SyncState()
+		if py.AcquiringId != "" {
+			return errPaymentChanged
+		}
+		py.Acquirer = t.router.Route(py)[0]
+		py.AcquiringId = uuid.NewString()
 		return nil
+	}, store.ForUpdate())
+}
+
+// createPayment creates the acquirer payment with the reserved ID. The acquirer deduplicates payments by ID,
+// so if the payment has already been created, it is returned as is, in whatever state it has reached.
+func (t *transitionerImpl) createPayment(ctx context.Context, payment *models.Payment) error {
+	acq, err := t.acquirerOf(payment)
+	if err != nil {
+		return err
+	}
+	force3ds := payment.RiskDecision == models.RiskDecisionForce3ds
+	if force3ds && !acq.Capabilities().ThreeDSecure {
+		return t.failover(ctx, payment, fmt.Errorf("acquirer %s does not support 3DS required by the risk rules", payment.Acquirer))
+	}
+	rCreate, err := acq.CreatePayment(ctx, &acquiring.CreatePaymentRequest{
+		Id:           payment.AcquiringId,
+		Amount:       payment.Amount,
+		Currency:     payment.Currency,
+		ThreeDSecure: force3ds,
+	})
+	if err != nil {
+		return t.failover(ctx, payment, err)
+	}
+
+	return t.advance(ctx, payment, rCreate)
+}
+
+func (t *transitionerImpl) authorisePayment(ctx context.Context, payment *models.Payment) error {
+	acq, err := t.acquirerOf(payment)
+	if err != nil {
+		return err
+	}
+	rAuth, err := acq.AuthorisePayment(ctx, payment.AcquiringId, payment.AcquiringVersion, &acquiring.Card{
+		Number:     payment.CardNumber,
+		ExpiryDate: payment.ExpiryDate,
+		Holder:     payment.CardHolder,
+		Cvv:        payment.Cvv,
 	})
+	if errors.Is(err, acquiring.ErrVersionMismatch) {
+		return t.resume(ctx, payment, err)
+	}
+	if err != nil {
+		return t.failover(ctx, payment, err)
+	}
+
+	return t.advance(ctx, payment, rAuth)
 }
 
 func (t *transitionerImpl) confirmPayment(ctx context.Context, payment *models.Payment) error {
-	rConfirm, err := t.acq.ConfirmPayment(acquirer.PaymentId(payment.AcquiringId), payment.AcquiringVersion)
+	acq, err := t.acquirerOf(payment)
 	if err != nil {
 		return err
 	}
+	rCapture, err := acq.CapturePayment(ctx, payment.AcquiringId, payment.AcquiringVersion)
+	if err != nil {
+		return t.resume(ctx, payment, err)
+	}
 
-	return t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
-		py.AcquiringVersion = rConfirm.Payment.Version
-		py.AcquiringState = string(rConfirm.Payment.State)
-		py.SyncState()
-		return nil
-	})
+	return t.advance(ctx, payment, rCapture)
 }
 
 func (t *transitionerImpl) syncPayment(ctx context.Context, payment *models.Payment) error {
-	rGet, err := t.acq.GetPayment(acquirer.PaymentId(payment.AcquiringId))
+	acq, err := t.acquirerOf(payment)
+	if err != nil {
+		return err
+	}
+	rGet, err := acq.GetPayment(ctx, payment.AcquiringId)
 	if err != nil {
 		return err
 	}
@@ -132,14 +601,91 @@ func (t *transitionerImpl) syncPayment(ctx context.Context, payment *models.Paym
 		return nil
 	}
 
-	err = t.s.Payments().Update(ctx, payment.Id, func(py *models.Payment) error {
-		py.AcquiringVersion = rGet.Version
-		py.AcquiringState = string(rGet.State)
-		py.SyncState()
-		return nil
+	var rDispute *acquiring.Dispute
+	if rGet.DisputeId != "" {
+		if rDispute, err = acq.GetDispute(ctx, rGet.DisputeId); err != nil {
+			return err
+		}
+	}
+
+	return t.s.Tx(ctx, func(ctx context.Context) error {
+		if rDispute != nil {
+			if err := t.syncDispute(ctx, payment, rDispute); err != nil {
+				return err
+			}
+		}
+		return t.advance(ctx, payment, rGet)
 	})
+}
+
+// TransitionDispute synchronously submits the dispute evidence to the acquirer, if any, and syncs the dispute state.
+// The acquirer call is made outside of a transaction; its outcome is persisted unless the dispute has changed meanwhile.
+func (t *transitionerImpl) TransitionDispute(ctx context.Context, id string) error {
+	d, err := t.s.Disputes().Get(ctx, id)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	if d.Evidence == "" || d.AcquiringState != string(acquiring.DisputeStateOpen) {
+		return nil
+	}
+
+	p, err := t.s.Payments().Get(ctx, d.PaymentId)
+	if err != nil {
+		return err
+	}
+	acq, err := t.acquirerOf(p)
+	if err != nil {
+		return err
+	}
+
+	rDispute, err := acq.SubmitDisputeEvidence(ctx, d.AcquiringId, d.AcquiringVersion, d.Evidence)
+	if err != nil {
+		return err
+	}
+
+	return t.s.Disputes().Update(ctx, d.Id, func(dm *models.Dispute) error {
+		if dm.AcquiringVersion != d.AcquiringVersion {
+			return errDisputeChanged
+		}
+		dm.AcquiringVersion = rDispute.Version
+		dm.AcquiringState = string(rDispute.State)
+		dm.SyncState()
+		return nil
+	})
+}
+
+// syncDispute creates or updates the gateway dispute from the acquirer dispute raised against the given payment.
+func (t *transitionerImpl) syncDispute(ctx context.Context, payment *models.Payment, rDispute *acquiring.Dispute) error {
+	d, err := t.s.Disputes().GetByAcquiringId(ctx, rDispute.Id)
+	switch {
+	case err == store.ErrNotFound:
+		d = &models.Dispute{
+			Id:               uuid.NewString(),
+			PaymentId:        payment.Id,
+			Reason:           rDispute.Reason,
+			Amount:           rDispute.Amount,
+			Currency:         rDispute.Currency,
+			EvidenceDueBy:    rDispute.EvidenceDueBy,
+			AcquiringId:      rDispute.Id,
+			AcquiringState:   string(rDispute.State),
+			AcquiringVersion: rDispute.Version,
+		}
+		d.SyncState()
+		_, err = t.s.Disputes().Create(ctx, d)
+		return err
+	case err != nil:
+		return err
+	}
+
+	if d.AcquiringVersion == rDispute.Version {
+		return nil
+	}
+
+	return t.s.Disputes().Update(ctx, d.Id, func(dm *models.Dispute) error {
+		dm.AcquiringVersion = rDispute.Version
+		dm.AcquiringState = string(rDispute.State)
+		dm.SyncState()
+		return nil
+	})
 }
@@ -0,0 +1,383 @@
+package transitioner
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"mkuznets.com/go/upsp/acquirer"
+	"mkuznets.com/go/upsp/gateway/acquiring"
+	"mkuznets.com/go/upsp/gateway/acquiring/simulator"
+	"mkuznets.com/go/upsp/gateway/models"
+	"mkuznets.com/go/upsp/gateway/routing"
+	"mkuznets.com/go/upsp/gateway/store"
+	"mkuznets.com/go/upsp/gateway/store/storetest"
+	"testing"
+	"time"
+)
+
+var errUnavailable = errors.New("acquirer is unavailable")
+
+// flakyAcquirer fails the acquirer calls as configured and passes the rest to the acquirer simulator.
+type flakyAcquirer struct {
+	acquiring.AcquirerAdapter
+
+	failCreate    bool
+	failAuthorise bool
+	// no3ds hides the 3DS support of the simulator.
+	no3ds bool
+	// lostConfirmations is the number of successful confirmations whose responses are lost.
+	lostConfirmations int
+}
+
+func (a *flakyAcquirer) Capabilities() acquiring.Capabilities {
+	c := a.AcquirerAdapter.Capabilities()
+	c.ThreeDSecure = c.ThreeDSecure && !a.no3ds
+	return c
+}
+
+func (a *flakyAcquirer) CreatePayment(ctx context.Context, req *acquiring.CreatePaymentRequest) (*acquiring.Payment, error) {
+	if a.failCreate {
+		return nil, errUnavailable
+	}
+	return a.AcquirerAdapter.CreatePayment(ctx, req)
+}
+
+func (a *flakyAcquirer) AuthorisePayment(ctx context.Context, id, version string, card *acquiring.Card) (*acquiring.Payment, error) {
+	if a.failAuthorise {
+		return nil, errUnavailable
+	}
+	return a.AcquirerAdapter.AuthorisePayment(ctx, id, version, card)
+}
+
+func (a *flakyAcquirer) CapturePayment(ctx context.Context, id, version string) (*acquiring.Payment, error) {
+	resp, err := a.AcquirerAdapter.CapturePayment(ctx, id, version)
+	if err == nil && a.lostConfirmations > 0 {
+		a.lostConfirmations--
+		return nil, errUnavailable
+	}
+	return resp, err
+}
+
+func newSimulator() acquiring.AcquirerAdapter {
+	return simulator.New(acquirer.New(acquirer.NewStore()))
+}
+
+// newRouter registers the given acquirers as "primary", "secondary", and so on, in the default route.
+func newRouter(t *testing.T, acqs ...acquiring.AcquirerAdapter) routing.Router {
+	names := []string{"primary", "secondary", "tertiary"}
+	var opts []routing.Option
+	for i, acq := range acqs {
+		opts = append(opts, routing.WithAcquirer(names[i], acq))
+	}
+	router, err := routing.New(opts...)
+	require.NoError(t, err)
+	return router
+}
+
+func TestTransitioner_Transition(t *testing.T) {
+	tests := []struct {
+		name       string
+		cardNumber string
+		state      models.PaymentState
+	}{
+		{"no 3ds", "4242424242424242", models.PaymentStateActionPaid},
+		{"3ds required", "4000000000003220", models.PaymentStateActionRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemory()
+			tr := New(s, newRouter(t, newSimulator()))
+
+			id := storetest.CreatePayment(t, s.Payments(), storetest.WithCardNumber(tt.cardNumber)).Id
+			require.NoError(t, tr.Transition(ctx, id))
+
+			p, err := s.Payments().Get(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.state, p.State)
+			assert.NotEmpty(t, p.AcquiringId)
+			assert.NotEmpty(t, p.AcquiringVersion)
+		})
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		acq := &flakyAcquirer{AcquirerAdapter: newSimulator(), lostConfirmations: 1}
+		tr := New(s, newRouter(t, acq))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		assert.ErrorIs(t, tr.Transition(ctx, id), errUnavailable)
+
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateProcessing, p.State)
+		assert.Equal(t, string(acquiring.PaymentStateAuthorised), p.AcquiringState)
+
+		// The acquirer has confirmed the payment already, the next transition adopts the confirmation.
+		require.NoError(t, tr.Transition(ctx, id))
+
+		p, err = s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+	})
+
+	t.Run("locked", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		tr := New(s, newRouter(t, newSimulator()))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		err := s.WithLock(ctx, "payment:"+id, func(ctx context.Context) error {
+			return tr.Transition(ctx, id)
+		})
+		assert.ErrorIs(t, err, store.ErrLocked)
+	})
+}
+
+func TestTransitioner_Failover(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary *flakyAcquirer
+	}{
+		{"create failed", &flakyAcquirer{AcquirerAdapter: newSimulator(), failCreate: true}},
+		{"authorise failed", &flakyAcquirer{AcquirerAdapter: newSimulator(), failAuthorise: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemory()
+			secondary := newSimulator()
+			tr := New(s, newRouter(t, tt.primary, secondary))
+
+			id := storetest.CreatePayment(t, s.Payments()).Id
+			require.NoError(t, tr.Transition(ctx, id))
+
+			p, err := s.Payments().Get(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, models.PaymentStateActionPaid, p.State)
+			assert.Equal(t, "secondary", p.Acquirer)
+
+			rGet, err := secondary.GetPayment(ctx, p.AcquiringId)
+			require.NoError(t, err)
+			assert.Equal(t, acquiring.PaymentStateCaptured, rGet.State)
+		})
+	}
+
+	t.Run("no acquirer left", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		failing := func() *flakyAcquirer {
+			return &flakyAcquirer{AcquirerAdapter: newSimulator(), failCreate: true}
+		}
+		tr := New(s, newRouter(t, failing(), failing()))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		assert.ErrorIs(t, tr.Transition(ctx, id), errUnavailable)
+
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateProcessing, p.State)
+		assert.Equal(t, "secondary", p.Acquirer)
+	})
+
+	t.Run("after authorisation", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		primary := &flakyAcquirer{AcquirerAdapter: newSimulator(), lostConfirmations: 1}
+		tr := New(s, newRouter(t, primary, newSimulator()))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		assert.ErrorIs(t, tr.Transition(ctx, id), errUnavailable)
+
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, "primary", p.Acquirer, "authorised payment must not fail over")
+	})
+}
+
+func TestTransitioner_Risk(t *testing.T) {
+	tests := []struct {
+		name     string
+		action   models.RiskDecision
+		state    models.PaymentState
+		acquired bool
+	}{
+		{"block", models.RiskDecisionBlock, models.PaymentStateRejected, false},
+		{"review", models.RiskDecisionReview, models.PaymentStateNeedsAttention, false},
+		{"force 3ds", models.RiskDecisionForce3ds, models.PaymentStateActionRequired, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := store.NewMemory()
+			tr := New(s, newRouter(t, newSimulator()))
+
+			require.NoError(t, s.RiskRules().Save(ctx, &models.RiskRule{
+				Id: "r1", Kind: models.RiskRuleAmount, Action: tt.action, Score: 40, Enabled: true,
+				Params: models.RiskRuleParams{Currency: "EUR", MinAmount: 100},
+			}))
+
+			id := storetest.CreatePayment(t, s.Payments()).Id
+			require.NoError(t, tr.Transition(ctx, id))
+
+			p, err := s.Payments().Get(ctx, id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.state, p.State)
+			assert.Equal(t, tt.action, p.RiskDecision)
+			assert.Equal(t, 40, p.RiskScore)
+			assert.Equal(t, tt.acquired, p.AcquiringId != "")
+		})
+	}
+
+	t.Run("allow", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		tr := New(s, newRouter(t, newSimulator()))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		require.NoError(t, tr.Transition(ctx, id))
+
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+		assert.Equal(t, models.RiskDecisionAllow, p.RiskDecision)
+	})
+
+	t.Run("force 3ds fails over", func(t *testing.T) {
+		ctx := context.Background()
+		s := store.NewMemory()
+		tr := New(s, newRouter(t, &flakyAcquirer{AcquirerAdapter: newSimulator(), no3ds: true}, newSimulator()))
+
+		require.NoError(t, s.RiskRules().Save(ctx, &models.RiskRule{
+			Id: "r1", Kind: models.RiskRuleAmount, Action: models.RiskDecisionForce3ds, Enabled: true,
+			Params: models.RiskRuleParams{Currency: "EUR"},
+		}))
+
+		id := storetest.CreatePayment(t, s.Payments()).Id
+		require.NoError(t, tr.Transition(ctx, id))
+
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateActionRequired, p.State)
+		assert.Equal(t, "secondary", p.Acquirer)
+	})
+}
+
+func TestTransitioner_attempt(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	acq := &flakyAcquirer{AcquirerAdapter: newSimulator(), failCreate: true}
+	tr := New(s, newRouter(t, acq), WithRetryPolicy(RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Second, MaxAttempts: 2})).(*transitionerImpl)
+
+	id := storetest.CreatePayment(t, s.Payments()).Id
+
+	tr.attempt(ctx, id)
+	p, err := s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStateProcessing, p.State)
+	assert.Equal(t, 1, p.Attempts)
+	assert.Equal(t, errUnavailable.Error(), p.LastError)
+	require.NotNil(t, p.NextAttemptAt)
+	assert.True(t, p.NextAttemptAt.After(time.Now()), "failed attempt must be retried later")
+
+	tr.attempt(ctx, id)
+	p, err = s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStateNeedsAttention, p.State)
+	assert.Equal(t, 2, p.Attempts)
+	assert.Nil(t, p.NextAttemptAt, "payment that needs attention must not be retried")
+
+	acq.failCreate = false
+	require.NoError(t, s.Payments().Update(ctx, id, func(py *models.Payment) error {
+		return py.SetState(models.PaymentStateProcessing)
+	}))
+
+	tr.attempt(ctx, id)
+	p, err = s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStateActionPaid, p.State)
+	assert.Equal(t, 0, p.Attempts)
+	assert.Empty(t, p.LastError)
+	require.NotNil(t, p.NextAttemptAt)
+	assert.True(t, p.NextAttemptAt.After(time.Now().Add(tr.settledMinDelay/2)), "paid payment must be synced on the settled schedule")
+}
+
+func TestTransitioner_attempt_recovered(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	acq := &flakyAcquirer{AcquirerAdapter: newSimulator(), failCreate: true}
+	tr := New(s, newRouter(t, acq), WithRetryPolicy(RetryPolicy{BaseDelay: time.Hour, MaxDelay: time.Hour, MaxAttempts: 3})).(*transitionerImpl)
+
+	id := storetest.CreatePayment(t, s.Payments(), storetest.WithCardNumber("4000000000003220")).Id
+	tr.attempt(ctx, id)
+	p, err := s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+	require.NotNil(t, p.NextAttemptAt)
+	require.True(t, p.NextAttemptAt.After(time.Now().Add(time.Minute)), "failed attempt must be backed off")
+
+	acq.failCreate = false
+	tr.attempt(ctx, id)
+	p, err = s.Payments().Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStateActionRequired, p.State)
+	assert.Equal(t, 0, p.Attempts)
+	require.NotNil(t, p.NextAttemptAt)
+	assert.True(t, p.NextAttemptAt.Before(time.Now().Add(tr.pollInterval+time.Second)),
+		"recovered payment must be attempted again after the poll interval, not the backoff")
+}
+
+func TestTransitioner_attempt_settled(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemory()
+	tr := New(s, newRouter(t, newSimulator()), WithPollInterval(10*time.Millisecond),
+		WithSettledResync(time.Hour, 24*time.Hour)).(*transitionerImpl)
+
+	id := storetest.CreatePayment(t, s.Payments()).Id
+	ids, err := s.Payments().ClaimDue(ctx, 10, tr.pollInterval)
+	require.NoError(t, err)
+	require.Equal(t, []string{id}, ids)
+
+	for i := 0; i < 2; i++ {
+		tr.attempt(ctx, id)
+		p, err := s.Payments().Get(ctx, id)
+		require.NoError(t, err)
+		assert.Equal(t, models.PaymentStateActionPaid, p.State)
+		require.NotNil(t, p.NextAttemptAt)
+		assert.True(t, p.NextAttemptAt.After(time.Now().Add(30*time.Minute)), "attempt %d", i+1)
+	}
+
+	time.Sleep(2 * tr.pollInterval)
+	ids, err = s.Payments().ClaimDue(ctx, 10, tr.pollInterval)
+	require.NoError(t, err)
+	assert.Empty(t, ids, "paid payment must not be claimed again within the poll interval")
+}
+
+func TestTransitioner_Start(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := store.NewMemory()
+	tr := New(s, newRouter(t, newSimulator()), WithPollInterval(100*time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Start(ctx)
+	}()
+
+	id := storetest.CreatePayment(t, s.Payments()).Id
+	assert.Eventually(t, func() bool {
+		p, err := s.Payments().Get(ctx, id)
+		return err == nil && p.State == models.PaymentStateActionPaid
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker has not stopped")
+	}
+}
@@ -0,0 +1,103 @@
+package money
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultExponent is the number of decimals of the currencies that are not listed in exponents.
+const defaultExponent = 2
+
+// exponents are the ISO 4217 minor unit exponents of the currencies that do not have two decimals.
+var exponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+
+	"CLF": 4, "UYW": 4,
+}
+
+// defaultMaxMajor is the largest amount of a single payment in the major units of the currency,
+// unless the currency has its own limit in maxMajor.
+const defaultMaxMajor = 999_999
+
+// maxMajor are the per-currency limits of a single payment in major units. The currencies with a low unit value
+// have higher limits, so that every limit is roughly within the same order of value.
+var maxMajor = map[string]int64{
+	"HUF": 99_999_999,
+	"IDR": 9_999_999_999,
+	"JPY": 99_999_999,
+	"KRW": 999_999_999,
+	"VND": 9_999_999_999,
+}
+
+// Money is an amount of money in the minor units of its currency, e.g. cents for EUR, or yen for JPY.
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// New creates Money of the given amount in minor units and the ISO 4217 currency code.
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToUpper(currency)}
+}
+
+// Exponent returns the number of decimals of the currency, i.e. its minor unit is 10^-exponent of the major one.
+func Exponent(currency string) int {
+	if exp, ok := exponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return defaultExponent
+}
+
+// MaxAmount returns the largest amount of a single payment in the minor units of the currency.
+func MaxAmount(currency string) int64 {
+	max, ok := maxMajor[strings.ToUpper(currency)]
+	if !ok {
+		max = defaultMaxMajor
+	}
+	return (max+1)*pow10(Exponent(currency)) - 1
+}
+
+// Minor converts an amount with the given number of decimals to the minor units of the currency,
+// rounding half away from zero if the currency has fewer decimals.
+func Minor(amount int64, decimals int, currency string) int64 {
+	exp := Exponent(currency)
+	if exp >= decimals {
+		return amount * pow10(exp-decimals)
+	}
+
+	d := pow10(decimals - exp)
+	q, r := amount/d, amount%d
+	switch {
+	case 2*r >= d:
+		q++
+	case 2*r <= -d:
+		q--
+	}
+	return q
+}
+
+// Display formats the money for humans, with the decimals of its currency, e.g. "10.50 EUR", "1050 JPY".
+func (m Money) Display() string {
+	exp := Exponent(m.Currency)
+	if exp == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	d := pow10(exp)
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/d, exp, amount%d, m.Currency)
+}
+
+func pow10(n int) int64 {
+	p := int64(1)
+	for i := 0; i < n; i++ {
+		p *= 10
+	}
+	return p
+}
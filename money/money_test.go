@@ -0,0 +1,53 @@
+package money
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExponent(t *testing.T) {
+	assert.Equal(t, 2, Exponent("EUR"))
+	assert.Equal(t, 0, Exponent("JPY"))
+	assert.Equal(t, 3, Exponent("kwd"))
+	assert.Equal(t, 4, Exponent("CLF"))
+}
+
+func TestMaxAmount(t *testing.T) {
+	assert.Equal(t, int64(99999999), MaxAmount("EUR"))
+	assert.Equal(t, int64(99999999), MaxAmount("JPY"))
+	assert.Equal(t, int64(999999999), MaxAmount("KWD"))
+	assert.Equal(t, int64(9999999999), MaxAmount("HUF"))
+}
+
+func TestMinor(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		decimals int
+		currency string
+		minor    int64
+	}{
+		{20, 2, "EUR", 20},
+		{20, 2, "KWD", 200},
+		{1500, 2, "JPY", 15},
+		{150, 2, "JPY", 2},
+		{149, 2, "JPY", 1},
+		{-150, 2, "JPY", -2},
+		{-149, 2, "JPY", -1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.minor, Minor(tt.amount, tt.decimals, tt.currency), "%d/%d %s", tt.amount, tt.decimals, tt.currency)
+	}
+}
+
+func TestMoney_Display(t *testing.T) {
+	tests := map[string]Money{
+		"10.50 EUR": New(1050, "eur"),
+		"0.05 EUR":  New(5, "EUR"),
+		"-0.50 EUR": New(-50, "EUR"),
+		"1050 JPY":  New(1050, "JPY"),
+		"1.050 KWD": New(1050, "KWD"),
+	}
+	for display, m := range tests {
+		assert.Equal(t, display, m.Display())
+	}
+}